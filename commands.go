@@ -0,0 +1,627 @@
+package main
+
+import (
+	"beanckup-cli/internal/backupset"
+	"beanckup-cli/internal/catalog"
+	"beanckup-cli/internal/history"
+	"beanckup-cli/internal/lock"
+	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/restorer"
+	"beanckup-cli/internal/signing"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/watcher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runCommand 处理命令行子命令，返回进程退出码。不带参数运行时进入交互式菜单。
+func runCommand(args []string) int {
+	switch args[0] {
+	case "watch":
+		return cmdWatch(args[1:])
+	case "migrate":
+		return cmdMigrate(args[1:])
+	case "deleted":
+		return cmdDeleted(args[1:])
+	case "catalog":
+		return cmdCatalog(args[1:])
+	case "keygen":
+		return cmdKeygen(args[1:])
+	case "reattach":
+		return cmdReattach(args[1:])
+	case "history":
+		return cmdHistory(args[1:])
+	case "daemon":
+		return cmdDaemon(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Printf("未知命令: %s\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Println("用法:")
+	fmt.Println("  beanckup                      进入交互式菜单")
+	fmt.Println("  beanckup watch <工作区路径|备份集定义>")
+	fmt.Println("                                监视工作区并记录变更日志，使下次扫描只检查变化的路径")
+	fmt.Println("  beanckup migrate <工作区路径|备份集定义>")
+	fmt.Println("                                将元数据目录中的旧版清单升级到当前格式版本，原文件会先备份")
+	fmt.Println("  beanckup deleted <工作区路径|备份集定义> [会话号|筛选条件]")
+	fmt.Println("                                列出各会话中被删除的文件及其最后所在的交付包")
+	fmt.Println("  beanckup catalog <工作区路径|备份集定义> sessions [筛选条件]|rebuild|path <路径>|hash <哈希>|package <包名>")
+	fmt.Println("                                查询目录索引: 会话摘要、文件各版本所在的会话与包、哈希或包中的内容")
+	fmt.Println("                                筛选条件为 tag:<标记> 或在会话标签、备注中查找的文字")
+	fmt.Println("  beanckup keygen               生成清单签名密钥 (保存在用户配置目录中)")
+	fmt.Println("  beanckup reattach <工作区路径|备份集定义> <交付目录> [原工作区名]")
+	fmt.Println("                                从交付包中的清单重建丢失的元数据目录，之后的备份从最新会话继续增量进行")
+	fmt.Println("  beanckup history <工作区路径|备份集定义> <文件路径> [版本号 <交付目录> [目标路径|-]]")
+	fmt.Println("                                列出文件在各会话中的版本；指定版本号时从交付目录中取出该版本 (- 表示输出到标准输出)")
+	fmt.Println("  beanckup daemon <守护进程配置> [--once]")
+	fmt.Println("                                按配置中的计划无人值守地备份各工作区，并写出状态文件；--once 立即运行全部任务一次后退出")
+}
+
+func cmdWatch(args []string) int {
+	if len(args) != 1 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	fmt.Println("监视已启动，按 Ctrl+C 停止。")
+	if err := watcher.Watch(set, stop); err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	fmt.Println("监视已停止。")
+	return 0
+}
+
+func cmdMigrate(args []string) int {
+	if len(args) != 1 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+
+	entries, err := os.ReadDir(set.MetadataDir)
+	if err != nil {
+		fmt.Printf("错误: 无法读取元数据目录 '%s': %v\n", set.MetadataDir, err)
+		return 1
+	}
+	workspaceLock, err := lock.Acquire(set.MetadataDir, "升级清单")
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	defer workspaceLock.Release()
+
+	backupDir := filepath.Join(set.MetadataDir, "migration_backup_"+time.Now().Format("20060102_150405"))
+	migrated, failed := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir() || !manifest.IsManifestFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(set.MetadataDir, entry.Name())
+		data, err := signing.Default().ReadFile(path)
+		if err != nil {
+			fmt.Printf("  跳过 %s: %v\n", entry.Name(), err)
+			failed++
+			continue
+		}
+		m, err := manifest.ParseManifest(data)
+		if err != nil {
+			fmt.Printf("  跳过 %s: %v\n", entry.Name(), err)
+			failed++
+			continue
+		}
+		if !manifest.NeedsMigration(m) {
+			continue
+		}
+		from := m.FormatVersion
+		if err := manifest.Migrate(m); err != nil {
+			fmt.Printf("  跳过 %s: %v\n", entry.Name(), err)
+			failed++
+			continue
+		}
+
+		// 先备份原文件 (及签名) 再原地改写，升级出错时可以手动恢复
+		if err := os.MkdirAll(backupDir, 0755); err != nil {
+			fmt.Printf("错误: 无法创建备份目录: %v\n", err)
+			return 1
+		}
+		if err := copyFile(path, filepath.Join(backupDir, entry.Name())); err != nil {
+			fmt.Printf("错误: 备份 %s 失败: %v\n", entry.Name(), err)
+			return 1
+		}
+		if _, err := os.Stat(signing.SigPath(path)); err == nil {
+			if err := copyFile(signing.SigPath(path), signing.SigPath(filepath.Join(backupDir, entry.Name()))); err != nil {
+				fmt.Printf("错误: 备份 %s 的签名失败: %v\n", entry.Name(), err)
+				return 1
+			}
+		}
+		if err := manifest.WriteManifest(m, path); err != nil {
+			fmt.Printf("错误: 改写 %s 失败: %v\n", entry.Name(), err)
+			return 1
+		}
+		if err := signing.Default().SignFile(path); err != nil {
+			fmt.Printf("警告: 无法为 %s 重新签名: %v\n", entry.Name(), err)
+		}
+		if from == "" {
+			from = "无版本"
+		}
+		fmt.Printf("  已升级 %s (%s -> %s)\n", entry.Name(), from, m.FormatVersion)
+		migrated++
+	}
+
+	if migrated == 0 {
+		fmt.Println("没有需要升级的清单。")
+	} else {
+		fmt.Printf("已升级 %d 个清单，原文件备份在: %s\n", migrated, backupDir)
+	}
+	if failed > 0 {
+		fmt.Printf("警告: %d 个清单无法升级。\n", failed)
+		return 1
+	}
+	return 0
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func cmdDeleted(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+	// 第二个参数可以是会话号，也可以是按会话标签筛选的条件 (如 tag:archive)
+	onlySession, filter := 0, ""
+	if len(args) == 2 {
+		if onlySession, err = strconv.Atoi(args[1]); err != nil {
+			onlySession, filter = 0, args[1]
+		} else if onlySession <= 0 {
+			fmt.Printf("错误: 无效的会话号 '%s'\n", args[1])
+			return 2
+		}
+	}
+	notes, err := history.SessionNotes(set.MetadataDir)
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+
+	loadState := history.LoadHistoricalStateReadOnly
+	if workspaceLock := lockForQuery(set.MetadataDir); workspaceLock != nil {
+		defer workspaceLock.Release()
+		loadState = history.LoadHistoricalState
+	}
+	state, err := loadState(set.MetadataDir)
+	if err != nil {
+		fmt.Printf("错误: 加载历史状态失败: %v\n", err)
+		return 1
+	}
+	bySession := history.DeletionsBySession(state)
+	var sessions []int
+	for sessionID := range bySession {
+		if (onlySession == 0 || sessionID == onlySession) && notes[sessionID].Matches(filter) {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	if len(sessions) == 0 {
+		fmt.Println("没有删除记录。")
+		return 0
+	}
+	sort.Ints(sessions)
+	for _, sessionID := range sessions {
+		tombstones := bySession[sessionID]
+		fmt.Printf("\n会话 S%d: 删除 %d 个文件", sessionID, len(tombstones))
+		if note := notes[sessionID]; !note.IsEmpty() {
+			fmt.Printf("  %s", note)
+		}
+		fmt.Println()
+		for _, t := range tombstones {
+			fmt.Printf("  - %s (%.2f MB)  最后版本: %s\n", t.Path, float64(t.Size)/1024/1024, t.Reference)
+		}
+	}
+	return 0
+}
+
+func cmdCatalog(args []string) int {
+	if len(args) < 2 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+	beanckupDir := set.MetadataDir
+
+	action := args[1]
+	if action == "rebuild" {
+		workspaceLock, err := lock.Acquire(beanckupDir, "重建目录索引")
+		if err != nil {
+			fmt.Printf("错误: %v\n", err)
+			return 1
+		}
+		defer workspaceLock.Release()
+		if err := history.RebuildCatalog(beanckupDir); err != nil {
+			fmt.Printf("错误: 重建目录索引失败: %v\n", err)
+			return 1
+		}
+		fmt.Println("目录索引已重建。")
+		return 0
+	}
+
+	openCatalog := history.OpenCatalogReadOnly
+	if workspaceLock := lockForQuery(beanckupDir); workspaceLock != nil {
+		defer workspaceLock.Release()
+		openCatalog = history.OpenCatalog
+	}
+	cat, err := openCatalog(beanckupDir)
+	if err != nil {
+		fmt.Printf("错误: 无法打开目录索引: %v\n", err)
+		return 1
+	}
+
+	if action == "sessions" {
+		if len(args) > 3 {
+			printUsage()
+			return 2
+		}
+		filter := ""
+		if len(args) == 3 {
+			filter = args[2]
+		}
+		for _, s := range cat.Sessions() {
+			if !s.SessionNote.Matches(filter) {
+				continue
+			}
+			fmt.Printf("S%d  %s  %d 个文件  %.2f MB  删除 %d 个  新包 %d 个\n",
+				s.SessionID, s.Timestamp, s.FileCount, float64(s.TotalSize)/1024/1024, s.Deleted, len(s.Packages))
+			if !s.SessionNote.IsEmpty() {
+				fmt.Printf("    标签: %s\n", s.SessionNote)
+			}
+			if s.Notes != "" {
+				fmt.Printf("    备注: %s\n", s.Notes)
+			}
+			for _, p := range s.Packages {
+				fmt.Printf("    %s: %d 个文件, %.2f MB\n", p.Name, p.FileCount, float64(p.TotalSize)/1024/1024)
+			}
+		}
+		return 0
+	}
+
+	if len(args) != 3 {
+		printUsage()
+		return 2
+	}
+	var entries []*catalog.Entry
+	switch action {
+	case "path":
+		entries, err = cat.LookupPath(args[2])
+	case "hash":
+		entries, err = cat.LookupHash(args[2])
+	case "package":
+		entries, err = cat.LookupPackage(args[2])
+	default:
+		printUsage()
+		return 2
+	}
+	if err != nil {
+		printCatalogError(err, args[0])
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Println("目录中没有匹配的记录。")
+		return 0
+	}
+	for _, e := range entries {
+		if e.Deleted {
+			fmt.Printf("%s  在 S%d 中被删除  最后版本: %s\n", e.Node.Path, e.From, e.Node.Reference)
+			continue
+		}
+		sessions := fmt.Sprintf("S%d 起至今", e.From)
+		if e.Until != 0 {
+			sessions = fmt.Sprintf("S%d - S%d", e.From, e.Until-1)
+		}
+		fmt.Printf("%s  %s  %.2f MB  %s  位置: %s\n", e.Node.Path, sessions, float64(e.Node.Size)/1024/1024, e.Node.Hash, nodeLocation(e.Node))
+	}
+	return 0
+}
+
+func cmdKeygen(args []string) int {
+	if len(args) != 0 {
+		printUsage()
+		return 2
+	}
+	pub, err := signing.GenerateKey()
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	dir, _ := signing.ConfigDir()
+	fmt.Printf("已在 %s 中生成签名密钥。\n", dir)
+	fmt.Printf("公钥: %s\n", pub)
+	fmt.Println("之后写入的清单都会被签名。其他机器若要验证这些清单，请将公钥加入其 signing.json 的 trusted_keys。")
+	return 0
+}
+
+func cmdReattach(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+	// 工作区被移动或改名后，交付包中记录的仍是原来的工作区名
+	workspaceName := set.Name
+	if len(args) == 3 {
+		workspaceName = args[2]
+	}
+	if err := os.MkdirAll(set.MetadataDir, 0755); err != nil {
+		fmt.Printf("错误: 无法创建元数据目录: %v\n", err)
+		return 1
+	}
+	workspaceLock, err := lock.Acquire(set.MetadataDir, "重建元数据")
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	defer workspaceLock.Release()
+
+	res, err := restorer.NewRestorer(args[1])
+	if err != nil {
+		fmt.Printf("错误: 初始化恢复器失败: %v\n", err)
+		return 1
+	}
+	sessions, err := res.DiscoverDeliverySessions()
+	if err != nil {
+		fmt.Printf("错误: 发现交付包失败: %v\n", err)
+		return 1
+	}
+	if len(sessions) == 0 {
+		fmt.Printf("在路径 '%s' 中未找到任何交付包\n", args[1])
+		return 1
+	}
+
+	password := askForPassword()
+	fmt.Printf("正在从 %d 个会话的交付包中提取工作区 '%s' 的清单...\n", len(sessions), workspaceName)
+	restored, names, err := res.ReattachWorkspace(workspaceName, set.MetadataDir, password)
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == workspaceName
+	}
+	if !found {
+		fmt.Printf("交付目录中没有工作区 '%s' 的清单。", workspaceName)
+		if len(names) > 0 {
+			fmt.Printf("找到的工作区: %v，可将原工作区名作为第三个参数传入。", names)
+		}
+		fmt.Println()
+		return 1
+	}
+	fmt.Printf("已恢复 %d 份清单。\n", restored)
+
+	if err := history.RebuildSnapshots(set.MetadataDir); err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	if err := history.RebuildCatalog(set.MetadataDir); err != nil {
+		fmt.Printf("警告: 无法重建目录索引: %v\n", err)
+	}
+	state, err := history.LoadHistoricalState(set.MetadataDir)
+	if err != nil {
+		fmt.Printf("错误: 加载重建的历史状态失败: %v\n", err)
+		return 1
+	}
+	fmt.Printf("✓ 元数据目录已重建: %s\n", set.MetadataDir)
+	fmt.Printf("  最新会话 S%d，已记录 %d 个文件，下次备份将从会话 S%d 开始。\n", state.MaxSessionID, len(state.PathToNode), state.MaxSessionID+1)
+	return 0
+}
+
+func cmdHistory(args []string) int {
+	if len(args) != 2 && len(args) != 4 && len(args) != 5 {
+		printUsage()
+		return 2
+	}
+	set, err := backupset.Open(args[0])
+	if err != nil {
+		fmt.Printf("错误: 无法打开工作区 '%s': %v\n", args[0], err)
+		return 1
+	}
+	nodePath := historyNodePath(set, args[1])
+	// 只在更新目录索引和查询版本期间持有工作区锁，不在等待输入密码或提取文件时阻塞备份
+	workspaceLock := lockForQuery(set.MetadataDir)
+	versions, err := history.PathVersions(set.MetadataDir, nodePath, workspaceLock == nil)
+	if workspaceLock != nil {
+		workspaceLock.Release()
+	}
+	if err != nil {
+		printCatalogError(err, args[0])
+		return 1
+	}
+	if len(versions) == 0 {
+		fmt.Printf("没有 '%s' 的备份记录。\n", nodePath)
+		return 1
+	}
+
+	if len(args) == 2 {
+		fmt.Printf("%s 共有 %d 个版本:\n", nodePath, len(versions))
+		for i, v := range versions {
+			if v.Deleted {
+				fmt.Printf("  [%d] S%d  %s  已删除\n", i+1, v.From, v.Timestamp)
+				continue
+			}
+			sessions := fmt.Sprintf("S%d 起至今", v.From)
+			if v.Until != 0 {
+				sessions = fmt.Sprintf("S%d - S%d", v.From, v.Until-1)
+			}
+			fmt.Printf("  [%d] %s  %s  %.2f MB  %s  位置: %s\n", i+1, sessions, v.Timestamp, float64(v.Node.Size)/1024/1024, v.Node.Hash, nodeLocation(v.Node))
+		}
+		return 0
+	}
+
+	choice, err := strconv.Atoi(args[2])
+	if err != nil || choice < 1 || choice > len(versions) {
+		fmt.Printf("错误: 无效的版本号 '%s'\n", args[2])
+		return 2
+	}
+	version := versions[choice-1]
+	if version.Deleted {
+		fmt.Printf("错误: 版本 %d 是删除记录，请选择删除之前的版本\n", choice)
+		return 1
+	}
+	target := filepath.Base(filepath.FromSlash(nodePath))
+	ext := filepath.Ext(target)
+	target = fmt.Sprintf("%s_S%d%s", strings.TrimSuffix(target, ext), version.From, ext)
+	if len(args) == 5 {
+		target = args[4]
+	}
+
+	// 输出到标准输出时，提示信息一律写到标准错误
+	out := os.Stdout
+	if target == "-" {
+		out = os.Stderr
+	}
+	res, err := restorer.NewRestorer(args[3])
+	if err != nil {
+		fmt.Fprintf(out, "错误: 初始化恢复器失败: %v\n", err)
+		return 1
+	}
+	if _, err := res.DiscoverDeliverySessions(); err != nil {
+		fmt.Fprintf(out, "错误: 发现交付包失败: %v\n", err)
+		return 1
+	}
+	fmt.Fprint(out, "请输入加密密码 (如果包未加密则留空): ")
+	password, _ := reader.ReadString('\n')
+	password = strings.TrimSpace(password)
+
+	if target == "-" {
+		if err := res.ExtractFile(version.Node, password, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if _, err := os.Stat(target); err == nil {
+		fmt.Printf("错误: 目标文件 '%s' 已存在\n", target)
+		return 1
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		fmt.Printf("错误: 无法创建目标文件: %v\n", err)
+		return 1
+	}
+	err = res.ExtractFile(version.Node, password, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+	if !version.Node.ModTime.IsZero() {
+		os.Chtimes(target, version.Node.ModTime, version.Node.ModTime)
+	}
+	fmt.Printf("✓ 已将 S%d 的版本取出到: %s\n", version.From, target)
+	return 0
+}
+
+// historyNodePath 将命令行给出的文件路径转换为清单中的路径: 绝对路径按所在的源目录转换，
+// 其余视为清单路径 (多源目录备份集需带源目录名前缀)
+func historyNodePath(set *types.BackupSet, arg string) string {
+	if filepath.IsAbs(arg) {
+		for i := range set.Roots {
+			rel, err := filepath.Rel(set.Roots[i].Path, arg)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return set.NodePath(&set.Roots[i], rel)
+			}
+		}
+	}
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean(arg)), "./")
+}
+
+// nodeLocation 返回文件版本所在的位置，按块存储的文件注明块数
+func nodeLocation(node *types.FileNode) string {
+	if len(node.Chunks) > 0 {
+		return fmt.Sprintf("%s (按块存储，共 %d 块)", node.Reference, len(node.Chunks))
+	}
+	return node.Reference
+}
+
+// lockForQuery 尝试锁定工作区，以便查询前更新目录索引。工作区正被其他进程使用或无法锁定时返回 nil，
+// 此时查询以只读方式进行，不写入元数据目录。
+func lockForQuery(beanckupDir string) *lock.Lock {
+	l, err := lock.Acquire(beanckupDir, "查询")
+	if err != nil {
+		if lock.IsLocked(err) {
+			fmt.Fprintln(os.Stderr, "注意: 工作区正被另一个 BeanCKUP 进程使用，本次查询不更新目录索引。")
+		}
+		return nil
+	}
+	return l
+}
+
+// printCatalogError 打印查询目录索引的错误，目录的记录被修改过时提示重建
+func printCatalogError(err error, workspace string) {
+	fmt.Printf("错误: %v\n", err)
+	if errors.Is(err, catalog.ErrDigestMismatch) {
+		fmt.Printf("可运行 beanckup catalog %s rebuild 从会话快照和清单重建目录索引。\n", workspace)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"beanckup-cli/internal/backupset"
+	"beanckup-cli/internal/config"
+	"beanckup-cli/internal/daemon"
+	"beanckup-cli/internal/lock"
+	"beanckup-cli/internal/session"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// cmdDaemon 按守护进程配置中的计划依次备份各工作区。带 --once 时立即运行全部任务一次后退出，
+// 便于由 cron 或 systemd timer 调度。
+func cmdDaemon(args []string) int {
+	if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "--once") {
+		printUsage()
+		return 2
+	}
+	once := len(args) == 2
+	cfg, err := daemon.LoadConfig(args[0])
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return 1
+	}
+
+	status := daemon.NewStatus(cfg, time.Now())
+	saveStatus := func() {
+		if err := status.Save(cfg.StatusFile); err != nil {
+			log.Printf("警告: %v", err)
+		}
+	}
+	saveStatus()
+
+	// 第一次收到信号时在当前任务结束后退出 (交付可以在下次运行时继续)，再次收到时立即退出
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("收到停止信号，将在当前任务结束后退出 (再次按 Ctrl+C 立即退出)。")
+		close(stop)
+		<-signals
+		os.Exit(1)
+	}()
+
+	log.Printf("守护进程已启动，共 %d 个任务，状态文件: %s", len(cfg.Jobs), cfg.StatusFile)
+	for {
+		for i, job := range cfg.Jobs {
+			select {
+			case <-stop:
+				return 0
+			default:
+			}
+			if !once && status.Jobs[i].NextRun.After(time.Now()) {
+				continue
+			}
+			log.Printf("=== 开始任务 %s ===", job.Name)
+			status.Start(i, time.Now())
+			saveStatus()
+			result, sessionID, err := runDaemonJob(job)
+			if err != nil {
+				log.Printf("错误: 任务 %s 失败: %v", job.Name, err)
+			}
+			status.Finish(cfg, i, result, sessionID, err, time.Now())
+			saveStatus()
+			log.Printf("=== 任务 %s 结束: %s，下次运行: %s ===", job.Name, result, status.Jobs[i].NextRun.Format("2006-01-02 15:04"))
+		}
+		if once {
+			return 0
+		}
+
+		wait := time.Until(status.NextRun())
+		if wait <= 0 {
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return 0
+		case <-timer.C:
+		}
+	}
+}
+
+// runDaemonJob 无人值守地运行一次备份: 有未完成的计划时自动继续，否则扫描工作区，没有变化时跳过。
+// 返回运行结果和涉及的会话号。
+func runDaemonJob(job *daemon.Job) (string, int, error) {
+	set, err := backupset.Open(job.Workspace)
+	if err != nil {
+		return daemon.ResultFailed, 0, fmt.Errorf("无法打开工作区: %w", err)
+	}
+	beanckupDir := set.MetadataDir
+	if err := os.MkdirAll(beanckupDir, 0755); err != nil {
+		return daemon.ResultFailed, 0, fmt.Errorf("无法创建 .beanckup 目录: %w", err)
+	}
+	workspaceLock, err := lock.Acquire(beanckupDir, "定时备份")
+	if err != nil {
+		if lock.IsLocked(err) {
+			return daemon.ResultBusy, 0, err
+		}
+		return daemon.ResultFailed, 0, err
+	}
+	defer workspaceLock.Release()
+	cfg, err := config.Load(beanckupDir)
+	if err != nil {
+		return daemon.ResultFailed, 0, err
+	}
+	params, err := job.DeliveryParams(cfg)
+	if err != nil {
+		return daemon.ResultFailed, 0, err
+	}
+
+	plan, _, err := session.FindLatestPlan(beanckupDir)
+	if err != nil {
+		return daemon.ResultFailed, 0, fmt.Errorf("检查未完成任务失败: %w", err)
+	}
+	if plan != nil && !plan.IsCompleted() {
+		log.Printf("发现未完成的交付任务 (会话 S%d, 还有 %d 个包未完成)，将自动继续。", plan.SessionID, plan.CountUnfinished())
+		stalePackages := prepareResume(beanckupDir, plan)
+		if checkResumablePlan(set, plan, true) {
+			for _, destination := range params.Destinations() {
+				session.CleanupIncompletePackages(destination, stalePackages)
+			}
+			return executeDeliveryLoop(set, cfg, plan, params, true), plan.SessionID, nil
+		}
+		log.Printf("会话 S%d 的计划无法继续，将重新扫描工作区。", plan.SessionID)
+	}
+
+	scan, err := scanWorkspace(set, cfg)
+	if err != nil {
+		return daemon.ResultFailed, 0, err
+	}
+	if scan.newCount == 0 && scan.movedCount == 0 && len(scan.deletions) == 0 {
+		fmt.Println("工作区内文件无增量变化，无需交付。")
+		return daemon.ResultSkipped, 0, nil
+	}
+	newPlan, err := createDeliveryPlan(set, cfg, scan, params)
+	if err != nil {
+		return daemon.ResultFailed, 0, err
+	}
+	if newPlan == nil {
+		fmt.Println("根据当前设置，本次扫描未计划任何交付包。")
+		return daemon.ResultSkipped, 0, nil
+	}
+	return executeDeliveryLoop(set, cfg, newPlan, params, true), newPlan.SessionID, nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/chunker"
+	"beanckup-cli/internal/compression"
+	"beanckup-cli/internal/hooks"
+	"beanckup-cli/internal/indexer"
+	"beanckup-cli/internal/inventory"
+	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/packager"
+	"beanckup-cli/internal/session"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// deliveryRun 是交付循环中的一轮: 打包当前所有待交付的包。
+// 多个包可以同时打包，各包对计划的修改 (状态、文件列表、引用) 以及保存计划都须持有 mu。
+// 每个包只修改自己的 episode，因此在不持有 mu 时也可以读取自己 episode 中的内容。
+type deliveryRun struct {
+	set          *types.BackupSet
+	cfg          *types.Config
+	plan         *types.Plan
+	params       *session.DeliveryParams
+	archiver     archive.Archiver // 写入交付包的归档后端
+	media        *util.MediaInfo  // 换盘模式下当前介质的信息，否则为 nil
+	mediumNumber int
+	unattended   bool
+
+	mu       sync.Mutex
+	progress *util.MultiProgress
+}
+
+// episodeOutcome 是一个包的交付结果
+type episodeOutcome struct {
+	err          error             // 打包失败，该包已恢复为待交付状态
+	abort        bool              // 须中止本次交付 (前置钩子失败、没有可用的交付目录等)
+	inconsistent []*types.FileNode // 扫描后发生变化、已移出该包的文件
+}
+
+// deliverPending 打包所有待交付的包，返回是否进行了交付以及是否须中止本次交付。
+// 同时打包的数量由 ParallelEpisodes 决定 (换盘模式下总是逐个打包)；一个包失败不影响其他包。
+func (r *deliveryRun) deliverPending() (delivered, aborted bool) {
+	var pending []int
+	for i := range r.plan.Episodes {
+		if r.plan.Episodes[i].Status == types.EpisodeStatusPending {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return false, false
+	}
+	workers := min(max(r.params.ParallelEpisodes, 1), len(pending))
+	if r.media != nil {
+		workers = 1
+	}
+	if workers > 1 {
+		fmt.Printf("将同时打包 %d 个包。\n", workers)
+	}
+
+	r.progress = util.NewMultiProgress()
+	for _, i := range pending {
+		r.progress.Add(fmt.Sprintf("E%02d", r.plan.Episodes[i].ID), r.plan.Episodes[i].PlannedSize())
+	}
+	var inconsistent []*types.FileNode
+	if workers == 1 {
+		for _, i := range pending {
+			outcome := r.deliverEpisode(i)
+			inconsistent = append(inconsistent, outcome.inconsistent...)
+			if outcome.abort {
+				aborted = true
+				break
+			}
+			if outcome.err != nil && !errors.Is(outcome.err, errMediumFull) && !r.unattended &&
+				!askForConfirmation("交付失败，是否继续尝试下一个包?") {
+				aborted = true
+				break
+			}
+		}
+	} else {
+		var wg sync.WaitGroup
+		var collectMu sync.Mutex
+		var stop atomic.Bool
+		slots := make(chan struct{}, workers)
+		for _, i := range pending {
+			slots <- struct{}{}
+			if stop.Load() {
+				break
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				outcome := r.deliverEpisode(i)
+				collectMu.Lock()
+				inconsistent = append(inconsistent, outcome.inconsistent...)
+				collectMu.Unlock()
+				if outcome.abort {
+					stop.Store(true)
+				}
+			}(i)
+		}
+		wg.Wait()
+		aborted = stop.Load()
+	}
+	r.progress.Finish()
+
+	// 追加新 episode 可能使 episode 指针失效，因此在本轮所有包结束之后再重新规划
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replanInconsistentFiles(r.plan, r.set, inconsistent)
+	r.savePlan()
+	return true, aborted
+}
+
+// savePlan 保存计划，调用者须持有 mu
+func (r *deliveryRun) savePlan() error {
+	planFilePath, err := session.SavePlan(r.set.MetadataDir, r.set.Name, r.plan)
+	if err != nil {
+		return err
+	}
+	r.plan.StatusFilePath = planFilePath
+	return nil
+}
+
+// resetEpisode 将打包失败的包恢复为待交付状态并保存计划
+func (r *deliveryRun) resetEpisode(episode *types.Episode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session.ResetEpisode(episode)
+	episode.Status = types.EpisodeStatusPending
+	r.savePlan()
+}
+
+// deliverEpisode 打包并交付计划中的第 i 个包
+func (r *deliveryRun) deliverEpisode(i int) (out episodeOutcome) {
+	set, beanckupDir, workspaceName := r.set, r.set.MetadataDir, r.set.Name
+	params := r.params
+
+	r.mu.Lock()
+	episode := &r.plan.Episodes[i]
+	sessionID := r.plan.SessionID
+
+	// 包只打包一次，写入第一个可用的交付目录，之后再复制到其余目录。
+	// 换盘模式下总是写入当前介质
+	buildPath := session.BuildDestination(episode)
+	if r.media != nil {
+		buildPath = session.PrimaryDestination(episode, params.DeliveryPath)
+	}
+	if buildPath == "" {
+		log.Printf("错误: 没有可用的交付目录 (%s)，已暂停交付。", strings.Join(episode.PendingDestinations(), ", "))
+		r.mu.Unlock()
+		out.abort = true
+		return
+	}
+
+	// 1. 生成包名并记录在计划中，中断后恢复时据此清理残留文件
+	episode.PackageName = manifest.GeneratePackageName(workspaceName, sessionID, episode.ID, r.archiver.Ext())
+	episode.Status = types.EpisodeStatusInProgress
+	if err := r.savePlan(); err != nil {
+		log.Printf("错误: 保存交付计划失败: %v", err)
+		episode.PackageName = ""
+		episode.Status = types.EpisodeStatusPending
+		r.mu.Unlock()
+		out.err = err
+		return
+	}
+	r.mu.Unlock()
+	episodePackageName := episode.PackageName
+	progressName := fmt.Sprintf("E%02d", episode.ID)
+
+	// --- 【核心流程重构】 ---
+
+	// 前置钩子失败时中止本次交付，该包保持待交付状态
+	preEnv := hookEnv(set, sessionID)
+	preEnv.EpisodeID = episode.ID
+	preEnv.EpisodeStatus = types.EpisodeStatusInProgress
+	if err := hooks.Run(r.cfg.Hooks, hooks.StagePreEpisode, preEnv); err != nil {
+		log.Printf("错误: %v，已中止交付。", err)
+		r.resetEpisode(episode)
+		out.abort = true
+		return
+	}
+
+	// 0. 打包前重新检查文件，扫描后已发生变化的文件移出本包并重新规划
+	if changed := indexer.FindChangedFiles(set, episode.Files); len(changed) > 0 {
+		reportInconsistentFiles(changed)
+		r.mu.Lock()
+		session.RemoveFiles(r.plan, episode, changed)
+		r.mu.Unlock()
+		out.inconsistent = append(out.inconsistent, changed...)
+	}
+
+	// 2. 创建一个包含所有数据文件的临时清单，用于生成 Reference
+	packageManifest := manifest.CreateManifest(workspaceName, sessionID, episode.ID, episodePackageName, episode.Files)
+
+	// 3. 确定引用名 (是否分卷)
+	volumeLimitMB := session.VolumeLimitMB(params.PackageSizeLimitMB, r.media)
+	packageSizeLimitBytes := int64(volumeLimitMB) * 1024 * 1024
+	willBeSplit := volumeLimitMB > 0 && episode.PlannedSize() > packageSizeLimitBytes
+	refPackageName := episodePackageName
+	if willBeSplit {
+		refPackageName += ".001"
+	}
+
+	// 按块存储的新文件只打包尚未交付的块，先将这些块写入暂存目录中的块包
+	chunkDir, chunkPacks, err := r.writeChunkPacks(episode, refPackageName, &out)
+	if err != nil {
+		log.Printf("错误: 写入块包失败: %v", err)
+		r.resetEpisode(episode)
+		out.err = err
+		return
+	}
+	if chunkDir != "" {
+		defer os.RemoveAll(chunkDir)
+	}
+
+	// 4. 为新文件选择压缩方式，并为清单中的新文件设置正确的引用。
+	// 采样需要读取文件，在锁外进行，结果在锁内写回
+	r.mu.Lock()
+	files := slices.Clone(episode.Files)
+	r.mu.Unlock()
+	classifier := compression.NewClassifier(r.archiver.Method(params.CompressionMethod), params.CompressionLevel)
+	methods := classifier.Classify(set, files)
+
+	r.mu.Lock()
+	for i, fileNode := range files {
+		if methods[i] != "" {
+			fileNode.Compression = methods[i]
+		}
+	}
+	var finalFilesForManifest []*types.FileNode
+	for _, fileNode := range episode.Files {
+		if fileNode.Reference == "" {
+			fileNode.Reference = fmt.Sprintf("%s/%s", refPackageName, set.PackPath(fileNode.Path))
+		}
+		finalFilesForManifest = append(finalFilesForManifest, fileNode)
+	}
+	if episode.ID == 1 {
+		finalFilesForManifest = append(finalFilesForManifest, session.ReferenceFiles(r.plan)...)
+		packageManifest.Tombstones = r.plan.Tombstones
+	}
+	r.mu.Unlock()
+	packageManifest.Files = finalFilesForManifest
+	packageManifest.Roots = set.RootNames()
+	packageManifest.SessionNote = r.plan.SessionNote
+	packageManifest.Archiver = r.archiver.Format()
+
+	// 5. 将最终的清单文件写入工作区的 .beanckup 目录
+	manifestFilePath, err := saveSignedManifest(packageManifest, beanckupDir)
+	if err != nil {
+		log.Printf("错误: 无法在工作区创建临时清单: %v", err)
+		r.resetEpisode(episode)
+		out.err = err
+		return
+	}
+
+	// 6. 准备待打包文件列表，路径转换为相对于所有源目录公共上级目录的包内路径
+	packRoot, err := set.PackRoot()
+	if err != nil {
+		log.Printf("错误: %v", err)
+		removeManifest(manifestFilePath)
+		r.resetEpisode(episode)
+		out.abort = true
+		return
+	}
+	filesToPack := make([]*types.FileNode, 0, len(episode.Files))
+	for _, fileNode := range episode.Files {
+		if len(fileNode.Chunks) > 0 {
+			continue // 内容已写入块包
+		}
+		filesToPack = append(filesToPack, &types.FileNode{
+			Path:        set.PackPath(fileNode.Path),
+			Size:        fileNode.Size,
+			Compression: fileNode.Compression,
+		})
+	}
+
+	// 7. 调用简化的打包器。数据文件写入后、清单写入前再检查一次，
+	// 打包期间发生变化的文件从清单中移除，保证清单中的哈希与包内内容一致。
+	pkg := packager.NewPackager(r.archiver)
+	pkg.SplitVolumes = willBeSplit
+	pkg.PackDir, pkg.Packs = chunkDir, chunkPacks
+	pkg.BeforeManifest = func() error {
+		changed := indexer.FindChangedFiles(set, episode.Files)
+		if len(changed) == 0 {
+			return nil
+		}
+		reportInconsistentFiles(changed)
+		r.mu.Lock()
+		session.RemoveFiles(r.plan, episode, changed)
+		r.mu.Unlock()
+		out.inconsistent = append(out.inconsistent, changed...)
+		packageManifest.Files = excludeFiles(packageManifest.Files, changed)
+		_, err := saveSignedManifest(packageManifest, beanckupDir)
+		return err
+	}
+
+	// 换盘模式下先在本地临时目录打包，确认实际大小放得下后再复制到介质上，
+	// 避免介质上同时存在完整压缩包和分卷，也避免写出超过文件系统限制的单个文件
+	packagePath := buildPath
+	if r.media != nil {
+		if packagePath, err = os.MkdirTemp("", "beanckup_stage_*"); err != nil {
+			log.Printf("错误: 无法创建临时打包目录: %v", err)
+			removeManifest(manifestFilePath)
+			r.resetEpisode(episode)
+			out.abort = true
+			return
+		}
+	}
+	err = pkg.CreatePackage(
+		packagePath,
+		episodePackageName,
+		packRoot,
+		filesToPack,
+		manifestFilePath,
+		params.Password,
+		params.CompressionLevel,
+		volumeLimitMB,
+		func(p packager.Progress) {
+			r.progress.Update(progressName, p.Percentage)
+		},
+	)
+	r.progress.Done(progressName)
+	if packagePath != buildPath {
+		if err == nil {
+			err = moveStagedPackage(packagePath, buildPath, episodePackageName, episode.ID)
+		}
+		os.RemoveAll(packagePath)
+	}
+
+	episodeResult, episodeStatus := "success", types.EpisodeStatusCompleted
+	if err != nil {
+		episodeResult, episodeStatus = "failure", types.EpisodeStatusPending
+	}
+	postEnv := hookEnv(set, sessionID)
+	postEnv.EpisodeID = episode.ID
+	postEnv.PackagePath = filepath.Join(buildPath, episodePackageName)
+	// 分卷的包在磁盘上只有 .001、.002 等文件，钩子需要的是实际存在的文件
+	if volumes, volErr := inventory.VolumePaths(buildPath, episodePackageName); volErr == nil && len(volumes) > 0 {
+		postEnv.PackagePath = volumes[0]
+		postEnv.PackageFiles = volumes
+	}
+	postEnv.EpisodeStatus = episodeStatus
+	postEnv.Result = episodeResult
+	if hookErr := hooks.Run(r.cfg.Hooks, hooks.StagePostEpisode, postEnv); hookErr != nil {
+		log.Printf("警告: %v", hookErr)
+	}
+
+	// 8. 【核心修正】: 只有在打包失败时才清理临时的清单文件。
+	// 成功后，清单文件必须保留在.beanckup目录作为历史记录。
+	if err != nil {
+		log.Printf("\n错误: 创建交付包 %s 失败: %v", episodePackageName, err)
+		removeManifest(manifestFilePath) // 打包失败，清理掉这个无效的清单
+		r.resetEpisode(episode)
+		if errors.Is(err, errMediumFull) {
+			fmt.Println("该包将交付到下一张介质。")
+		}
+		out.err = err
+		return
+	}
+
+	fmt.Printf("\n✓ 交付包 %s 已成功创建。\n", episodePackageName)
+	// 记录包各分卷的大小和哈希，恢复时据此检查交付目录中的文件是否完整
+	r.mu.Lock()
+	session.MarkDestination(episode, buildPath)
+	if r.media != nil {
+		episode.Medium = r.mediumNumber
+	}
+	r.mu.Unlock()
+	if inv, err := inventory.Describe(buildPath, episodePackageName, episode.ID); err != nil {
+		log.Printf("警告: 无法记录交付包的校验信息: %v", err)
+	} else {
+		if err := inventory.Record(beanckupDir, buildPath, workspaceName, sessionID, r.plan.SessionNote, inv); err != nil {
+			log.Printf("警告: 无法更新会话索引: %v", err)
+		}
+		r.mu.Lock()
+		recordActualSize(beanckupDir, episode, inv, params)
+		r.mu.Unlock()
+		copied := copyToDestinations(beanckupDir, workspaceName, r.plan, episode, inv)
+		r.mu.Lock()
+		for _, destination := range copied {
+			session.MarkDestination(episode, destination)
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	episode.Status = types.EpisodeStatusCompleted
+	r.savePlan()
+	return
+}
+
+// writeChunkPacks 将包中按块存储的新文件尚未交付的块写入临时目录下的块包，并记录各块的位置。
+// 内容已与规划时的块列表不符的文件移出本包并重新规划。返回暂存目录 (没有按块存储的文件时为空) 和其中的块包。
+func (r *deliveryRun) writeChunkPacks(episode *types.Episode, refPackageName string, out *episodeOutcome) (string, []*types.FileNode, error) {
+	var chunked []*types.FileNode
+	for _, node := range episode.Files {
+		if node.Reference == "" && len(node.Chunks) > 0 {
+			chunked = append(chunked, node)
+		}
+	}
+	if len(chunked) == 0 {
+		return "", nil, nil
+	}
+	stageDir, err := os.MkdirTemp("", "beanckup_chunks_*")
+	if err != nil {
+		return "", nil, fmt.Errorf("无法创建块包暂存目录: %w", err)
+	}
+
+	// 写入块包耗时较长，期间不持有 mu，各块的位置在全部写入之后一并设置
+	writer := chunker.NewPackWriter(stageDir, refPackageName)
+	located := make(map[*types.FileNode][]types.Chunk, len(chunked))
+	var changed []*types.FileNode
+	for _, node := range chunked {
+		chunks, err := writer.WriteFile(r.set.AbsPath(node.Path), node.Chunks)
+		if errors.Is(err, chunker.ErrChanged) {
+			changed = append(changed, node)
+			continue
+		}
+		if err != nil {
+			writer.Close()
+			os.RemoveAll(stageDir)
+			return "", nil, fmt.Errorf("%s: %w", node.Path, err)
+		}
+		located[node] = chunks
+	}
+	packs, err := writer.Close()
+	if err != nil {
+		os.RemoveAll(stageDir)
+		return "", nil, err
+	}
+
+	r.mu.Lock()
+	for node, chunks := range located {
+		node.Chunks = chunks
+	}
+	r.mu.Unlock()
+	if len(changed) > 0 {
+		reportInconsistentFiles(changed)
+		r.mu.Lock()
+		session.RemoveFiles(r.plan, episode, changed)
+		r.mu.Unlock()
+		out.inconsistent = append(out.inconsistent, changed...)
+	}
+	return stageDir, packs, nil
+}
@@ -1,9 +1,9 @@
 module beanckup-cli
 
-go 1.23.0
+go 1.24.0
 
 toolchain go1.24.3
 
 require golang.org/x/term v0.32.0
 
-require golang.org/x/sys v0.33.0 // indirect
+require golang.org/x/sys v0.33.0
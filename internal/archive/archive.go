@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"beanckup-cli/internal/types"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// 交付包的写入和读取由归档后端完成。清单记录写入每个包的后端 (types.Manifest.Archiver)，
+// 恢复时据此选择读取方式；没有记录的旧清单按包的扩展名判断。
+const (
+	// Format7z 调用外部的 7z 程序，包的扩展名为 .7z
+	Format7z = "7z"
+	// FormatNative 是纯 Go 实现的容器格式 (见 native.go)，不依赖外部程序，包的扩展名为 .bca
+	FormatNative = "native"
+)
+
+// ProgressFunc 报告一次写入的进度 (0-100) 和正在写入的文件
+type ProgressFunc func(percentage int, currentFile string)
+
+// Options 是创建交付包的参数
+type Options struct {
+	Password         string // 为空表示不加密
+	CompressionLevel int    // 0-9
+	WorkDir          string // 临时文件所在的目录，为空时使用包所在的目录
+}
+
+// Archiver 是一种交付包格式的读写实现
+type Archiver interface {
+	// Format 返回记录在清单中的后端名称
+	Format() string
+	// Ext 返回包文件的扩展名 (含 .)，分卷在其后追加 .001、.002 ...
+	Ext() string
+	// Method 返回该后端写入可压缩文件时实际使用的压缩方式，不支持的方式被替换为最接近的一种
+	Method(requested types.CompressionMethod) types.CompressionMethod
+	// Create 创建一个新的包，所有文件写入后须调用 Writer.Close
+	Create(path string, opts Options) (Writer, error)
+	// Extract 将包内的指定文件按包内路径解压到 destDir 下，已存在的文件被覆盖。
+	// 包中不存在的文件被忽略，调用方须自行检查需要的文件是否已解压。path 可以是首个分卷。
+	Extract(path string, names []string, destDir, password string) error
+	// ExtractFile 将包内的单个文件写入 w
+	ExtractFile(path, name, password string, w io.Writer) error
+}
+
+// Writer 向一个正在创建的包中写入文件
+type Writer interface {
+	// Add 以指定的压缩方式写入一组文件，files 中的路径相对于 dir，也是文件在包内的路径
+	Add(dir string, files []*types.FileNode, method types.CompressionMethod, progress ProgressFunc) error
+	// Close 完成写入。写入失败后也须调用，以释放打开的文件
+	Close() error
+}
+
+var archivers = map[string]Archiver{
+	Format7z:     sevenZip{},
+	FormatNative: native{},
+}
+
+// Get 返回指定名称的后端。name 为空时，已安装 7z 则使用 7z，否则使用原生格式。
+// 指定 7z 而系统中找不到 7z 程序时返回错误。
+func Get(name string) (Archiver, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		if SevenZipAvailable() {
+			return archivers[Format7z], nil
+		}
+		return archivers[FormatNative], nil
+	}
+	a, ok := archivers[name]
+	if !ok {
+		return nil, fmt.Errorf("未知的归档格式 %q (可选: %s、%s)", name, Format7z, FormatNative)
+	}
+	if name == Format7z && !SevenZipAvailable() {
+		return nil, fmt.Errorf("找不到 7z 程序，请安装 7-Zip/p7zip，或将 archiver 设为 %s", FormatNative)
+	}
+	return a, nil
+}
+
+// Valid 判断 name 是否为可识别的后端名称 (空表示自动选择)
+func Valid(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	_, ok := archivers[name]
+	return ok || name == ""
+}
+
+// SevenZipAvailable 判断系统中是否能找到 7z 程序
+func SevenZipAvailable() bool {
+	_, err := exec.LookPath("7z")
+	return err == nil
+}
+
+// ForFormat 返回清单中记录的后端，format 为空 (旧清单) 或无法识别时按包名的扩展名判断
+func ForFormat(format, packageName string) Archiver {
+	if a, ok := archivers[format]; ok {
+		return a
+	}
+	return ForFile(packageName)
+}
+
+// ForFile 按包文件名 (可以带分卷后缀) 的扩展名返回对应的后端，无法识别时返回 7z
+func ForFile(name string) Archiver {
+	name = strings.ToLower(strings.TrimSuffix(name, ".001"))
+	for _, a := range archivers {
+		if strings.HasSuffix(name, a.Ext()) {
+			return a
+		}
+	}
+	return archivers[Format7z]
+}
+
+// IsPackageFile 判断文件名是否为包文件或包的首个分卷
+func IsPackageFile(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, ".001"))
+	for _, a := range archivers {
+		if strings.HasSuffix(name, a.Ext()) {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseName 去掉包名的分卷后缀 .001 和扩展名，返回包的基础名 (带时间戳)
+func BaseName(name string) string {
+	name = strings.TrimSuffix(name, ".001")
+	for _, a := range archivers {
+		if trimmed, ok := strings.CutSuffix(name, a.Ext()); ok {
+			return trimmed
+		}
+	}
+	return name
+}
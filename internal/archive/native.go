@@ -0,0 +1,440 @@
+package archive
+
+import (
+	"archive/tar"
+	"beanckup-cli/internal/types"
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 原生格式 (.bca, BeanCKUP Archive) 只使用标准库读写，不依赖 7z 程序。
+//
+// 文件由明文的包头和紧随其后的数据区组成，所有整数均为大端:
+//
+//	偏移  长度  内容
+//	0     4     魔数 "BCA1"
+//	4     1     标志，位 0 为 1 表示数据区已加密
+//	加密时:
+//	5     16    PBKDF2 的盐
+//	21    4     PBKDF2 的迭代次数
+//
+// 数据区是一个 PAX 格式的 tar 流。每个文件是一个普通文件条目，名称为包内路径 (以 / 分隔)。
+// 压缩过的文件在条目的 PAX 记录中带有 BEANCKUP.compression=gzip 和 BEANCKUP.size=<原始字节数>，
+// 条目内容是该文件的 gzip 流；没有这两条记录的条目内容就是文件本身。清单及其签名总是最后写入，
+// 位于 .beanckup/ 下。
+//
+// 加密时，由密码经 PBKDF2-HMAC-SHA256 派生 32 字节密钥，数据区 (整个 tar 流，包括文件名)
+// 按 64 KiB 明文分段，每段以 AES-256-GCM 加密后依次存放，每段比明文多 16 字节的认证标签。
+// 第 i 段的 nonce 为 12 字节: 首字节在最后一段为 1、其余段为 0，字节 1-3 为 0，字节 4-11 为 i。
+// 附加认证数据是完整的包头。除最后一段外每段都是完整的 64 KiB，最后一段为 0 到 64 KiB-1 字节，
+// 因此读取时可以由数据区的总长度确定每一段的位置，截断或调换段都会导致认证失败。
+//
+// 超过单包大小限制时，整个文件按字节切分为 .bca.001、.bca.002 ... 分卷，按顺序拼接即还原为原文件。
+const (
+	nativeMagic   = "BCA1"
+	flagEncrypted = 1 << 0
+
+	paxCompression = "BEANCKUP.compression"
+	paxSize        = "BEANCKUP.size"
+)
+
+// native 是原生格式的读写实现
+type native struct{}
+
+func (native) Format() string { return FormatNative }
+
+func (native) Ext() string { return ".bca" }
+
+func (native) Method(requested types.CompressionMethod) types.CompressionMethod {
+	if requested == types.CompressionStore {
+		return types.CompressionStore
+	}
+	return types.CompressionGzip
+}
+
+func (native) Create(path string, opts Options) (Writer, error) {
+	if opts.WorkDir == "" {
+		opts.WorkDir = filepath.Dir(path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法创建交付包: %w", err)
+	}
+	w := &nativeWriter{f: f, buf: bufio.NewWriterSize(f, 1024*1024), opts: opts}
+
+	header := []byte(nativeMagic)
+	var key []byte
+	if opts.Password != "" {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("无法生成随机盐: %w", err)
+		}
+		header = append(header, flagEncrypted)
+		header = append(header, salt...)
+		header = binary.BigEndian.AppendUint32(header, kdfIterations)
+		if key, err = deriveKey(opts.Password, salt, kdfIterations); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("无法派生密钥: %w", err)
+		}
+	} else {
+		header = append(header, 0)
+	}
+	if _, err := w.buf.Write(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("无法写入包头: %w", err)
+	}
+
+	var data io.Writer = w.buf
+	if key != nil {
+		if w.seal, err = newSealWriter(w.buf, key, header); err != nil {
+			f.Close()
+			return nil, err
+		}
+		data = w.seal
+	}
+	w.tw = tar.NewWriter(data)
+	return w, nil
+}
+
+// nativeWriter 依次写入 tar 条目: tar → (AES-GCM 分段加密) → 缓冲 → 文件
+type nativeWriter struct {
+	f    *os.File
+	buf  *bufio.Writer
+	seal *sealWriter
+	tw   *tar.Writer
+	opts Options
+}
+
+func (w *nativeWriter) Add(dir string, files []*types.FileNode, method types.CompressionMethod, progress ProgressFunc) error {
+	var total, done int64
+	for _, node := range files {
+		total += node.Size
+	}
+	report := func(current string, n int64) {
+		done += n
+		if total > 0 {
+			progress(int(done*100/total), current)
+		}
+	}
+	for _, node := range files {
+		if err := w.addFile(filepath.Join(dir, filepath.FromSlash(node.Path)), filepath.ToSlash(node.Path), method, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *nativeWriter) addFile(fullPath, name string, method types.CompressionMethod, report func(string, int64)) error {
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("无法读取文件 %s: %w", name, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("无法读取文件 %s: %w", name, err)
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	content := io.Reader(&progressReader{r: io.LimitReader(src, info.Size()), name: name, report: report})
+
+	if method != types.CompressionStore {
+		// tar 条目须先写出大小，因此先压缩到临时文件
+		tmp, err := os.CreateTemp(w.opts.WorkDir, ".beanckup_gz_*")
+		if err != nil {
+			return fmt.Errorf("无法创建临时文件: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		gz, err := gzip.NewWriterLevel(tmp, gzipLevel(w.opts.CompressionLevel))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gz, content); err != nil {
+			return fmt.Errorf("压缩文件 %s 失败: %w", name, err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("压缩文件 %s 失败: %w", name, err)
+		}
+		compressedSize, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		hdr.PAXRecords = map[string]string{
+			paxCompression: string(types.CompressionGzip),
+			paxSize:        strconv.FormatInt(info.Size(), 10),
+		}
+		hdr.Size = compressedSize
+		content = tmp
+	}
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("写入文件 %s 失败: %w", name, err)
+	}
+	// 文件在读取期间被截短时 CopyN 返回错误，不会写出与条目大小不符的内容
+	if _, err := io.CopyN(w.tw, content, hdr.Size); err != nil {
+		return fmt.Errorf("写入文件 %s 失败: %w", name, err)
+	}
+	return nil
+}
+
+// Close 依次结束 tar 流、写出最后一个加密段并关闭文件
+func (w *nativeWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.tw.Close()
+	if w.seal != nil && err == nil {
+		err = w.seal.Close()
+	}
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	w.f = nil
+	if err != nil {
+		return fmt.Errorf("无法完成交付包: %w", err)
+	}
+	return nil
+}
+
+// gzipLevel 将 0-9 的压缩级别映射为 gzip 的压缩级别
+func gzipLevel(level int) int {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// progressReader 在读取文件内容时报告已读取的字节数
+type progressReader struct {
+	r      io.Reader
+	name   string
+	report func(string, int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.report(p.name, int64(n))
+	}
+	return n, err
+}
+
+func (native) Extract(path string, names []string, destDir, password string) error {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[filepath.ToSlash(name)] = true
+	}
+	return walkNative(path, password, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if !wanted[hdr.Name] {
+			return false, nil
+		}
+		delete(wanted, hdr.Name)
+		if !filepath.IsLocal(filepath.FromSlash(hdr.Name)) {
+			return false, fmt.Errorf("包内路径无效: %s", hdr.Name)
+		}
+		target := filepath.Join(destDir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return false, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(out, r)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, fmt.Errorf("解压 %s 失败: %w", hdr.Name, err)
+		}
+		return len(wanted) == 0, nil
+	})
+}
+
+func (native) ExtractFile(path, name, password string, w io.Writer) error {
+	name = filepath.ToSlash(name)
+	found := false
+	err := walkNative(path, password, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if hdr.Name != name {
+			return false, nil
+		}
+		found = true
+		if _, err := io.Copy(w, r); err != nil {
+			return false, fmt.Errorf("解压 %s 失败: %w", name, err)
+		}
+		return true, nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("包 %s 中没有文件 %s", filepath.Base(path), name)
+	}
+	return err
+}
+
+// walkNative 按顺序读取包中的条目，对每个条目调用 fn，r 为解压后的文件内容。fn 返回 true 时停止读取。
+// 不需要的条目通过 Seek 跳过，无需读取 (或解密) 其内容。
+func walkNative(path, password string, fn func(hdr *tar.Header, r io.Reader) (bool, error)) error {
+	vols, err := openVolumes(path)
+	if err != nil {
+		return err
+	}
+	defer vols.Close()
+
+	data, err := openNativeData(vols, password)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	tr := tar.NewReader(data)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, errDecrypt) {
+				return fmt.Errorf("%s: %w", filepath.Base(path), err)
+			}
+			return fmt.Errorf("读取包 %s 失败: %w", filepath.Base(path), err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var content io.Reader = tr
+		var gz *gzip.Reader
+		if hdr.PAXRecords[paxCompression] == string(types.CompressionGzip) {
+			if gz, err = gzip.NewReader(tr); err != nil {
+				return fmt.Errorf("解压 %s 失败: %w", hdr.Name, err)
+			}
+			content = gz
+		}
+		stop, err := fn(hdr, content)
+		if gz != nil {
+			gz.Close()
+		}
+		if err != nil || stop {
+			return err
+		}
+	}
+}
+
+// openNativeData 读取包头，返回数据区 (tar 流) 的明文
+func openNativeData(vols *volumes, password string) (io.ReadSeeker, error) {
+	header := make([]byte, len(nativeMagic)+1)
+	if _, err := vols.ReadAt(header, 0); err != nil || string(header[:len(nativeMagic)]) != nativeMagic {
+		return nil, fmt.Errorf("不是有效的 BeanCKUP 原生格式包")
+	}
+	if header[len(nativeMagic)]&flagEncrypted == 0 {
+		// 与 7z 的行为一致: 未加密的包忽略密码
+		return io.NewSectionReader(vols, int64(len(header)), vols.size-int64(len(header))), nil
+	}
+	if password == "" {
+		return nil, fmt.Errorf("包已加密，需要密码")
+	}
+
+	kdf := make([]byte, saltSize+4)
+	if _, err := vols.ReadAt(kdf, int64(len(header))); err != nil {
+		return nil, fmt.Errorf("包头不完整: %w", err)
+	}
+	header = append(header, kdf...)
+	salt, iterations := kdf[:saltSize], binary.BigEndian.Uint32(kdf[saltSize:])
+	if iterations == 0 || iterations > maxKDFIterations {
+		return nil, fmt.Errorf("包头中的密钥派生参数无效")
+	}
+	key, err := deriveKey(password, salt, int(iterations))
+	if err != nil {
+		return nil, fmt.Errorf("无法派生密钥: %w", err)
+	}
+	return newOpenReader(vols, int64(len(header)), vols.size-int64(len(header)), key, header)
+}
+
+// volumes 将包的各个分卷按顺序拼接为一个可随机读取的整体
+type volumes struct {
+	files   []*os.File
+	offsets []int64 // 各分卷在整体中的起始偏移
+	size    int64
+}
+
+// openVolumes 打开包文件。path 以 .001 结尾时打开同名的全部分卷
+func openVolumes(path string) (*volumes, error) {
+	paths := []string{path}
+	if base, ok := strings.CutSuffix(path, ".001"); ok {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(base), globEscape(filepath.Base(base))+".[0-9][0-9][0-9]"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		paths = matches
+	}
+	v := &volumes{}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			v.Close()
+			return nil, fmt.Errorf("无法打开交付包: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			v.Close()
+			return nil, fmt.Errorf("无法读取交付包: %w", err)
+		}
+		v.files = append(v.files, f)
+		v.offsets = append(v.offsets, v.size)
+		v.size += info.Size()
+	}
+	return v, nil
+}
+
+func (v *volumes) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		if pos >= v.size {
+			return read, io.EOF
+		}
+		i := sort.Search(len(v.offsets), func(i int) bool { return v.offsets[i] > pos }) - 1
+		n, err := v.files[i].ReadAt(p[read:], pos-v.offsets[i])
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n == 0 && err == io.EOF {
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	return read, nil
+}
+
+func (v *volumes) Close() error {
+	for _, f := range v.files {
+		f.Close()
+	}
+	return nil
+}
+
+func globEscape(name string) string {
+	return strings.NewReplacer(`[`, `\[`, `]`, `\]`, `*`, `\*`, `?`, `\?`).Replace(name)
+}
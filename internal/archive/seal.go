@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// segmentSize 是每个加密段的明文字节数，最后一段小于该值
+	segmentSize = 64 * 1024
+	// kdfIterations 是 PBKDF2-HMAC-SHA256 的迭代次数
+	kdfIterations = 600000
+	// maxKDFIterations 读取时允许的最大迭代次数，防止损坏的包头导致长时间计算
+	maxKDFIterations = 100000000
+	saltSize         = 16
+	keySize          = 32
+)
+
+// errDecrypt 表示某个加密段未通过认证: 密码错误，或包的内容已损坏
+var errDecrypt = errors.New("解密失败: 密码错误或包已损坏")
+
+// deriveKey 由密码和盐派生 AES-256 密钥
+func deriveKey(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, keySize)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce 返回第 index 段的 nonce: 首字节为最后一段标志，后 8 字节为段序号 (大端)
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	if final {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// sealWriter 将写入的数据按 segmentSize 分段，以 AES-GCM 加密后写入 w。
+// 缓冲区写满即作为普通段输出，Close 时剩余的数据 (可能为空) 作为最后一段输出。
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	aad   []byte
+	buf   []byte
+	index int64
+}
+
+func newSealWriter(w io.Writer, key, aad []byte) (*sealWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, aad: aad, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):segmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == segmentSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *sealWriter) flush(final bool) error {
+	sealed := s.aead.Seal(nil, segmentNonce(s.index, final), s.buf, s.aad)
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close 输出最后一段，不关闭下层的 w
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+// openReader 是加密数据的可随机访问的明文视图。段的边界由密文的总长度推算:
+// 除最后一段外每段都是 segmentSize 字节明文加 GCM 标签。
+type openReader struct {
+	src       io.ReaderAt
+	base      int64 // 第一段在 src 中的偏移
+	aead      cipher.AEAD
+	aad       []byte
+	last      int64 // 最后一段的序号
+	lastLen   int64 // 最后一段的密文长度
+	plainSize int64
+	pos       int64
+	cur       int64 // 已解密的段序号，-1 表示没有
+	plain     []byte
+}
+
+func newOpenReader(src io.ReaderAt, base, cipherLen int64, key, aad []byte) (*openReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealedSize := int64(segmentSize + aead.Overhead())
+	last, lastLen := cipherLen/sealedSize, cipherLen%sealedSize
+	if lastLen < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("加密数据长度不正确，包可能被截断")
+	}
+	return &openReader{
+		src:       src,
+		base:      base,
+		aead:      aead,
+		aad:       aad,
+		last:      last,
+		lastLen:   lastLen,
+		plainSize: last*segmentSize + lastLen - int64(aead.Overhead()),
+		cur:       -1,
+	}, nil
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	if r.pos >= r.plainSize {
+		return 0, io.EOF
+	}
+	index := r.pos / segmentSize
+	if index != r.cur {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-index*segmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *openReader) load(index int64) error {
+	sealedSize := int64(segmentSize + r.aead.Overhead())
+	length := sealedSize
+	if index == r.last {
+		length = r.lastLen
+	}
+	sealed := make([]byte, length)
+	if _, err := r.src.ReadAt(sealed, r.base+index*sealedSize); err != nil {
+		return fmt.Errorf("读取加密数据失败: %w", err)
+	}
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(index, index == r.last), sealed, r.aad)
+	if err != nil {
+		r.cur = -1
+		return errDecrypt
+	}
+	r.plain, r.cur = plain, index
+	return nil
+}
+
+func (r *openReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.plainSize
+	}
+	if offset < 0 {
+		return 0, errors.New("seek 位置无效")
+	}
+	r.pos = offset
+	return offset, nil
+}
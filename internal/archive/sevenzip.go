@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"beanckup-cli/internal/types"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sevenZip 通过外部的 7z 程序读写 .7z 包
+type sevenZip struct{}
+
+func (sevenZip) Format() string { return Format7z }
+
+func (sevenZip) Ext() string { return ".7z" }
+
+func (sevenZip) Method(requested types.CompressionMethod) types.CompressionMethod {
+	if requested == types.CompressionGzip {
+		return types.CompressionLZMA2
+	}
+	return requested
+}
+
+func (sevenZip) Create(path string, opts Options) (Writer, error) {
+	listDir, err := os.MkdirTemp("", "beanckup_list_*")
+	if err != nil {
+		return nil, fmt.Errorf("无法创建临时列表目录: %w", err)
+	}
+	if opts.WorkDir == "" {
+		opts.WorkDir = filepath.Dir(path)
+	}
+	return &sevenZipWriter{path: path, opts: opts, listDir: listDir}, nil
+}
+
+// sevenZipWriter 每次 Add 执行一次 `7z a`，向同一个包追加文件
+type sevenZipWriter struct {
+	path    string
+	opts    Options
+	listDir string
+	groups  int
+}
+
+func (w *sevenZipWriter) Add(dir string, files []*types.FileNode, method types.CompressionMethod, progress ProgressFunc) error {
+	w.groups++
+	listFilePath := filepath.Join(w.listDir, fmt.Sprintf("listfile_%d.txt", w.groups))
+	if err := writeListFile(listFilePath, files); err != nil {
+		return err
+	}
+
+	args := []string{
+		"a",
+		w.path,                // 最终输出的压缩包
+		"@" + listFilePath,    // 让7z根据列表读取文件
+		"-w" + w.opts.WorkDir, // 强制临时文件在交付目录生成
+	}
+	args = append(args, methodArgs(method, w.opts.CompressionLevel)...)
+	args = append(args, "-mmt=on", "-bb3", "-bsp1", "-bso1")
+	if w.opts.Password != "" {
+		args = append(args, "-p"+w.opts.Password, "-mhe=on")
+	}
+
+	log.Printf("[DEBUG] 7z 命令参数: 7z %s", strings.Join(redactPassword(args), " "))
+	log.Printf("[DEBUG] 工作目录: %s", dir)
+
+	cmd := exec.Command("7z", args...)
+	cmd.Dir = dir // 将工作目录设置为源目录，以便7z能通过相对路径找到所有文件
+	return run7zAndHandleProgress(cmd, progress)
+}
+
+func (w *sevenZipWriter) Close() error {
+	return os.RemoveAll(w.listDir)
+}
+
+func (sevenZip) Extract(path string, names []string, destDir, password string) error {
+	listFile, err := os.CreateTemp("", "beanckup_extract_*.txt")
+	if err != nil {
+		return fmt.Errorf("无法创建文件列表: %w", err)
+	}
+	defer os.Remove(listFile.Name())
+	for _, name := range names {
+		io.WriteString(listFile, filepath.ToSlash(name)+"\n")
+	}
+	if err := listFile.Close(); err != nil {
+		return fmt.Errorf("无法写入文件列表: %w", err)
+	}
+
+	args := []string{"x", path, "-o" + destDir, "-aoa", "-y", "@" + listFile.Name()}
+	if password != "" {
+		args = append(args, "-p"+password)
+	}
+	if output, err := exec.Command("7z", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("7z 解压失败 (包: %s): %v %s", filepath.Base(path), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (sevenZip) ExtractFile(path, name, password string, w io.Writer) error {
+	args := []string{"e", path, "-so", filepath.ToSlash(name)}
+	if password != "" {
+		args = append(args, "-p"+password)
+	}
+	var stderr strings.Builder
+	cmd := exec.Command("7z", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("7z 解压失败 (包: %s): %v %s", filepath.Base(path), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// methodArgs 返回指定压缩方式对应的 7z 参数
+func methodArgs(method types.CompressionMethod, compressionLevel int) []string {
+	switch method {
+	case types.CompressionLZMA2:
+		return []string{"-m0=LZMA2", fmt.Sprintf("-mx=%d", compressionLevel)}
+	case types.CompressionPPMd:
+		return []string{"-m0=PPMd", fmt.Sprintf("-mx=%d", compressionLevel)}
+	default:
+		return []string{"-mx=0"}
+	}
+}
+
+// redactPassword 返回隐去密码的参数列表，用于写入日志
+func redactPassword(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-p") && len(arg) > 2 {
+			arg = "-p***"
+		}
+		redacted[i] = arg
+	}
+	return redacted
+}
+
+func writeListFile(listFilePath string, nodes []*types.FileNode) error {
+	listFile, err := os.Create(listFilePath)
+	if err != nil {
+		return fmt.Errorf("无法创建文件列表: %w", err)
+	}
+	defer listFile.Close()
+	for _, node := range nodes {
+		// 写入所有文件的相对路径
+		if _, err := listFile.WriteString(node.Path + "\n"); err != nil {
+			return fmt.Errorf("无法写入文件列表: %w", err)
+		}
+	}
+	return nil
+}
+
+// run7zAndHandleProgress 执行 7z 命令，并从其标准输出中解析进度
+func run7zAndHandleProgress(cmd *exec.Cmd, progressCallback ProgressFunc) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("无法获取 stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("无法获取 stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("启动 7z 命令失败: %w", err)
+	}
+
+	var stderrBuf strings.Builder
+	go func() {
+		io.Copy(&stderrBuf, stderr)
+	}()
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\r')
+		if len(line) > 0 {
+			percentage, currentFile := parse7zProgress(line)
+			if percentage > 0 || strings.Contains(line, "%") {
+				progressCallback(percentage, currentFile)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("读取7z输出时出错: %v", err)
+			}
+			break
+		}
+	}
+
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		if exitErr, ok := waitErr.(*exec.ExitError); ok {
+			// Exit code 1 是 7z 的非致命警告 (例如，有文件被锁定无法访问)
+			// 我们应该记录它，但不应将其视为整个打包过程的失败。
+			if exitErr.ExitCode() == 1 {
+				log.Printf("[警告] 7z 执行时返回非致命错误 (代码 1)，打包可能已部分成功。错误详情: %s", stderrBuf.String())
+				return nil // 视为成功
+			}
+		}
+		// 其他错误 (包括其他退出代码) 视为致命错误。
+		log.Printf("[ERROR] 7z 命令执行失败: %v", waitErr)
+		log.Printf("[ERROR] 7z 标准错误输出: %s", stderrBuf.String())
+		return fmt.Errorf("7z 命令执行失败: %w\n7z stderr: %s", waitErr, stderrBuf.String())
+	}
+	return nil
+}
+
+var (
+	rePercent = regexp.MustCompile(`(\d+)\%`)
+	reFile    = regexp.MustCompile(`\s(U|A|Compressing)\s+(.+)`)
+)
+
+// parse7zProgress 从 7z 的一行输出中解析百分比和当前文件
+func parse7zProgress(line string) (percentage int, currentFile string) {
+	if matches := rePercent.FindStringSubmatch(line); len(matches) > 1 {
+		if p, err := strconv.Atoi(matches[1]); err == nil {
+			percentage = p
+		}
+	}
+	if matches := reFile.FindStringSubmatch(line); len(matches) > 2 {
+		currentFile = strings.TrimSpace(matches[2])
+	}
+	return percentage, currentFile
+}
@@ -0,0 +1,124 @@
+package backupset
+
+import (
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Open 根据用户输入的路径打开备份集: 目录视为单一源目录的工作区，.json 文件视为备份集定义。
+func Open(path string) (*types.BackupSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return FromDirectory(path)
+	}
+	return Load(path)
+}
+
+// FromDirectory 为单个工作区目录创建备份集，元数据保存在其 .beanckup 目录中。
+func FromDirectory(path string) (*types.BackupSet, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析工作区路径: %w", err)
+	}
+	return &types.BackupSet{
+		Name:        util.GetWorkspaceName(absPath),
+		MetadataDir: filepath.Join(absPath, ".beanckup"),
+		Roots:       []types.SourceRoot{{Path: absPath}},
+	}, nil
+}
+
+// Load 读取备份集定义文件，例如:
+//
+//	{
+//	  "name": "server",
+//	  "metadata_dir": "/var/lib/beanckup/server",
+//	  "roots": [
+//	    {"name": "projects", "path": "~/projects"},
+//	    {"name": "etc", "path": "/etc"}
+//	  ]
+//	}
+//
+// 未指定 metadata_dir 时，元数据保存在定义文件旁的 "<name>.beanckup" 目录中。
+func Load(defPath string) (*types.BackupSet, error) {
+	data, err := os.ReadFile(defPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取备份集定义: %w", err)
+	}
+	var set types.BackupSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("无法解析备份集定义: %w", err)
+	}
+	if set.Name == "" {
+		set.Name = strings.TrimSuffix(filepath.Base(defPath), filepath.Ext(defPath))
+	}
+	if len(set.Roots) == 0 {
+		return nil, fmt.Errorf("备份集 '%s' 没有定义任何源目录", set.Name)
+	}
+
+	if set.MetadataDir == "" {
+		set.MetadataDir = filepath.Join(filepath.Dir(defPath), set.Name+".beanckup")
+	}
+	if set.MetadataDir, err = resolvePath(set.MetadataDir); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for i := range set.Roots {
+		root := &set.Roots[i]
+		if root.Name == "" || strings.ContainsAny(root.Name, `/\`) || root.Name == ".beanckup" {
+			return nil, fmt.Errorf("源目录名称 '%s' 无效: 名称不能为空或包含路径分隔符", root.Name)
+		}
+		if names[root.Name] {
+			return nil, fmt.Errorf("源目录名称 '%s' 重复", root.Name)
+		}
+		names[root.Name] = true
+
+		if root.Path, err = resolvePath(root.Path); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(root.Path); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("源目录 '%s' (%s) 不存在或不是目录", root.Name, root.Path)
+		}
+	}
+	for i := range set.Roots {
+		for j := range set.Roots {
+			if i != j && isWithin(set.Roots[j].Path, set.Roots[i].Path) {
+				return nil, fmt.Errorf("源目录 '%s' 位于源目录 '%s' 之内，不能重复备份", set.Roots[j].Name, set.Roots[i].Name)
+			}
+		}
+	}
+	if _, err := set.PackRoot(); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// resolvePath 展开 ~ 并转换为绝对路径
+func resolvePath(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("无法展开路径 '%s': %w", path, err)
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("无法解析路径 '%s': %w", path, err)
+	}
+	return absPath, nil
+}
+
+// isWithin 判断 path 是否位于 dir 之内 (或与之相同)
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
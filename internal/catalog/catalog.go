@@ -0,0 +1,663 @@
+package catalog
+
+import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// 目录 (catalog) 是 .beanckup/catalog/ 下的本地索引，记录每个路径的各个版本在哪些会话中存在、
+// 内容保存在哪个包中，用于快速回答跨会话的查询，而无需重新解析所有清单。
+// 目录只包含已结束的会话，可以随时从清单和会话快照重建。
+const (
+	catalogDirName   = "catalog"
+	recordsFile      = "records.dat"
+	pathIndexFile    = "paths.idx"
+	hashIndexFile    = "hashes.idx"
+	packageIndexFile = "packages.idx"
+	metaFile         = "catalog.json"
+
+	catalogVersion = 1
+)
+
+// PackageInfo 汇总一个包中保存的文件
+type PackageInfo struct {
+	Name      string `json:"name"`
+	FileCount int    `json:"file_count"`
+	TotalSize int64  `json:"total_size"`
+}
+
+// SessionInfo 汇总一个已收录的会话
+type SessionInfo struct {
+	SessionID     int           `json:"session_id"`
+	Timestamp     string        `json:"timestamp"`
+	WorkspaceName string        `json:"workspace_name"`
+	Roots         []string      `json:"roots,omitempty"`
+	FileCount     int           `json:"file_count"`
+	TotalSize     int64         `json:"total_size"`
+	Deleted       int           `json:"deleted,omitempty"`
+	Packages      []PackageInfo `json:"packages,omitempty"` // 本会话新写入的包
+	types.SessionNote
+}
+
+// meta 是目录的元数据。RecordsSize 最后写入，记录文件的实际大小与之不符说明上次更新被中断。
+// RecordsSHA256 是记录文件的摘要，遍历记录时会核对，配合元数据文件的签名可以发现对记录的篡改。
+type meta struct {
+	Version       int           `json:"version"`
+	LastSession   int           `json:"last_session"`
+	RecordsSize   int64         `json:"records_size"`
+	RecordsSHA256 string        `json:"records_sha256"`
+	Sessions      []SessionInfo `json:"sessions"`
+}
+
+// ErrDigestMismatch 表示记录文件与元数据中的摘要不符
+var ErrDigestMismatch = errors.New("目录记录文件的摘要与元数据不符，目录可能已被修改")
+
+var errReadOnly = errors.New("目录索引以只读方式打开，不能修改")
+
+type Catalog struct {
+	dir      string
+	meta     meta
+	rawMeta  []byte   // 元数据文件的内容，验证签名时使用
+	verified bool     // 记录文件已与元数据中的摘要核对过
+	readOnly bool     // 以只读方式打开，不写入目录文件
+	overlay  *overlay // 只读打开时在内存中收录的会话，见 Overlay
+}
+
+// overlay 是在内存中收录的会话对目录的改动
+type overlay struct {
+	last     int
+	sessions []SessionInfo
+	until    map[int64]int // 记录文件中被收录的会话结束的版本: 记录位置 -> 截止会话
+	entries  []*Entry      // 收录的会话新增的记录，Offset 为 -1
+}
+
+// Dir 返回 .beanckup 目录下的目录索引所在路径
+func Dir(beanckupDir string) string {
+	return filepath.Join(beanckupDir, catalogDirName)
+}
+
+// Open 打开目录索引，不存在时返回一个空目录。若上次更新被中断，目录会被清空以便重建。
+func Open(beanckupDir string) (*Catalog, error) {
+	c := &Catalog{dir: Dir(beanckupDir), meta: meta{Version: catalogVersion}}
+	data, err := os.ReadFile(filepath.Join(c.dir, metaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, c.Reset()
+		}
+		return nil, fmt.Errorf("无法读取目录元数据: %w", err)
+	}
+	c.rawMeta = data
+	if err := json.Unmarshal(data, &c.meta); err != nil || c.meta.Version != catalogVersion {
+		log.Printf("警告: 目录索引元数据无法识别，将重建目录")
+		return c, c.Reset()
+	}
+
+	info, err := os.Stat(c.path(recordsFile))
+	if err != nil || info.Size() != c.meta.RecordsSize {
+		log.Printf("警告: 目录索引上次更新未完成，将重建目录")
+		return c, c.Reset()
+	}
+	return c, nil
+}
+
+// OpenReadOnly 以只读方式打开目录索引，用于不持有工作区锁的查询，不会清空或修改目录。
+// 目录不存在时返回一个空目录；元数据无法识别、上次更新未完成或记录文件与摘要不符时返回错误。
+// 其他进程更新目录时先替换记录文件、再写入元数据，两者之间读到的记录文件与元数据不符 (ErrDigestMismatch)，
+// 调用方可以稍后重新打开。
+func OpenReadOnly(beanckupDir string) (*Catalog, error) {
+	c := &Catalog{dir: Dir(beanckupDir), meta: meta{Version: catalogVersion}, readOnly: true}
+	data, err := os.ReadFile(filepath.Join(c.dir, metaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.verified = true
+			return c, nil
+		}
+		return nil, fmt.Errorf("无法读取目录元数据: %w", err)
+	}
+	c.rawMeta = data
+	if err := json.Unmarshal(data, &c.meta); err != nil || c.meta.Version != catalogVersion {
+		return nil, errors.New("目录索引元数据无法识别")
+	}
+	// 正在更新目录的进程追加的记录位于 RecordsSize 之后，读取时会被忽略
+	info, err := os.Stat(c.path(recordsFile))
+	if err != nil || info.Size() < c.meta.RecordsSize {
+		return nil, errors.New("目录索引上次更新未完成")
+	}
+	if err := c.verify(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Catalog) path(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+// Reset 清空目录中的全部记录和索引
+func (c *Catalog) Reset() error {
+	if c.readOnly {
+		return errReadOnly
+	}
+	if err := os.RemoveAll(c.dir); err != nil {
+		return fmt.Errorf("无法清空目录索引: %w", err)
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("无法创建目录索引: %w", err)
+	}
+	if err := os.WriteFile(c.path(recordsFile), nil, 0644); err != nil {
+		return fmt.Errorf("无法创建目录记录文件: %w", err)
+	}
+	c.meta = meta{Version: catalogVersion, RecordsSHA256: hex.EncodeToString(sha256.New().Sum(nil))}
+	c.verified = true
+	return c.saveMeta()
+}
+
+func (c *Catalog) saveMeta() error {
+	data, err := json.MarshalIndent(&c.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(c.path(metaFile), data); err != nil {
+		return fmt.Errorf("无法写入目录元数据: %w", err)
+	}
+	c.rawMeta = data
+	return nil
+}
+
+// RawMeta 返回目录实际使用的元数据文件内容，验证签名时应验证这份内容而不是重新读取文件
+func (c *Catalog) RawMeta() []byte {
+	return c.rawMeta
+}
+
+// MetaPath 返回目录元数据文件的路径，签名时使用
+func (c *Catalog) MetaPath() string {
+	return c.path(metaFile)
+}
+
+// LastSession 返回目录已收录的最后一个会话 (含在内存中叠加的会话)
+func (c *Catalog) LastSession() int {
+	if c.overlay != nil {
+		return c.overlay.last
+	}
+	return c.meta.LastSession
+}
+
+// Sessions 返回已收录会话的摘要
+func (c *Catalog) Sessions() []SessionInfo {
+	if c.overlay == nil {
+		return c.meta.Sessions
+	}
+	return append(slices.Clone(c.meta.Sessions), c.overlay.sessions...)
+}
+
+// Session 返回指定会话的摘要
+func (c *Catalog) Session(sessionID int) (SessionInfo, bool) {
+	for _, s := range c.Sessions() {
+		if s.SessionID == sessionID {
+			return s, true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// changes 是收录一个会话对目录的改动
+type changes struct {
+	info     SessionInfo
+	added    []*Entry // 新增的记录 (文件版本及删除记录)，按写入顺序
+	closed   []*Entry // 截止于该会话的版本
+	reopened []*Entry // 被中断的更新改写了截止会话、但实际仍存在的版本
+}
+
+// diff 计算收录会话 m 对目录的改动。m.Files 须为该会话结束时工作区的完整文件列表，
+// m.Tombstones 中会话号大于目录最后会话的删除记录会被追加。
+func (c *Catalog) diff(m *types.Manifest) (*changes, error) {
+	if m.SessionID <= c.LastSession() {
+		return nil, fmt.Errorf("会话 S%d 已收录在目录中", m.SessionID)
+	}
+	// 新的摘要由更新后的记录文件计算，先确认已有的记录未被修改
+	if err := c.verify(); err != nil {
+		return nil, err
+	}
+	open, err := c.openEntries()
+	if err != nil {
+		return nil, fmt.Errorf("读取目录记录失败: %w", err)
+	}
+
+	ch := &changes{info: SessionInfo{
+		SessionID:     m.SessionID,
+		Timestamp:     m.Timestamp,
+		WorkspaceName: m.WorkspaceName,
+		Roots:         m.Roots,
+		SessionNote:   m.SessionNote,
+	}}
+	packages := make(map[string]*PackageInfo)
+	knownPackages := make(map[string]bool)
+	for _, e := range open {
+		knownPackages[PackageKey(e.Node.Reference)] = true
+	}
+
+	seen := make(map[string]bool, len(m.Files))
+	for _, node := range m.Files {
+		if node.IsDirectory() {
+			continue
+		}
+		seen[node.Path] = true
+		ch.info.FileCount++
+		ch.info.TotalSize += node.Size
+
+		if e, ok := open[node.Path]; ok {
+			if sameVersion(e.Node, node) {
+				if e.Until != 0 {
+					ch.reopened = append(ch.reopened, e)
+				}
+				continue
+			}
+			ch.closed = append(ch.closed, e)
+		}
+		ch.added = append(ch.added, &Entry{From: m.SessionID, Node: node})
+		if key := PackageKey(node.Reference); key != "" && !knownPackages[key] {
+			p := packages[key]
+			if p == nil {
+				p = &PackageInfo{Name: key}
+				packages[key] = p
+			}
+			p.FileCount++
+			p.TotalSize += node.Size
+		}
+	}
+	for path, e := range open {
+		if !seen[path] {
+			ch.closed = append(ch.closed, e)
+		}
+	}
+	for _, t := range m.Tombstones {
+		if t.SessionID <= c.LastSession() {
+			continue
+		}
+		ch.info.Deleted++
+		node := &types.FileNode{Path: t.Path, Size: t.Size, Hash: t.Hash, Reference: t.Reference, Chunks: t.Chunks}
+		ch.added = append(ch.added, &Entry{From: t.SessionID, Deleted: true, Node: node})
+	}
+
+	for _, p := range packages {
+		ch.info.Packages = append(ch.info.Packages, *p)
+	}
+	sort.Slice(ch.info.Packages, func(i, j int) bool { return ch.info.Packages[i].Name < ch.info.Packages[j].Name })
+	return ch, nil
+}
+
+// openEntries 返回目录最后会话中仍存在的版本。截止会话大于已收录会话的记录属于上次被中断的更新，
+// 同样视为仍存在，其 Until 保持记录文件中的值。
+func (c *Catalog) openEntries() (map[string]*Entry, error) {
+	open := make(map[string]*Entry)
+	if c.meta.RecordsSize > 0 {
+		f, err := os.Open(c.path(recordsFile))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		err = scanRecords(f, c.meta.RecordsSize, func(e *Entry) error {
+			if c.overlay != nil {
+				if _, closed := c.overlay.until[e.Offset]; closed {
+					return nil
+				}
+			}
+			if !e.Deleted && (e.Until == 0 || e.Until > c.meta.LastSession) {
+				open[e.Node.Path] = e
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.overlay != nil {
+		for _, e := range c.overlay.entries {
+			if !e.Deleted && e.Until == 0 {
+				open[e.Node.Path] = e
+			}
+		}
+	}
+	return open, nil
+}
+
+// ApplySession 收录一个已结束的会话，对 m 的要求见 diff
+func (c *Catalog) ApplySession(m *types.Manifest) error {
+	if c.readOnly {
+		return errReadOnly
+	}
+	ch, err := c.diff(m)
+	if err != nil {
+		return err
+	}
+
+	// 已有记录的截止会话需要改写，在记录文件的副本上更新后再替换，只读打开目录的进程不会读到改写了一半的记录
+	recordsPath := c.path(recordsFile)
+	tmpPath := recordsPath + ".tmp"
+	f, err := copyRecords(recordsPath, tmpPath, c.meta.RecordsSize)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	w := bufio.NewWriterSize(&offsetWriter{f: f, offset: c.meta.RecordsSize}, 1<<20)
+	offset := c.meta.RecordsSize
+	var pathEntries, hashEntries, packageEntries []indexEntry
+	for _, e := range ch.added {
+		var flags byte
+		if e.Deleted {
+			flags = flagTombstone
+		}
+		rec := encodeRecord(e.From, flags, e.Node)
+		if _, err := w.Write(rec); err != nil {
+			return fmt.Errorf("写入目录记录失败: %w", err)
+		}
+		pathEntries = append(pathEntries, indexEntry{key: keyHash(e.Node.Path), offset: offset})
+		// 删除记录只按路径索引
+		if !e.Deleted && e.Node.Hash != "" {
+			hashEntries = append(hashEntries, indexEntry{key: keyHash(e.Node.Hash), offset: offset})
+		}
+		if !e.Deleted && e.Node.Reference != "" {
+			packageEntries = append(packageEntries, indexEntry{key: keyHash(PackageKey(e.Node.Reference)), offset: offset})
+		}
+		offset += int64(len(rec))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("写入目录记录失败: %w", err)
+	}
+
+	var until [4]byte
+	binary.LittleEndian.PutUint32(until[:], uint32(m.SessionID))
+	for _, e := range ch.closed {
+		if _, err := f.WriteAt(until[:], e.Offset+untilOffset); err != nil {
+			return fmt.Errorf("更新目录记录失败: %w", err)
+		}
+	}
+	var zero [4]byte
+	for _, e := range ch.reopened {
+		if _, err := f.WriteAt(zero[:], e.Offset+untilOffset); err != nil {
+			return fmt.Errorf("更新目录记录失败: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("写入目录记录失败: %w", err)
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(f, 0, offset)); err != nil {
+		return fmt.Errorf("计算目录记录摘要失败: %w", err)
+	}
+	err = f.Close()
+	f = nil
+	if err == nil {
+		err = os.Rename(tmpPath, recordsPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("替换目录记录文件失败: %w", err)
+	}
+
+	// 记录文件替换后、元数据写入前中断时，记录文件的大小与元数据不符，下次打开时目录会被重建
+	for name, entries := range map[string][]indexEntry{
+		pathIndexFile:    pathEntries,
+		hashIndexFile:    hashEntries,
+		packageIndexFile: packageEntries,
+	} {
+		if err := mergeIndex(c.path(name), entries); err != nil {
+			return fmt.Errorf("更新目录索引 %s 失败: %w", name, err)
+		}
+	}
+
+	c.meta.Sessions = append(c.meta.Sessions, ch.info)
+	c.meta.LastSession = m.SessionID
+	c.meta.RecordsSize = offset
+	c.meta.RecordsSHA256 = hex.EncodeToString(digest.Sum(nil))
+	return c.saveMeta()
+}
+
+// copyRecords 将记录文件的前 size 字节复制到 tmpPath，返回以读写方式打开的副本
+func copyRecords(recordsPath, tmpPath string, size int64) (*os.File, error) {
+	src, err := os.Open(recordsPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开目录记录文件: %w", err)
+	}
+	defer src.Close()
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("无法创建目录记录文件副本: %w", err)
+	}
+	if _, err := io.CopyN(f, src, size); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("复制目录记录文件失败: %w", err)
+	}
+	return f, nil
+}
+
+// Overlay 在内存中收录一个已结束的会话而不修改目录文件，对 m 的要求见 diff。
+// 只读打开的目录借此包含尚未收录的会话，之后的查询和遍历都会反映这些会话。
+func (c *Catalog) Overlay(m *types.Manifest) error {
+	if !c.readOnly {
+		return errors.New("只有以只读方式打开的目录可以在内存中收录会话")
+	}
+	ch, err := c.diff(m)
+	if err != nil {
+		return err
+	}
+	if c.overlay == nil {
+		c.overlay = &overlay{last: c.meta.LastSession, until: make(map[int64]int)}
+	}
+	for _, e := range ch.closed {
+		if e.Offset < 0 {
+			e.Until = m.SessionID
+		} else {
+			c.overlay.until[e.Offset] = m.SessionID
+		}
+	}
+	// 被中断的更新改写的截止会话在读取时已按仍存在处理，无需改动
+	for _, e := range ch.added {
+		e.Offset = -1
+		c.overlay.entries = append(c.overlay.entries, e)
+	}
+	c.overlay.sessions = append(c.overlay.sessions, ch.info)
+	c.overlay.last = m.SessionID
+	return nil
+}
+
+// verify 核对记录文件与元数据中的摘要，每个打开的目录只需核对一次
+func (c *Catalog) verify() error {
+	if c.verified {
+		return nil
+	}
+	f, err := os.Open(c.path(recordsFile))
+	if err != nil {
+		return fmt.Errorf("无法打开目录记录文件: %w", err)
+	}
+	defer f.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(f, 0, c.meta.RecordsSize)); err != nil {
+		return fmt.Errorf("计算目录记录摘要失败: %w", err)
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != c.meta.RecordsSHA256 {
+		return ErrDigestMismatch
+	}
+	c.verified = true
+	return nil
+}
+
+// sameVersion 判断两个节点是否为同一文件版本
+func sameVersion(a, b *types.FileNode) bool {
+	return a.Hash == b.Hash && a.Size == b.Size && a.Reference == b.Reference &&
+		a.ModTime.Equal(b.ModTime) && a.CreateTime.Equal(b.CreateTime)
+}
+
+// PackageKey 返回引用中的包基础名 (不含扩展名与 .001 后缀)，与恢复器定位包的方式一致
+func PackageKey(reference string) string {
+	if reference == "" {
+		return ""
+	}
+	pkg, _, _ := strings.Cut(reference, "/")
+	return archive.BaseName(pkg)
+}
+
+// ForEach 按写入顺序遍历目录中的全部记录，最后是在内存中收录的会话的记录。
+// 记录文件尚未核对过且摘要与元数据不符时返回 ErrDigestMismatch，此时回调可能已经收到部分记录，调用方应丢弃已收到的结果。
+// 已核对过的目录不再比较摘要: 其他进程更新目录后，记录文件中已收录部分只有截止会话可能被改写，读取时会被修正。
+func (c *Catalog) ForEach(fn func(*Entry) error) error {
+	if c.meta.RecordsSize > 0 {
+		f, err := os.Open(c.path(recordsFile))
+		if err != nil {
+			return fmt.Errorf("无法打开目录记录文件: %w", err)
+		}
+		defer f.Close()
+		digest := sha256.New()
+		err = scanRecords(io.TeeReader(f, digest), c.meta.RecordsSize, func(e *Entry) error {
+			c.current(e)
+			return fn(e)
+		})
+		if err != nil {
+			return err
+		}
+		if !c.verified && hex.EncodeToString(digest.Sum(nil)) != c.meta.RecordsSHA256 {
+			return ErrDigestMismatch
+		}
+		c.verified = true
+	}
+	if c.overlay != nil {
+		for _, e := range c.overlay.entries {
+			copied := *e
+			if err := fn(&copied); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// current 将从记录文件读出的记录的截止会话修正为目录当前的状态
+func (c *Catalog) current(e *Entry) {
+	// 截止会话超出已收录范围的改写来自被中断的更新，按仍存在处理
+	if e.Until > c.meta.LastSession {
+		e.Until = 0
+	}
+	if c.overlay != nil {
+		if until, ok := c.overlay.until[e.Offset]; ok {
+			e.Until = until
+		}
+	}
+}
+
+// SessionFiles 返回指定会话结束时工作区中的全部文件
+func (c *Catalog) SessionFiles(sessionID int) ([]*types.FileNode, error) {
+	var files []*types.FileNode
+	err := c.ForEach(func(e *Entry) error {
+		if e.InSession(sessionID) {
+			files = append(files, e.Node)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// LookupPath 返回该路径的全部版本及删除记录
+func (c *Catalog) LookupPath(path string) ([]*Entry, error) {
+	return c.lookup(pathIndexFile, path, func(e *Entry) bool { return e.Node.Path == path })
+}
+
+// LookupHash 返回内容哈希为 hash 的全部文件版本
+func (c *Catalog) LookupHash(hash string) ([]*Entry, error) {
+	return c.lookup(hashIndexFile, hash, func(e *Entry) bool { return e.Node.Hash == hash })
+}
+
+// LookupPackage 返回内容保存在指定包中的全部文件版本，name 可以带或不带扩展名和 .001 后缀
+func (c *Catalog) LookupPackage(name string) ([]*Entry, error) {
+	key := PackageKey(name)
+	return c.lookup(packageIndexFile, key, func(e *Entry) bool { return PackageKey(e.Node.Reference) == key })
+}
+
+func (c *Catalog) lookup(indexName, key string, match func(*Entry) bool) ([]*Entry, error) {
+	result, err := c.lookupRecords(indexName, key, match)
+	if err != nil {
+		return nil, err
+	}
+	if c.overlay != nil {
+		for _, e := range c.overlay.entries {
+			// 删除记录只按路径索引
+			if match(e) && (indexName == pathIndexFile || !e.Deleted) {
+				copied := *e
+				result = append(result, &copied)
+			}
+		}
+	}
+	return result, nil
+}
+
+// lookupRecords 通过索引查找记录文件中的匹配记录
+func (c *Catalog) lookupRecords(indexName, key string, match func(*Entry) bool) ([]*Entry, error) {
+	if c.meta.RecordsSize == 0 {
+		return nil, nil
+	}
+	// 索引只给出候选位置，记录本身须与经过签名的元数据中的摘要一致
+	if err := c.verify(); err != nil {
+		return nil, err
+	}
+	offsets, err := lookupIndex(c.path(indexName), key)
+	if err != nil {
+		return nil, fmt.Errorf("查询目录索引失败: %w", err)
+	}
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(c.path(recordsFile))
+	if err != nil {
+		return nil, fmt.Errorf("无法打开目录记录文件: %w", err)
+	}
+	defer f.Close()
+
+	var result []*Entry
+	for _, off := range offsets {
+		if off >= c.meta.RecordsSize {
+			continue
+		}
+		e, err := readRecordAt(f, off)
+		if err != nil {
+			return nil, fmt.Errorf("读取目录记录失败: %w", err)
+		}
+		c.current(e)
+		if match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// offsetWriter 从指定偏移开始顺序写入文件
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
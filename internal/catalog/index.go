@@ -0,0 +1,139 @@
+package catalog
+
+import (
+	"beanckup-cli/internal/util"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+)
+
+// 索引文件由定长条目组成，每个条目为 8 字节键哈希 (FNV-1a) 加 8 字节记录偏移，均为大端序，
+// 按 (键哈希, 偏移) 排序，查询时二分查找。键哈希可能冲突，因此命中后须读取记录核对实际的键。
+const indexEntrySize = 16
+
+type indexEntry struct {
+	key    uint64
+	offset int64
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func sortIndex(entries []indexEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].offset < entries[j].offset
+	})
+}
+
+// mergeIndex 将新条目合并进已有的索引文件，通过临时文件原子替换
+func mergeIndex(path string, added []indexEntry) error {
+	sortIndex(added)
+
+	var existing *bufio.Reader
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		existing = bufio.NewReaderSize(f, 1<<20)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return util.WriteAtomic(path, func(out io.Writer) error {
+		w := bufio.NewWriterSize(out, 1<<20)
+		var buf [indexEntrySize]byte
+		write := func(e indexEntry) error {
+			binary.BigEndian.PutUint64(buf[0:], e.key)
+			binary.BigEndian.PutUint64(buf[8:], uint64(e.offset))
+			_, err := w.Write(buf[:])
+			return err
+		}
+		next := func() (indexEntry, bool, error) {
+			if existing == nil {
+				return indexEntry{}, false, nil
+			}
+			if _, err := io.ReadFull(existing, buf[:]); err != nil {
+				if err == io.EOF {
+					return indexEntry{}, false, nil
+				}
+				return indexEntry{}, false, err
+			}
+			return indexEntry{key: binary.BigEndian.Uint64(buf[0:]), offset: int64(binary.BigEndian.Uint64(buf[8:]))}, true, nil
+		}
+
+		cur, ok, err := next()
+		if err != nil {
+			return err
+		}
+		for _, e := range added {
+			for ok && (cur.key < e.key || (cur.key == e.key && cur.offset < e.offset)) {
+				if err := write(cur); err != nil {
+					return err
+				}
+				if cur, ok, err = next(); err != nil {
+					return err
+				}
+			}
+			if err := write(e); err != nil {
+				return err
+			}
+		}
+		for ok {
+			if err := write(cur); err != nil {
+				return err
+			}
+			if cur, ok, err = next(); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	})
+}
+
+// lookupIndex 返回索引中键哈希等于 key 的全部记录偏移
+func lookupIndex(path string, key string) ([]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size()%indexEntrySize != 0 {
+		return nil, fmt.Errorf("索引文件 %s 已损坏", path)
+	}
+	n := int(info.Size() / indexEntrySize)
+	target := keyHash(key)
+
+	var buf [indexEntrySize]byte
+	var readErr error
+	readAt := func(i int) indexEntry {
+		if _, err := f.ReadAt(buf[:], int64(i)*indexEntrySize); err != nil && readErr == nil {
+			readErr = err
+		}
+		return indexEntry{key: binary.BigEndian.Uint64(buf[0:]), offset: int64(binary.BigEndian.Uint64(buf[8:]))}
+	}
+	first := sort.Search(n, func(i int) bool { return readAt(i).key >= target })
+	var offsets []int64
+	for i := first; i < n; i++ {
+		e := readAt(i)
+		if e.key != target {
+			break
+		}
+		offsets = append(offsets, e.offset)
+	}
+	return offsets, readErr
+}
@@ -0,0 +1,238 @@
+package catalog
+
+import (
+	"beanckup-cli/internal/types"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 记录文件 (records.dat) 只追加写入，每条记录的格式为:
+//
+//	uint32 长度 (不含本字段) | uint32 起始会话 | uint32 截止会话 | uint8 标志 |
+//	int64 大小 | int64 修改时间 | int64 创建时间 | 路径 | 哈希 | 引用 | 压缩方式 [| 块列表]
+//
+// 字符串以 uvarint 长度前缀编码，整数均为小端序，时间为 Unix 纳秒 (0 表示未知)。
+// 块列表只出现在按块存储的文件的记录中，其格式见 appendChunks。
+// 截止会话位于记录内的固定偏移处，文件版本结束时在记录文件的副本上改写后替换原文件，其余字段写入后不再修改。
+const (
+	recordHeaderSize = 4
+	untilOffset      = 8
+	fixedBodySize    = 4 + 4 + 1 + 8 + 8 + 8
+
+	flagTombstone = 1
+)
+
+// Entry 是目录中的一条记录: 某个路径的一个版本在 [From, Until) 会话区间内存在于工作区中，
+// Until 为 0 表示至今仍存在。删除记录的 From 为发现删除的会话。
+type Entry struct {
+	Offset  int64
+	From    int
+	Until   int
+	Deleted bool
+	Node    *types.FileNode
+}
+
+// InSession 判断该版本是否存在于指定会话中
+func (e *Entry) InSession(sessionID int) bool {
+	return !e.Deleted && e.From <= sessionID && (e.Until == 0 || e.Until > sessionID)
+}
+
+func encodeRecord(from int, flags byte, node *types.FileNode) []byte {
+	buf := make([]byte, recordHeaderSize+fixedBodySize, recordHeaderSize+fixedBodySize+len(node.Path)+len(node.Hash)+len(node.Reference)+16)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(from))
+	binary.LittleEndian.PutUint32(buf[8:], 0)
+	buf[12] = flags
+	binary.LittleEndian.PutUint64(buf[13:], uint64(node.Size))
+	binary.LittleEndian.PutUint64(buf[21:], uint64(unixNano(node.ModTime)))
+	binary.LittleEndian.PutUint64(buf[29:], uint64(unixNano(node.CreateTime)))
+	for _, s := range []string{node.Path, node.Hash, node.Reference, string(node.Compression)} {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	if len(node.Chunks) > 0 {
+		buf = appendChunks(buf, node.Chunks)
+	}
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)-recordHeaderSize))
+	return buf
+}
+
+func decodeRecord(offset int64, body []byte) (*Entry, error) {
+	if len(body) < fixedBodySize {
+		return nil, fmt.Errorf("目录记录 @%d 长度不足", offset)
+	}
+	e := &Entry{
+		Offset:  offset,
+		From:    int(binary.LittleEndian.Uint32(body[0:])),
+		Until:   int(binary.LittleEndian.Uint32(body[4:])),
+		Deleted: body[8]&flagTombstone != 0,
+		Node: &types.FileNode{
+			Size:       int64(binary.LittleEndian.Uint64(body[9:])),
+			ModTime:    fromUnixNano(int64(binary.LittleEndian.Uint64(body[17:]))),
+			CreateTime: fromUnixNano(int64(binary.LittleEndian.Uint64(body[25:]))),
+		},
+	}
+	rest := body[fixedBodySize:]
+	var fields [4]string
+	for i := range fields {
+		n, k := binary.Uvarint(rest)
+		if k <= 0 || uint64(len(rest)-k) < n {
+			return nil, fmt.Errorf("目录记录 @%d 已损坏", offset)
+		}
+		fields[i] = string(rest[k : k+int(n)])
+		rest = rest[k+int(n):]
+	}
+	e.Node.Path, e.Node.Hash, e.Node.Reference = fields[0], fields[1], fields[2]
+	e.Node.Compression = types.CompressionMethod(fields[3])
+	if len(rest) > 0 {
+		chunks, err := decodeChunks(rest)
+		if err != nil {
+			return nil, fmt.Errorf("目录记录 @%d 已损坏: %w", offset, err)
+		}
+		e.Node.Chunks = chunks
+	}
+	return e, nil
+}
+
+// appendChunks 编码块列表: uvarint 块包数 | 各块包的引用 (字符串) | uvarint 块数 |
+// 各块的 32 字节哈希、uvarint 大小、uvarint 块包序号 + 1 (0 表示尚未交付) 和 uvarint 偏移
+func appendChunks(buf []byte, chunks []types.Chunk) []byte {
+	packIndex := make(map[string]int)
+	var packs []string
+	for _, c := range chunks {
+		if _, ok := packIndex[c.Reference]; !ok && c.Reference != "" {
+			packIndex[c.Reference] = len(packs)
+			packs = append(packs, c.Reference)
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(packs)))
+	for _, p := range packs {
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+		buf = append(buf, p...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(chunks)))
+	for _, c := range chunks {
+		var hash [sha256.Size]byte
+		hex.Decode(hash[:], []byte(c.Hash))
+		buf = append(buf, hash[:]...)
+		buf = binary.AppendUvarint(buf, uint64(c.Size))
+		pack := 0
+		if c.Reference != "" {
+			pack = packIndex[c.Reference] + 1
+		}
+		buf = binary.AppendUvarint(buf, uint64(pack))
+		buf = binary.AppendUvarint(buf, uint64(c.Offset))
+	}
+	return buf
+}
+
+func decodeChunks(data []byte) ([]types.Chunk, error) {
+	errCorrupt := errors.New("块列表格式错误")
+	next := func() (uint64, error) {
+		v, k := binary.Uvarint(data)
+		if k <= 0 {
+			return 0, errCorrupt
+		}
+		data = data[k:]
+		return v, nil
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	packs := make([]string, 0, min(count, 1024))
+	for range count {
+		n, err := next()
+		if err != nil || uint64(len(data)) < n {
+			return nil, errCorrupt
+		}
+		packs = append(packs, string(data[:n]))
+		data = data[n:]
+	}
+	if count, err = next(); err != nil {
+		return nil, err
+	}
+	chunks := make([]types.Chunk, 0, min(count, uint64(len(data)/sha256.Size)))
+	for range count {
+		if len(data) < sha256.Size {
+			return nil, errCorrupt
+		}
+		c := types.Chunk{Hash: hex.EncodeToString(data[:sha256.Size])}
+		data = data[sha256.Size:]
+		var fields [3]uint64
+		for i := range fields {
+			if fields[i], err = next(); err != nil {
+				return nil, err
+			}
+		}
+		if fields[1] > uint64(len(packs)) {
+			return nil, errCorrupt
+		}
+		c.Size, c.Offset = int64(fields[0]), int64(fields[2])
+		if fields[1] > 0 {
+			c.Reference = packs[fields[1]-1]
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// readRecordAt 读取指定偏移处的一条记录
+func readRecordAt(r io.ReaderAt, offset int64) (*Entry, error) {
+	var header [recordHeaderSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := r.ReadAt(body, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	return decodeRecord(offset, body)
+}
+
+// scanRecords 顺序读取记录文件中前 size 字节内的全部记录
+func scanRecords(r io.Reader, size int64, fn func(*Entry) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var offset int64
+	var header [recordHeaderSize]byte
+	for offset < size {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(br, body); err != nil {
+			return err
+		}
+		e, err := decodeRecord(offset, body)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		offset += recordHeaderSize + int64(len(body))
+	}
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
@@ -0,0 +1,115 @@
+package chunker
+
+import (
+	"beanckup-cli/internal/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 块的大小范围。切分点由内容决定 (FastCDC)，文件中间插入或删除数据只影响附近的块。
+// 这些参数和 gear 表决定了切分结果，修改后已交付的块将无法再被复用。
+const (
+	MinSize = 256 * 1024
+	AvgSize = 1024 * 1024
+	MaxSize = 4 * 1024 * 1024
+)
+
+// 归一化切分: 未达到平均大小前使用更严格的掩码，之后使用更宽松的掩码，使块大小集中在平均值附近
+const (
+	maskStrict = uint64(1<<22-1) << (64 - 22)
+	maskLoose  = uint64(1<<18-1) << (64 - 18)
+)
+
+// gear 是滚动哈希使用的随机表，由固定种子的 splitmix64 生成
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x6265616e636b7570)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Split 将数据流切分为块，依次传给 fn。传给 fn 的切片在其返回后会被复用，不得保留。
+func Split(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, 2*MaxSize)
+	start, end := 0, 0
+	eof := false
+	for {
+		if !eof && end-start < MaxSize {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		n := cut(buf[start:end])
+		if err := fn(buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// cut 返回 data 开头第一个块的长度
+func cut(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	n := min(len(data), MaxSize)
+	normal := min(n, AvgSize)
+	var hash uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&maskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&maskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// HashChunk 返回块内容的哈希
+func HashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Chunks 切分文件并返回各块的哈希和大小 (不含位置)
+func Chunks(path string) ([]types.Chunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var chunks []types.Chunk
+	err = Split(f, func(chunk []byte) error {
+		chunks = append(chunks, types.Chunk{Hash: HashChunk(chunk), Size: int64(len(chunk))})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("无法切分文件: %w", err)
+	}
+	return chunks, nil
+}
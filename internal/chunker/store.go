@@ -0,0 +1,168 @@
+package chunker
+
+import (
+	"beanckup-cli/internal/types"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DefaultMinFileMB 是未设置 min_file_mb 时按块存储的最小文件大小
+const DefaultMinFileMB = 64
+
+// PackDir 是块包在交付包内的目录
+const PackDir = ".beanckup/chunks"
+
+// packLimit 是单个块包的大小上限。恢复时只需解压含有所需块的块包
+const packLimit = 64 * 1024 * 1024
+
+// ErrChanged 表示文件内容与规划时切分出的块不符，即文件在扫描之后被修改过
+var ErrChanged = errors.New("文件内容与规划时的块列表不符")
+
+// MinFileSize 返回按块存储的最小文件大小，未启用块级去重时返回 0
+func MinFileSize(cfg types.ChunkingConfig) int64 {
+	if !cfg.Enabled {
+		return 0
+	}
+	minFileMB := cfg.MinFileMB
+	if minFileMB <= 0 {
+		minFileMB = DefaultMinFileMB
+	}
+	return int64(minFileMB) * 1024 * 1024
+}
+
+// Prepare 切分待交付的大文件 (不小于 minSize)，为其设置块列表。已交付过的块 (known 中的) 记录其位置，不再重复交付；
+// 文件的规划大小按仍需交付的字节数的比例缩小。返回按块存储的文件数和其中无需再交付的字节数。
+// 无法读取的文件保持按整个文件交付。
+func Prepare(set *types.BackupSet, nodes []*types.FileNode, known map[string]types.Chunk, minSize int64) (files int, reused int64) {
+	if minSize <= 0 {
+		return 0, 0
+	}
+	for _, node := range nodes {
+		if node.IsDirectory() || node.Reference != "" || node.Size < minSize {
+			continue
+		}
+		chunks, err := Chunks(set.AbsPath(node.Path))
+		if err != nil {
+			log.Printf("警告: 无法切分文件 %s，将按整个文件交付: %v", node.Path, err)
+			continue
+		}
+		var newBytes int64
+		seen := make(map[string]bool, len(chunks))
+		for i, c := range chunks {
+			if k, ok := known[c.Hash]; ok {
+				chunks[i] = k
+			} else if !seen[c.Hash] {
+				newBytes += c.Size
+			}
+			seen[c.Hash] = true
+		}
+		node.Chunks = chunks
+		node.EstimatedSize = max(int64(float64(node.PlannedSize())*float64(newBytes)/float64(node.Size)), 1)
+		files++
+		reused += node.Size - newBytes
+	}
+	return files, reused
+}
+
+// PackWriter 将一个交付包中新增的块写入暂存目录下的块包，同一块在包内只写入一次
+type PackWriter struct {
+	stageDir    string
+	packageName string                 // 引用中的包名 (分卷时带 .001)
+	written     map[string]types.Chunk // 已写入本包的块
+	packs       []*types.FileNode
+	current     *os.File
+}
+
+// NewPackWriter 创建写入 stageDir/.beanckup/chunks 的块包写入器，packageName 是块引用中使用的包名
+func NewPackWriter(stageDir, packageName string) *PackWriter {
+	return &PackWriter{stageDir: stageDir, packageName: packageName, written: make(map[string]types.Chunk)}
+}
+
+// WriteFile 重新切分文件，将块列表 chunks 中尚未交付的块写入块包，返回设置了位置的块列表 (chunks 本身不被修改)。
+// 文件内容与块列表不符 (扫描之后被修改过) 时返回 ErrChanged，此前已写入的块仍然有效。
+func (w *PackWriter) WriteFile(fullPath string, chunks []types.Chunk) ([]types.Chunk, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	located := make([]types.Chunk, 0, len(chunks))
+	err = Split(f, func(data []byte) error {
+		i := len(located)
+		if i >= len(chunks) || HashChunk(data) != chunks[i].Hash {
+			return ErrChanged
+		}
+		c := chunks[i]
+		if c.Reference == "" {
+			if existing, ok := w.written[c.Hash]; ok {
+				c = existing
+			} else if err := w.write(&c, data); err != nil {
+				return err
+			}
+		}
+		located = append(located, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(located) != len(chunks) {
+		return nil, ErrChanged
+	}
+	return located, nil
+}
+
+// write 将一个块追加到当前块包，当前块包已满时换用新的块包
+func (w *PackWriter) write(c *types.Chunk, data []byte) error {
+	if w.current == nil || w.packs[len(w.packs)-1].Size+int64(len(data)) > packLimit {
+		if err := w.nextPack(); err != nil {
+			return err
+		}
+	}
+	pack := w.packs[len(w.packs)-1]
+	if _, err := w.current.Write(data); err != nil {
+		return fmt.Errorf("无法写入块包: %w", err)
+	}
+	c.Reference = w.packageName + "/" + pack.Path
+	c.Offset = pack.Size
+	pack.Size += int64(len(data))
+	w.written[c.Hash] = *c
+	return nil
+}
+
+func (w *PackWriter) nextPack() error {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return fmt.Errorf("无法写入块包: %w", err)
+		}
+		w.current = nil
+	}
+	name := path.Join(PackDir, fmt.Sprintf("%04d.pack", len(w.packs)+1))
+	fullPath := filepath.Join(w.stageDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("无法创建块包目录: %w", err)
+	}
+	f, err := os.Create(fullPath)
+	if err != nil {
+		return fmt.Errorf("无法创建块包: %w", err)
+	}
+	w.current = f
+	w.packs = append(w.packs, &types.FileNode{Path: name})
+	return nil
+}
+
+// Close 关闭当前块包，返回已写入的块包 (路径相对于暂存目录)
+func (w *PackWriter) Close() ([]*types.FileNode, error) {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return nil, fmt.Errorf("无法写入块包: %w", err)
+		}
+		w.current = nil
+	}
+	return w.packs, nil
+}
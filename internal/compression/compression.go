@@ -0,0 +1,142 @@
+package compression
+
+import (
+	"beanckup-cli/internal/types"
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// sampleBlockSize 是每个采样块的大小
+	sampleBlockSize = 64 * 1024
+	// sampleMinSize 小于该大小的文件不做采样，直接按扩展名判断
+	sampleMinSize = 4 * 1024
+	// incompressibleRatio 采样压缩比高于该值时视为不可压缩
+	incompressibleRatio = 0.9
+)
+
+// incompressibleExts 是已知内容已经过压缩的文件扩展名
+var incompressibleExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".wmv": true, ".webm": true, ".m4v": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".flac": true, ".ogg": true, ".opus": true,
+	".zip": true, ".7z": true, ".rar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".epub": true,
+	".jar": true, ".apk": true, ".dmg": true,
+}
+
+// compressibleExts 是已知压缩效果良好的文本类扩展名，无需采样
+var compressibleExts = map[string]bool{
+	".txt": true, ".md": true, ".csv": true, ".tsv": true, ".log": true, ".json": true, ".xml": true, ".yaml": true, ".yml": true,
+	".html": true, ".htm": true, ".css": true, ".js": true, ".ts": true, ".go": true, ".c": true, ".h": true, ".cpp": true,
+	".py": true, ".java": true, ".sql": true, ".ini": true, ".conf": true, ".svg": true,
+}
+
+// ParseMethod 将用户输入解析为压缩方法，无法识别时返回 false。
+func ParseMethod(input string) (types.CompressionMethod, bool) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "lzma2":
+		return types.CompressionLZMA2, true
+	case "ppmd":
+		return types.CompressionPPMd, true
+	case "gzip", "deflate":
+		return types.CompressionGzip, true
+	case "store", "copy":
+		return types.CompressionStore, true
+	}
+	return "", false
+}
+
+// Classifier 根据扩展名和采样结果为文件选择压缩方式。
+type Classifier struct {
+	method types.CompressionMethod
+	level  int
+}
+
+// NewClassifier 创建一个分类器。method 为可压缩文件使用的方法，level 为 0 时所有文件都仅存储。
+func NewClassifier(method types.CompressionMethod, level int) *Classifier {
+	if method == "" {
+		method = types.CompressionLZMA2
+	}
+	return &Classifier{method: method, level: level}
+}
+
+// Classify 返回文件列表中每个节点应使用的压缩方式 (目录为空字符串)，不修改节点。
+// 未知类型的文件需要读取采样，调用方不应在持有锁时调用。
+func (c *Classifier) Classify(set *types.BackupSet, nodes []*types.FileNode) []types.CompressionMethod {
+	methods := make([]types.CompressionMethod, len(nodes))
+	for i, node := range nodes {
+		if node.IsDirectory() {
+			continue
+		}
+		methods[i] = c.classifyFile(set.AbsPath(node.Path), node.Size)
+	}
+	return methods
+}
+
+func (c *Classifier) classifyFile(fullPath string, size int64) types.CompressionMethod {
+	if c.level == 0 || c.method == types.CompressionStore {
+		return types.CompressionStore
+	}
+	if !IsCompressible(fullPath, size) {
+		return types.CompressionStore
+	}
+	return c.method
+}
+
+// IsCompressible 先按扩展名判断，未知类型再对文件头、中、尾三段进行采样压缩测试。
+func IsCompressible(fullPath string, size int64) bool {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if incompressibleExts[ext] {
+		return false
+	}
+	if compressibleExts[ext] || size < sampleMinSize {
+		return true
+	}
+	ratio, err := SampleRatio(fullPath, size)
+	if err != nil {
+		// 采样失败时保守地交给 7z 压缩
+		return true
+	}
+	return ratio < incompressibleRatio
+}
+
+// SampleRatio 对文件进行采样并返回 deflate 快速压缩后的大小比例 (压缩后/压缩前)。
+func SampleRatio(fullPath string, size int64) (float64, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	offsets := []int64{0}
+	if size > 3*sampleBlockSize {
+		offsets = append(offsets, size/2-sampleBlockSize/2, size-sampleBlockSize)
+	}
+
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		return 0, err
+	}
+	var sampled int64
+	buf := make([]byte, sampleBlockSize)
+	for _, offset := range offsets {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		writer.Write(buf[:n])
+		sampled += int64(n)
+	}
+	writer.Close()
+
+	if sampled == 0 {
+		return 1, nil
+	}
+	return float64(compressed.Len()) / float64(sampled), nil
+}
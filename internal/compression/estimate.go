@@ -0,0 +1,189 @@
+package compression
+
+import (
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StatsFileName 是压缩估算统计在元数据目录中的相对路径。
+// 放在子目录中，以免被当作旧格式的 JSON 清单。
+const StatsFileName = "stats/compression.json"
+
+const (
+	// defaultRatio 是既不能采样、也没有扩展名统计的可压缩文件使用的压缩比
+	defaultRatio = 0.5
+	// minExtSample 扩展名累计采样量达到该字节数后，才用其统计值代替默认压缩比
+	minExtSample = 1024 * 1024
+	// correctionWeight 是每个交付包的实际结果在校正系数中所占的权重
+	correctionWeight = 0.5
+)
+
+// MethodStats 记录某种压缩方法下实际大小与估算大小之比的滑动平均
+type MethodStats struct {
+	Correction float64 `json:"correction"`
+	Episodes   int     `json:"episodes"`
+}
+
+// ExtStats 累计某种扩展名文件的采样结果
+type ExtStats struct {
+	Sampled    int64 `json:"sampled"`    // 采样的原始字节数
+	Compressed int64 `json:"compressed"` // 采样压缩后的字节数
+}
+
+// Stats 是保存在元数据目录中的压缩估算统计
+type Stats struct {
+	Methods    map[types.CompressionMethod]*MethodStats `json:"methods"`
+	Extensions map[string]*ExtStats                     `json:"extensions"`
+}
+
+// Estimator 根据采样和历史统计估算文件压缩后的大小。
+// 采样使用 deflate 快速压缩，与 7z 的实际结果存在系统性偏差，由每个交付包的实际大小逐步校正。
+type Estimator struct {
+	path  string
+	stats *Stats
+}
+
+// LoadEstimator 从元数据目录加载估算统计，文件不存在时从空统计开始
+func LoadEstimator(beanckupDir string) (*Estimator, error) {
+	e := &Estimator{
+		path: filepath.Join(beanckupDir, filepath.FromSlash(StatsFileName)),
+		stats: &Stats{
+			Methods:    make(map[types.CompressionMethod]*MethodStats),
+			Extensions: make(map[string]*ExtStats),
+		},
+	}
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return e, nil
+		}
+		return nil, fmt.Errorf("无法读取压缩估算统计: %w", err)
+	}
+	if err := json.Unmarshal(data, e.stats); err != nil {
+		return nil, fmt.Errorf("无法解析压缩估算统计: %w", err)
+	}
+	if e.stats.Methods == nil {
+		e.stats.Methods = make(map[types.CompressionMethod]*MethodStats)
+	}
+	if e.stats.Extensions == nil {
+		e.stats.Extensions = make(map[string]*ExtStats)
+	}
+	return e, nil
+}
+
+// Save 将估算统计写回元数据目录
+func (e *Estimator) Save() error {
+	data, err := json.MarshalIndent(e.stats, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化压缩估算统计失败: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+		return fmt.Errorf("无法创建统计目录: %w", err)
+	}
+	if err := util.WriteFileAtomic(e.path, data); err != nil {
+		return fmt.Errorf("写入压缩估算统计失败: %w", err)
+	}
+	return nil
+}
+
+// Estimate 为每个新文件设置 EstimatedSize。method 和 level 与交付参数相同；不压缩时估算值即原始大小。
+// 返回全部文件估算大小之和。
+func (e *Estimator) Estimate(set *types.BackupSet, nodes []*types.FileNode, method types.CompressionMethod, level int) int64 {
+	if method == "" {
+		method = types.CompressionLZMA2
+	}
+	correction := 1.0
+	if ms := e.stats.Methods[method]; ms != nil && ms.Correction > 0 {
+		correction = ms.Correction
+	}
+
+	var total int64
+	for _, node := range nodes {
+		if node.IsDirectory() {
+			continue
+		}
+		node.EstimatedSize = node.Size
+		if level > 0 && method != types.CompressionStore && node.Size > 0 {
+			ratio := e.fileRatio(set.AbsPath(node.Path), node.Size)
+			estimated := int64(float64(node.Size) * ratio * correction)
+			if ratio < 1 && estimated < node.Size {
+				node.EstimatedSize = max(estimated, 1)
+			}
+		}
+		total += node.EstimatedSize
+	}
+	return total
+}
+
+// fileRatio 返回单个文件的估算压缩比 (压缩后/压缩前)，不可压缩的文件返回 1
+func (e *Estimator) fileRatio(fullPath string, size int64) float64 {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	if incompressibleExts[ext] {
+		return 1
+	}
+	if size >= sampleMinSize {
+		if ratio, err := SampleRatio(fullPath, size); err == nil {
+			e.recordSample(ext, size, ratio)
+			if ratio >= incompressibleRatio {
+				return 1 // 与 IsCompressible 一致，这类文件会被仅存储
+			}
+			return ratio
+		}
+	}
+	if es := e.stats.Extensions[ext]; es != nil && es.Sampled >= minExtSample {
+		return float64(es.Compressed) / float64(es.Sampled)
+	}
+	return defaultRatio
+}
+
+// recordSample 将一次采样结果计入扩展名统计，采样量按实际读取的块数计算
+func (e *Estimator) recordSample(ext string, size int64, ratio float64) {
+	sampled := min(size, int64(sampleBlockSize))
+	if size > 3*sampleBlockSize {
+		sampled = 3 * sampleBlockSize
+	}
+	es := e.stats.Extensions[ext]
+	if es == nil {
+		es = &ExtStats{}
+		e.stats.Extensions[ext] = es
+	}
+	es.Sampled += sampled
+	es.Compressed += int64(float64(sampled) * ratio)
+}
+
+// Observe 根据一个已交付包的实际大小与估算大小更新该压缩方法的校正系数。
+// 仅存储的文件不参与校正，从两边扣除后只比较被压缩部分。
+func (e *Estimator) Observe(method types.CompressionMethod, episode *types.Episode) {
+	var stored int64
+	for _, node := range episode.Files {
+		if node.EstimatedSize == 0 || node.EstimatedSize == node.Size {
+			stored += node.Size
+		}
+	}
+	estimated := episode.EstimatedSize - stored
+	actual := episode.ActualSize - stored
+	if estimated <= 0 || actual <= 0 {
+		return
+	}
+	if method == "" {
+		method = types.CompressionLZMA2
+	}
+	ms := e.stats.Methods[method]
+	if ms == nil {
+		ms = &MethodStats{Correction: 1}
+		e.stats.Methods[method] = ms
+	}
+	observed := ms.Correction * float64(actual) / float64(estimated)
+	if ms.Episodes == 0 {
+		ms.Correction = observed
+	} else {
+		ms.Correction = ms.Correction*(1-correctionWeight) + observed*correctionWeight
+	}
+	ms.Correction = min(max(ms.Correction, 0.05), 2.0)
+	ms.Episodes++
+}
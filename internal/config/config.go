@@ -0,0 +1,28 @@
+package config
+
+import (
+	"beanckup-cli/internal/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ConfigFileName 是工作区配置文件在 .beanckup 目录中的文件名
+const ConfigFileName = "config.json"
+
+// Load 从 .beanckup 目录读取配置文件。文件不存在时返回空的默认配置。
+func Load(beanckupDir string) (*types.Config, error) {
+	cfg := &types.Config{}
+	data, err := os.ReadFile(filepath.Join(beanckupDir, ConfigFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("无法读取配置文件: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("无法解析配置文件: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/compression"
+	"beanckup-cli/internal/session"
+	"beanckup-cli/internal/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config 是守护进程的配置文件，列出按计划备份的工作区
+type Config struct {
+	// StatusFile 是守护进程写出的状态文件，供其他工具读取；默认为配置文件旁的 <配置文件名>.status.json
+	StatusFile string `json:"status_file,omitempty"`
+	Jobs       []*Job `json:"jobs"`
+}
+
+// Job 是一个按计划备份的工作区。交付参数未设置 (为零值) 时使用工作区 config.json 中的值。
+type Job struct {
+	Name      string `json:"name,omitempty"` // 状态文件中的名称，默认为工作区路径
+	Workspace string `json:"workspace"`      // 工作区路径或备份集定义文件
+	Schedule  string `json:"schedule"`       // "hourly"、"daily 02:30" 或 "every 30m"
+
+	DeliveryPath       string            `json:"delivery_path,omitempty"`
+	Mirrors            []string          `json:"mirrors,omitempty"`
+	PackageSizeLimitMB int               `json:"package_size_limit_mb,omitempty"`
+	TotalSizeLimitMB   int               `json:"total_size_limit_mb,omitempty"`
+	CompressionLevel   int               `json:"compression_level,omitempty"`
+	CompressionMethod  string            `json:"compression_method,omitempty"`
+	PackingMode        types.PackingMode `json:"packing_mode,omitempty"`
+	ParallelEpisodes   int               `json:"parallel_episodes,omitempty"`
+	Archiver           string            `json:"archiver,omitempty"` // "7z" 或 "native"
+	// PasswordEnv 是保存加密密码的环境变量名，未设置时使用工作区配置中的密码
+	PasswordEnv string `json:"password_env,omitempty"`
+	// Label、Notes 和 Tags 记录在该任务创建的每个会话中，如 "tags": ["nightly"]
+	Label string   `json:"label,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	schedule Schedule
+}
+
+// LoadConfig 读取并校验守护进程的配置文件
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取守护进程配置: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("无法解析守护进程配置: %w", err)
+	}
+	if len(cfg.Jobs) == 0 {
+		return nil, fmt.Errorf("守护进程配置中没有任何工作区")
+	}
+	names := make(map[string]bool)
+	for i, job := range cfg.Jobs {
+		if job.Workspace == "" {
+			return nil, fmt.Errorf("第 %d 个任务没有设置 workspace", i+1)
+		}
+		if job.Name == "" {
+			job.Name = job.Workspace
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("任务名称重复: %s", job.Name)
+		}
+		names[job.Name] = true
+		if job.schedule, err = ParseSchedule(job.Schedule); err != nil {
+			return nil, fmt.Errorf("任务 %s: %w", job.Name, err)
+		}
+		if job.CompressionMethod != "" {
+			if _, ok := compression.ParseMethod(job.CompressionMethod); !ok {
+				return nil, fmt.Errorf("任务 %s: 未知的压缩方法 %q", job.Name, job.CompressionMethod)
+			}
+		}
+		if !archive.Valid(job.Archiver) {
+			return nil, fmt.Errorf("任务 %s: 未知的归档格式 %q", job.Name, job.Archiver)
+		}
+	}
+	if cfg.StatusFile == "" {
+		cfg.StatusFile = strings.TrimSuffix(path, filepath.Ext(path)) + ".status.json"
+	}
+	return &cfg, nil
+}
+
+// DeliveryParams 合并任务和工作区配置，得到本次交付的参数
+func (j *Job) DeliveryParams(cfg *types.Config) (*session.DeliveryParams, error) {
+	params := &session.DeliveryParams{
+		DeliveryPath:       firstNonEmpty(j.DeliveryPath, cfg.DeliveryPath),
+		Mirrors:            j.Mirrors,
+		PackageSizeLimitMB: firstNonZero(j.PackageSizeLimitMB, cfg.PackageSizeLimitMB),
+		TotalSizeLimitMB:   firstNonZero(j.TotalSizeLimitMB, cfg.TotalSizeLimitMB),
+		CompressionLevel:   firstNonZero(j.CompressionLevel, cfg.CompressionLevel),
+		PackingMode:        j.PackingMode,
+		ParallelEpisodes:   firstNonZero(j.ParallelEpisodes, cfg.ParallelEpisodes),
+		Archiver:           firstNonEmpty(j.Archiver, cfg.Archiver),
+		Password:           cfg.Password,
+		Note:               types.SessionNote{Label: j.Label, Notes: j.Notes, Tags: j.Tags},
+	}
+	if params.DeliveryPath == "" {
+		return nil, fmt.Errorf("没有设置交付目录 (delivery_path)")
+	}
+	if params.PackingMode == "" {
+		params.PackingMode = cfg.PackingMode
+	}
+	params.CompressionMethod = types.CompressionStore
+	if params.CompressionLevel > 0 {
+		params.CompressionMethod = types.CompressionLZMA2
+		if method, ok := compression.ParseMethod(j.CompressionMethod); ok {
+			params.CompressionMethod = method
+		}
+	}
+	if j.PasswordEnv != "" {
+		password, ok := os.LookupEnv(j.PasswordEnv)
+		if !ok {
+			return nil, fmt.Errorf("环境变量 %s 未设置", j.PasswordEnv)
+		}
+		params.Password = password
+	}
+	return params, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstNonZero(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
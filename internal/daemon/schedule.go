@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 决定任务的运行时间
+type Schedule interface {
+	// Next 返回 last (上次开始运行的时间) 之后的下一次运行时间；从未运行过时 last 为零值，
+	// 此时从 now 开始计算。返回的时间早于 now 表示错过了运行时间，应立即运行。
+	Next(last, now time.Time) time.Time
+}
+
+// ParseSchedule 解析计划: "hourly" (每小时整点)、"daily HH:MM" (每天固定时间) 或 "every <间隔>" (如 every 30m)
+func ParseSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	switch {
+	case len(fields) == 1 && fields[0] == "hourly":
+		return hourly{}, nil
+	case len(fields) == 2 && fields[0] == "daily":
+		hour, minute, ok := parseClock(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("无效的时间 %q，应为 HH:MM", fields[1])
+		}
+		return daily{hour: hour, minute: minute}, nil
+	case len(fields) == 2 && fields[0] == "every":
+		interval, err := time.ParseDuration(fields[1])
+		if err != nil || interval < time.Minute {
+			return nil, fmt.Errorf("无效的间隔 %q，应为不小于 1m 的时长，如 30m 或 6h", fields[1])
+		}
+		return every{interval: interval}, nil
+	}
+	return nil, fmt.Errorf("无效的计划 %q，应为 hourly、daily HH:MM 或 every <间隔>", spec)
+}
+
+func parseClock(s string) (hour, minute int, ok bool) {
+	h, m, found := strings.Cut(s, ":")
+	if !found {
+		return 0, 0, false
+	}
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, false
+	}
+	return hour, minute, true
+}
+
+// hourly 在每小时整点运行
+type hourly struct{}
+
+func (hourly) Next(last, now time.Time) time.Time {
+	base := last
+	if base.IsZero() {
+		base = now
+	}
+	return base.Truncate(time.Hour).Add(time.Hour)
+}
+
+// daily 在每天的固定时间 (本地时间) 运行
+type daily struct {
+	hour, minute int
+}
+
+func (d daily) Next(last, now time.Time) time.Time {
+	base := last
+	if base.IsZero() {
+		base = now
+	}
+	next := time.Date(base.Year(), base.Month(), base.Day(), d.hour, d.minute, 0, 0, base.Location())
+	if !next.After(base) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// every 在上次运行开始后经过固定间隔再次运行，从未运行过时立即运行
+type every struct {
+	interval time.Duration
+}
+
+func (e every) Next(last, now time.Time) time.Time {
+	if last.IsZero() {
+		return now
+	}
+	return last.Add(e.interval)
+}
@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"beanckup-cli/internal/util"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 任务运行的结果。completed、paused 和 aborted 与 post_session 钩子的结果相同。
+const (
+	ResultCompleted = "completed" // 本会话的全部包均已交付
+	ResultPaused    = "paused"    // 部分包已交付，其余的留待下次运行
+	ResultAborted   = "aborted"   // 交付被钩子或错误中止
+	ResultSkipped   = "skipped"   // 工作区没有变化，无需交付
+	ResultFailed    = "failed"    // 运行前出错 (如工作区或交付目录不可用)
+	ResultBusy      = "busy"      // 工作区正被另一个进程使用，留待下次运行
+)
+
+// 任务状态
+const (
+	StateIdle    = "idle"
+	StateRunning = "running"
+)
+
+// Status 是守护进程写出的状态文件
+type Status struct {
+	PID     int          `json:"pid"`
+	Started time.Time    `json:"started"`
+	Updated time.Time    `json:"updated"`
+	Jobs    []*JobStatus `json:"jobs"`
+}
+
+// JobStatus 是单个任务的状态
+type JobStatus struct {
+	Name          string    `json:"name"`
+	Workspace     string    `json:"workspace"`
+	Schedule      string    `json:"schedule"`
+	State         string    `json:"state"`
+	LastStarted   time.Time `json:"last_started"`
+	LastFinished  time.Time `json:"last_finished"`
+	LastResult    string    `json:"last_result,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastSessionID int       `json:"last_session_id,omitempty"`
+	NextRun       time.Time `json:"next_run"`
+}
+
+// NewStatus 为配置中的任务创建状态，保留状态文件中上次记录的运行结果，使重启后仍按计划运行
+func NewStatus(cfg *Config, now time.Time) *Status {
+	previous := make(map[string]*JobStatus)
+	if data, err := os.ReadFile(cfg.StatusFile); err == nil {
+		var old Status
+		if json.Unmarshal(data, &old) == nil {
+			for _, js := range old.Jobs {
+				previous[js.Name] = js
+			}
+		}
+	}
+
+	status := &Status{PID: os.Getpid(), Started: now}
+	for _, job := range cfg.Jobs {
+		js := &JobStatus{Name: job.Name}
+		if old, ok := previous[job.Name]; ok {
+			*js = *old
+		}
+		js.Workspace = job.Workspace
+		js.Schedule = job.Schedule
+		js.State = StateIdle
+		js.NextRun = job.schedule.Next(js.LastStarted, now)
+		status.Jobs = append(status.Jobs, js)
+	}
+	return status
+}
+
+// Start 记录任务开始运行
+func (s *Status) Start(i int, now time.Time) {
+	js := s.Jobs[i]
+	js.State = StateRunning
+	js.LastStarted = now
+}
+
+// Finish 记录任务的运行结果并计算下一次运行时间
+func (s *Status) Finish(cfg *Config, i int, result string, sessionID int, err error, now time.Time) {
+	js := s.Jobs[i]
+	js.State = StateIdle
+	js.LastFinished = now
+	js.LastResult = result
+	js.LastError = ""
+	if err != nil {
+		js.LastError = err.Error()
+	}
+	if sessionID > 0 {
+		js.LastSessionID = sessionID
+	}
+	js.NextRun = cfg.Jobs[i].schedule.Next(js.LastStarted, now)
+}
+
+// NextRun 返回最早的下一次运行时间
+func (s *Status) NextRun() time.Time {
+	var next time.Time
+	for _, js := range s.Jobs {
+		if next.IsZero() || js.NextRun.Before(next) {
+			next = js.NextRun
+		}
+	}
+	return next
+}
+
+// Save 原子地写出状态文件
+func (s *Status) Save(path string) error {
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化状态失败: %w", err)
+	}
+	if err := util.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("写入状态文件失败: %w", err)
+	}
+	return nil
+}
@@ -1,70 +1,578 @@
 package history
 
 import (
+	"beanckup-cli/internal/catalog"
+	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/signing"
 	"beanckup-cli/internal/types"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
+	"time"
 )
 
-// LoadHistoricalState 遍历 .beanckup 目录，加载所有历史清单，并构建一个历史状态对象。
+// manifestEntry 是 .beanckup 目录中一个清单文件的位置及其所属会话
+type manifestEntry struct {
+	path      string
+	sessionID int
+	episodeID int
+	note      types.SessionNote
+}
+
+// LoadHistoricalState 以目录索引 (catalog) 为基础构建历史状态，目录落后时先从会话快照和清单补齐。
+// PathToNode 只包含目录 (或快照) 中最新的已结束会话的文件；比它更新的 (未完成的) 会话的清单
+// 可能只有部分包，只用于补充 HashToNode 和 Chunks。
+// 目录不可用时退回到逐个读取快照和清单。
 func LoadHistoricalState(beanckupDir string) (*types.HistoricalState, error) {
+	return loadHistoricalState(beanckupDir, false)
+}
+
+// LoadHistoricalStateReadOnly 与 LoadHistoricalState 相同，但以只读方式使用目录索引 (见 OpenCatalogReadOnly)，
+// 供不持有工作区锁的查询使用。
+func LoadHistoricalStateReadOnly(beanckupDir string) (*types.HistoricalState, error) {
+	return loadHistoricalState(beanckupDir, true)
+}
+
+func loadHistoricalState(beanckupDir string, readOnly bool) (*types.HistoricalState, error) {
 	// 修复：初始化 HistoricalState 以匹配 types.go 中的新结构
 	state := &types.HistoricalState{
 		HashToNode:   make(map[string]*types.FileNode),
 		PathToNode:   make(map[string]*types.FileNode),
 		MaxSessionID: 0,
+		Chunks:       make(map[string]types.Chunk),
 	}
 
-	entries, err := os.ReadDir(beanckupDir)
+	entries, err := listManifests(beanckupDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return state, nil
 		}
 		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
 	}
+	for _, e := range entries {
+		if e.sessionID > state.MaxSessionID {
+			state.MaxSessionID = e.sessionID
+		}
+	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
+	baseSessionID, err := loadFromCatalog(state, beanckupDir, entries, readOnly)
+	if err != nil {
+		log.Printf("警告: 目录索引不可用，将从会话快照和清单加载历史状态: %v", err)
+		state.HashToNode = make(map[string]*types.FileNode)
+		state.PathToNode = make(map[string]*types.FileNode)
+		state.Tombstones = nil
+		state.Chunks = make(map[string]types.Chunk)
+		if baseSessionID, err = loadFromSnapshot(state, beanckupDir); err != nil {
+			log.Printf("警告: 无法加载会话快照，将从清单重建历史状态: %v", err)
+			baseSessionID = 0
+		}
+	}
 
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), "Delivery_Status_") || strings.HasPrefix(entry.Name(), "config") {
+	// 没有目录和快照时，以最新的带有 E1 清单的会话为准 (E1 清单记录了未变化的文件和删除记录)
+	pathSessionID := 0
+	if baseSessionID == 0 {
+		for _, e := range entries {
+			if e.episodeID == 1 {
+				pathSessionID = e.sessionID
+			}
+		}
+	}
+	for _, e := range entries {
+		// 目录或快照已包含它及之前会话的全部内容
+		if e.sessionID <= baseSessionID {
 			continue
 		}
+		if err := loadManifestInto(state, e, e.sessionID == pathSessionID); err != nil {
+			log.Printf("警告: 无法加载清单文件 %s: %v", e.path, err)
+		}
+	}
 
-		manifestPath := filepath.Join(beanckupDir, entry.Name())
-		data, err := os.ReadFile(manifestPath)
+	return state, nil
+}
+
+// loadFromCatalog 同步目录索引并从中载入已结束会话的状态，返回目录收录的最后会话
+func loadFromCatalog(state *types.HistoricalState, beanckupDir string, entries []manifestEntry, readOnly bool) (int, error) {
+	var cat *catalog.Catalog
+	var err error
+	if readOnly {
+		cat, err = openCatalogReadOnly(beanckupDir, entries)
+	} else {
+		cat, err = openCatalog(beanckupDir, entries)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	last := cat.LastSession()
+	if last > state.MaxSessionID {
+		state.MaxSessionID = last
+	}
+	err = cat.ForEach(func(e *catalog.Entry) error {
+		if e.Deleted {
+			state.Tombstones = append(state.Tombstones, &types.Tombstone{
+				Path:      e.Node.Path,
+				Size:      e.Node.Size,
+				Hash:      e.Node.Hash,
+				Reference: e.Node.Reference,
+				SessionID: e.From,
+				Chunks:    e.Node.Chunks,
+			})
+		} else if e.Until == 0 {
+			state.PathToNode[e.Node.Path] = e.Node
+		}
+		addContent(state, e.Node)
+		return nil
+	})
+	if err != nil {
+		if readOnly {
+			return 0, err
+		}
+		// 目录已不可信，清空后下次加载时重建
+		if resetErr := cat.Reset(); resetErr == nil {
+			signing.Default().SignFile(cat.MetaPath())
+		}
+		return 0, err
+	}
+	return last, nil
+}
+
+// loadFromSnapshot 从最新的会话快照载入状态，返回快照的会话号 (没有快照时为 0)
+func loadFromSnapshot(state *types.HistoricalState, beanckupDir string) (int, error) {
+	snapshot, err := LoadLatestSnapshot(beanckupDir)
+	if err != nil || snapshot == nil {
+		return 0, err
+	}
+	if snapshot.SessionID > state.MaxSessionID {
+		state.MaxSessionID = snapshot.SessionID
+	}
+	for _, node := range snapshot.Files {
+		state.PathToNode[node.GetPath()] = node
+		addContent(state, node)
+	}
+	for _, t := range snapshot.Tombstones {
+		state.Tombstones = append(state.Tombstones, t)
+		addContent(state, tombstoneNode(t))
+	}
+	return snapshot.SessionID, nil
+}
+
+// OpenCatalog 打开目录索引并更新到最新的已结束会话。
+// 元数据文件的签名验证失败时目录会被清空，并从经过验证的快照和清单重建。
+func OpenCatalog(beanckupDir string) (*catalog.Catalog, error) {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	return openCatalog(beanckupDir, entries)
+}
+
+func openCatalog(beanckupDir string, entries []manifestEntry) (*catalog.Catalog, error) {
+	cat, err := catalog.Open(beanckupDir)
+	if err != nil {
+		return nil, err
+	}
+	policy := signing.Default()
+	if cat.LastSession() > 0 {
+		if err := checkCatalog(cat); err != nil {
+			log.Printf("警告: 目录索引验证失败，将重建目录: %v", err)
+			if err := cat.Reset(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	syncErr := syncCatalog(cat, beanckupDir, entries, cat.ApplySession)
+	if errors.Is(syncErr, catalog.ErrDigestMismatch) {
+		log.Printf("警告: %v，将重建目录", syncErr)
+		if syncErr = cat.Reset(); syncErr == nil {
+			syncErr = syncCatalog(cat, beanckupDir, entries, cat.ApplySession)
+		}
+	}
+	if err := policy.SignFile(cat.MetaPath()); err != nil {
+		log.Printf("警告: 无法为目录索引签名: %v", err)
+	}
+	if syncErr != nil {
+		return nil, syncErr
+	}
+	return cat, nil
+}
+
+// OpenCatalogReadOnly 以只读方式打开目录索引，供不持有工作区锁的查询使用 (工作区可能正被备份进程更新)。
+// 目录尚未收录的已结束会话只在内存中收录，不会更新、清空或重新签名目录；目录不可用时返回错误。
+func OpenCatalogReadOnly(beanckupDir string) (*catalog.Catalog, error) {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	return openCatalogReadOnly(beanckupDir, entries)
+}
+
+// 只读打开目录时，正在更新目录的进程可能已替换了记录文件、尚未写入元数据，或已写入元数据、尚未写入其签名。
+// 此时稍后重新打开，超过 catalogRetries 次仍不一致时返回错误。
+const (
+	catalogRetries       = 50
+	catalogRetryInterval = 100 * time.Millisecond
+)
+
+func openCatalogReadOnly(beanckupDir string, entries []manifestEntry) (*catalog.Catalog, error) {
+	var cat *catalog.Catalog
+	var err error
+	for attempt := 1; ; attempt++ {
+		cat, err = catalog.OpenReadOnly(beanckupDir)
+		if err == nil && cat.LastSession() > 0 {
+			if err = checkCatalog(cat); err != nil {
+				err = fmt.Errorf("目录索引验证失败: %w", err)
+			}
+		}
+		if err == nil {
+			break
+		}
+		retry := errors.Is(err, catalog.ErrDigestMismatch) || errors.Is(err, signing.ErrInvalid)
+		if !retry || attempt == catalogRetries {
+			return nil, err
+		}
+		time.Sleep(catalogRetryInterval)
+	}
+	if err := syncCatalog(cat, beanckupDir, entries, cat.Overlay); err != nil {
+		return nil, err
+	}
+	return cat, nil
+}
+
+// checkCatalog 按签名策略验证目录打开时读取的元数据内容
+func checkCatalog(cat *catalog.Catalog) error {
+	sig, err := os.ReadFile(signing.SigPath(cat.MetaPath()))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("无法读取签名文件: %w", err)
+	}
+	return signing.Default().Check(filepath.Base(cat.MetaPath()), cat.RawMeta(), sig)
+}
+
+// SyncCatalog 将目录索引更新到最新的已结束会话
+func SyncCatalog(beanckupDir string) error {
+	_, err := OpenCatalog(beanckupDir)
+	return err
+}
+
+// RebuildCatalog 清空目录索引并从会话快照和清单重新构建
+func RebuildCatalog(beanckupDir string) error {
+	cat, err := catalog.Open(beanckupDir)
+	if err != nil {
+		return err
+	}
+	if err := cat.Reset(); err != nil {
+		return err
+	}
+	_, err = OpenCatalog(beanckupDir)
+	return err
+}
+
+// syncCatalog 依次收录目录中尚未包含的已结束会话: 有快照的会话以快照为准；
+// 没有快照、但已有更新会话的 (被放弃的) 会话以其清单的并集为准，缺少 E1 清单时叠加在上一个会话的状态之上；
+// 最新的未完成会话不收录。每个会话的状态交给 apply 收录 (写入目录或只在内存中收录)。
+func syncCatalog(cat *catalog.Catalog, beanckupDir string, entries []manifestEntry, apply func(*types.Manifest) error) error {
+	snapshots, err := snapshotSessions(beanckupDir)
+	if err != nil {
+		return fmt.Errorf("无法读取会话快照目录: %w", err)
+	}
+	hasSnapshot := make(map[int]bool)
+	sessions := make(map[int]bool)
+	maxSessionID := 0
+	for _, id := range snapshots {
+		hasSnapshot[id] = true
+		sessions[id] = true
+	}
+	for _, e := range entries {
+		sessions[e.sessionID] = true
+		if e.sessionID > maxSessionID {
+			maxSessionID = e.sessionID
+		}
+	}
+	var pending []int
+	for id := range sessions {
+		if id > cat.LastSession() && (hasSnapshot[id] || id < maxSessionID) {
+			pending = append(pending, id)
+		}
+	}
+	sort.Ints(pending)
+
+	for _, id := range pending {
+		var m *types.Manifest
+		if hasSnapshot[id] {
+			if m, err = loadSnapshot(beanckupDir, id); err != nil {
+				log.Printf("警告: 无法使用会话 S%d 的快照，将合并其清单: %v", id, err)
+			}
+		}
+		if m == nil {
+			m, err = sessionState(entries, id)
+			// 缺少 E1 清单的会话只交付了部分新文件，以目录中上一个会话的状态为基础叠加这些文件
+			if err == nil && !hasEpisode(entries, id, 1) {
+				err = overlayCatalog(cat, m)
+			}
+		}
 		if err != nil {
-			log.Printf("警告: 无法读取清单文件 %s: %v", manifestPath, err)
+			return fmt.Errorf("无法读取会话 S%d: %w", id, err)
+		}
+		if err := apply(m); err != nil {
+			return fmt.Errorf("收录会话 S%d 失败: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// sessionState 合并一个会话的全部清单，得到该会话结束时的文件列表及其删除记录
+func sessionState(entries []manifestEntry, sessionID int) (*types.Manifest, error) {
+	var state *types.Manifest
+	filesByPath := make(map[string]*types.FileNode)
+	for _, e := range entries {
+		if e.sessionID != sessionID {
 			continue
 		}
+		m, err := loadManifest(e.path)
+		if err != nil {
+			return nil, fmt.Errorf("无法加载清单文件 %s: %w", e.path, err)
+		}
+		if state == nil {
+			state = &types.Manifest{
+				FormatVersion: manifest.FormatVersion,
+				WorkspaceName: m.WorkspaceName,
+				SessionID:     sessionID,
+				Timestamp:     m.Timestamp,
+				Roots:         m.Roots,
+				SessionNote:   m.SessionNote,
+			}
+		}
+		state.Tombstones = append(state.Tombstones, m.Tombstones...)
+		for _, node := range m.Files {
+			filesByPath[node.GetPath()] = node
+		}
+	}
+	if state == nil {
+		return nil, fmt.Errorf("会话 S%d 没有任何清单", sessionID)
+	}
+	paths := make([]string, 0, len(filesByPath))
+	for path := range filesByPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	state.Files = make([]*types.FileNode, 0, len(paths))
+	for _, path := range paths {
+		state.Files = append(state.Files, filesByPath[path])
+	}
+	return state, nil
+}
+
+// hasEpisode 判断会话的指定包是否有清单
+func hasEpisode(entries []manifestEntry, sessionID, episodeID int) bool {
+	for _, e := range entries {
+		if e.sessionID == sessionID && e.episodeID == episodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// overlayCatalog 将 m 的文件列表补全为目录中最后会话仍存在的文件加上 m 中的文件
+func overlayCatalog(cat *catalog.Catalog, m *types.Manifest) error {
+	var base []*types.FileNode
+	err := cat.ForEach(func(e *catalog.Entry) error {
+		if !e.Deleted && e.Until == 0 {
+			base = append(base, e.Node)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	overlayFiles(m, base)
+	return nil
+}
+
+// overlayFiles 将 m 的文件列表补全为 base 中的文件加上 m 中的文件 (同一路径以 m 为准)，按路径排序
+func overlayFiles(m *types.Manifest, base []*types.FileNode) {
+	filesByPath := make(map[string]*types.FileNode, len(base)+len(m.Files))
+	for _, node := range base {
+		filesByPath[node.GetPath()] = node
+	}
+	for _, node := range m.Files {
+		filesByPath[node.GetPath()] = node
+	}
+	paths := make([]string, 0, len(filesByPath))
+	for path := range filesByPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	m.Files = make([]*types.FileNode, 0, len(paths))
+	for _, path := range paths {
+		m.Files = append(m.Files, filesByPath[path])
+	}
+}
+
+// ManifestPaths 返回 .beanckup 目录中会话号不大于 maxSessionID、且通过签名验证的全部清单文件
+func ManifestPaths(beanckupDir string, maxSessionID int) ([]string, error) {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.sessionID <= maxSessionID {
+			paths = append(paths, e.path)
+		}
+	}
+	return paths, nil
+}
+
+// SessionNotes 返回元数据目录中各会话的标签、备注和标记，键为会话号。
+// 同一会话的每份清单记录的内容相同，取其中的第一份。
+func SessionNotes(beanckupDir string) (map[int]types.SessionNote, error) {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	notes := make(map[int]types.SessionNote)
+	for _, e := range entries {
+		if _, ok := notes[e.sessionID]; !ok {
+			notes[e.sessionID] = e.note
+		}
+	}
+	return notes, nil
+}
+
+// listManifests 读取 .beanckup 目录中所有清单的会话号，按会话和包的顺序返回
+func listManifests(beanckupDir string) ([]manifestEntry, error) {
+	dirEntries, err := os.ReadDir(beanckupDir)
+	if err != nil {
+		return nil, err
+	}
 
-		var manifest types.Manifest
-		if err := json.Unmarshal(data, &manifest); err != nil {
-			log.Printf("警告: 无法解析清单文件 %s: %v", manifestPath, err)
+	var entries []manifestEntry
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !manifest.IsManifestFile(entry.Name()) {
+			continue
+		}
+		manifestPath := filepath.Join(beanckupDir, entry.Name())
+		r, err := openManifest(manifestPath)
+		if err != nil {
+			if signing.IsVerificationError(err) {
+				log.Printf("警告: 已忽略未通过签名验证的清单: %v", err)
+			} else {
+				log.Printf("警告: 无法加载清单文件 %s: %v", manifestPath, err)
+			}
 			continue
 		}
+		header := r.Header()
+		entries = append(entries, manifestEntry{path: manifestPath, sessionID: header.SessionID, episodeID: header.EpisodeID, note: header.SessionNote})
+		r.Close()
+	}
 
-		if manifest.SessionID > state.MaxSessionID {
-			state.MaxSessionID = manifest.SessionID
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].sessionID != entries[j].sessionID {
+			return entries[i].sessionID < entries[j].sessionID
 		}
+		return entries[i].episodeID < entries[j].episodeID
+	})
+	return entries, nil
+}
+
+// openManifest 读取并验证清单文件，返回解析这份经过验证的内容的读取器
+func openManifest(path string) (*manifest.Reader, error) {
+	data, err := signing.Default().ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.NewReader(bytes.NewReader(data))
+}
+
+// loadManifest 读取、验证并解析清单文件 (或会话快照)
+func loadManifest(path string) (*types.Manifest, error) {
+	data, err := signing.Default().ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.ParseManifest(data)
+}
+
+// loadManifestInto 逐条读取清单中的文件记录并合并到历史状态中，不在内存中保留整份清单。
+// withPaths 为 true 时同时将文件记入 PathToNode。
+func loadManifestInto(state *types.HistoricalState, e manifestEntry, withPaths bool) error {
+	r, err := openManifest(e.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-		for _, node := range manifest.Files {
+	for {
+		node, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if withPaths {
 			state.PathToNode[node.GetPath()] = node
+		}
+		addContent(state, node)
+	}
+	for _, t := range r.Tombstones() {
+		state.Tombstones = append(state.Tombstones, t)
+		addContent(state, tombstoneNode(t))
+	}
+	return nil
+}
 
-			// 修复：更新 Hash -> Node 映射
-			if node.Hash != "" {
-				if _, exists := state.HashToNode[node.Hash]; !exists {
-					state.HashToNode[node.Hash] = node
-				}
-			}
+// addContent 记录可从交付包中取得的内容，同一内容以最早出现的位置为准
+func addContent(state *types.HistoricalState, node *types.FileNode) {
+	// 修复：更新 Hash -> Node 映射
+	if node.Hash != "" && node.Reference != "" {
+		if _, exists := state.HashToNode[node.Hash]; !exists {
+			state.HashToNode[node.Hash] = node
+		}
+	}
+	for _, c := range node.Chunks {
+		if _, exists := state.Chunks[c.Hash]; !exists && c.Reference != "" {
+			state.Chunks[c.Hash] = c
 		}
 	}
+}
 
-	return state, nil
+// tombstoneNode 将删除记录转换为文件节点，使已删除文件的内容在重新出现时仍可引用原来的包
+func tombstoneNode(t *types.Tombstone) *types.FileNode {
+	return &types.FileNode{Path: t.Path, Size: t.Size, Hash: t.Hash, Reference: t.Reference, Chunks: t.Chunks}
+}
+
+// FindDeletions 找出历史状态中存在、但本次扫描中已找不到该路径的文件。
+// 被移动或改名的文件的原路径、以及多个副本中被删除的一个同样记为删除，新路径由扫描结果记录。
+func FindDeletions(state *types.HistoricalState, allNodes []*types.FileNode, sessionID int) []*types.Tombstone {
+	if state == nil {
+		return nil
+	}
+	currentPaths := make(map[string]bool, len(allNodes))
+	for _, node := range allNodes {
+		if !node.IsDirectory() {
+			currentPaths[node.Path] = true
+		}
+	}
+
+	var tombstones []*types.Tombstone
+	for path, node := range state.PathToNode {
+		if node.IsDirectory() || currentPaths[path] {
+			continue
+		}
+		tombstones = append(tombstones, &types.Tombstone{
+			Path:      path,
+			Size:      node.Size,
+			Hash:      node.Hash,
+			Reference: node.Reference,
+			SessionID: sessionID,
+			Chunks:    node.Chunks,
+		})
+	}
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].Path < tombstones[j].Path })
+	return tombstones
 }
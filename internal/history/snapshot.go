@@ -0,0 +1,156 @@
+package history
+
+import (
+	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/signing"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotDir 返回会话快照所在的目录。
+// 每个完成的会话写入一份快照，记录该会话结束时工作区的完整文件列表以及截至该会话的全部删除记录。
+func SnapshotDir(beanckupDir string) string {
+	return filepath.Join(beanckupDir, "snapshots")
+}
+
+func snapshotPath(beanckupDir string, sessionID int) string {
+	return filepath.Join(SnapshotDir(beanckupDir), fmt.Sprintf("S%04d%s", sessionID, manifest.CompactExt))
+}
+
+// snapshotSessions 返回已有快照的会话号 (升序)
+func snapshotSessions(beanckupDir string) ([]int, error) {
+	entries, err := os.ReadDir(SnapshotDir(beanckupDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []int
+	for _, entry := range entries {
+		var sessionID int
+		if _, err := fmt.Sscanf(entry.Name(), "S%d", &sessionID); err == nil && sessionID > 0 &&
+			entry.Name() == filepath.Base(snapshotPath(beanckupDir, sessionID)) {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	sort.Ints(sessions)
+	return sessions, nil
+}
+
+// LoadLatestSnapshot 加载会话号最大的快照，没有快照时返回 nil
+func LoadLatestSnapshot(beanckupDir string) (*types.Manifest, error) {
+	sessions, err := snapshotSessions(beanckupDir)
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	return loadSnapshot(beanckupDir, sessions[len(sessions)-1])
+}
+
+// loadSnapshot 验证签名后加载指定会话的快照
+func loadSnapshot(beanckupDir string, sessionID int) (*types.Manifest, error) {
+	return loadManifest(snapshotPath(beanckupDir, sessionID))
+}
+
+// SaveSnapshot 在会话完成后写入其快照: 文件列表为该会话所有清单的并集，缺少 E1 清单 (只交付了部分包) 时
+// 叠加在上一份快照的文件之上；删除记录为上一份快照的删除记录加上之后各会话 E1 清单中的删除记录。
+func SaveSnapshot(beanckupDir string, sessionID int) error {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	snapshot, err := sessionState(entries, sessionID)
+	if err != nil {
+		return err
+	}
+
+	baseSessionID := 0
+	previous, err := LoadLatestSnapshot(beanckupDir)
+	if err != nil {
+		return fmt.Errorf("无法加载上一份会话快照: %w", err)
+	}
+	tombstones := snapshot.Tombstones
+	snapshot.Tombstones = nil
+	if previous != nil && previous.SessionID < sessionID {
+		baseSessionID = previous.SessionID
+		snapshot.Tombstones = append(snapshot.Tombstones, previous.Tombstones...)
+		// 缺少 E1 清单的会话只记录了已交付的包中的新文件，未变化的文件以上一份快照为准
+		if !hasEpisode(entries, sessionID, 1) {
+			overlayFiles(snapshot, previous.Files)
+		}
+	}
+	// 两份快照之间被放弃的会话也可能记录了删除
+	for _, e := range entries {
+		if e.sessionID <= baseSessionID || e.sessionID >= sessionID {
+			continue
+		}
+		r, err := openManifest(e.path)
+		if err != nil {
+			return fmt.Errorf("无法加载清单文件 %s: %w", e.path, err)
+		}
+		for {
+			if _, err = r.Next(); err != nil {
+				break
+			}
+		}
+		r.Close()
+		if err != io.EOF {
+			return fmt.Errorf("无法加载清单文件 %s: %w", e.path, err)
+		}
+		snapshot.Tombstones = append(snapshot.Tombstones, r.Tombstones()...)
+	}
+	snapshot.Tombstones = append(snapshot.Tombstones, tombstones...)
+
+	if err := os.MkdirAll(SnapshotDir(beanckupDir), 0755); err != nil {
+		return fmt.Errorf("无法创建快照目录: %w", err)
+	}
+	finalPath := snapshotPath(beanckupDir, sessionID)
+	err = util.WriteAtomic(finalPath, func(w io.Writer) error {
+		return manifest.WriteCompact(snapshot, w)
+	})
+	if err != nil {
+		return fmt.Errorf("无法保存会话快照: %w", err)
+	}
+	return signing.Default().SignFile(finalPath)
+}
+
+// RebuildSnapshots 为最新快照之后的每个会话按顺序补写快照，用于从交付目录重建历史记录后。
+// 交付目录中找到的会话都按已结束处理：未交付的包中的文件不在快照中，下次扫描时会重新打包。
+func RebuildSnapshots(beanckupDir string) error {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	existing, err := snapshotSessions(beanckupDir)
+	if err != nil {
+		return err
+	}
+	last := 0
+	if len(existing) > 0 {
+		last = existing[len(existing)-1]
+	}
+	for _, e := range entries {
+		if e.sessionID <= last {
+			continue
+		}
+		if err := SaveSnapshot(beanckupDir, e.sessionID); err != nil {
+			return fmt.Errorf("无法为会话 S%d 写入快照: %w", e.sessionID, err)
+		}
+		last = e.sessionID
+	}
+	return nil
+}
+
+// DeletionsBySession 返回截至最新会话的全部删除记录，按会话号分组
+func DeletionsBySession(state *types.HistoricalState) map[int][]*types.Tombstone {
+	result := make(map[int][]*types.Tombstone)
+	for _, t := range state.Tombstones {
+		result[t.SessionID] = append(result[t.SessionID], t)
+	}
+	return result
+}
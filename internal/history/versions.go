@@ -0,0 +1,94 @@
+package history
+
+import (
+	"beanckup-cli/internal/catalog"
+	"beanckup-cli/internal/types"
+	"fmt"
+	"sort"
+)
+
+// Version 是某个路径的一个版本: 在 [From, Until) 会话区间内以同一内容存在于工作区中，
+// Until 为 0 表示至今仍存在。Deleted 为 true 时表示该路径在 From 会话中被删除。
+type Version struct {
+	From      int
+	Until     int
+	Timestamp string // From 会话的时间
+	Deleted   bool
+	Node      *types.FileNode
+}
+
+// PathVersions 返回路径在全部会话中的各个版本，按会话顺序排列。
+// 已结束的会话从目录索引查询，尚未结束的最新会话再从其清单中补充。
+// readOnly 为 true 时以只读方式使用目录索引 (见 OpenCatalogReadOnly)。
+func PathVersions(beanckupDir, path string, readOnly bool) ([]*Version, error) {
+	entries, err := listManifests(beanckupDir)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取 .beanckup 目录: %w", err)
+	}
+	var cat *catalog.Catalog
+	if readOnly {
+		cat, err = openCatalogReadOnly(beanckupDir, entries)
+	} else {
+		cat, err = openCatalog(beanckupDir, entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	records, err := cat.LookupPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*Version
+	for _, e := range records {
+		v := &Version{From: e.From, Until: e.Until, Deleted: e.Deleted, Node: e.Node}
+		if info, ok := cat.Session(e.From); ok {
+			v.Timestamp = info.Timestamp
+		}
+		versions = append(versions, v)
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].From < versions[j].From })
+
+	var openSessions []int
+	for _, e := range entries {
+		if e.sessionID > cat.LastSession() && (len(openSessions) == 0 || openSessions[len(openSessions)-1] != e.sessionID) {
+			openSessions = append(openSessions, e.sessionID)
+		}
+	}
+	for _, sessionID := range openSessions {
+		state, err := sessionState(entries, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		var current *Version
+		if n := len(versions); n > 0 && versions[n-1].Until == 0 && !versions[n-1].Deleted {
+			current = versions[n-1]
+		}
+		var node *types.FileNode
+		for _, f := range state.Files {
+			if f.GetPath() == path {
+				node = f
+				break
+			}
+		}
+		switch {
+		case node != nil:
+			if current != nil && current.Node.Hash == node.Hash && current.Node.Reference == node.Reference {
+				continue
+			}
+			if current != nil {
+				current.Until = sessionID
+			}
+			versions = append(versions, &Version{From: sessionID, Timestamp: state.Timestamp, Node: node})
+		case current != nil:
+			for _, t := range state.Tombstones {
+				if t.Path == path {
+					current.Until = sessionID
+					versions = append(versions, &Version{From: sessionID, Timestamp: state.Timestamp, Deleted: true, Node: tombstoneNode(t)})
+					break
+				}
+			}
+		}
+	}
+	return versions, nil
+}
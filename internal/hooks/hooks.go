@@ -0,0 +1,104 @@
+package hooks
+
+import (
+	"beanckup-cli/internal/types"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Stage 表示钩子命令的执行阶段
+type Stage string
+
+const (
+	StagePreScan     Stage = "pre_scan"
+	StagePreEpisode  Stage = "pre_episode"
+	StagePostEpisode Stage = "post_episode"
+	StagePostSession Stage = "post_session"
+)
+
+// Env 描述传递给钩子命令的上下文，会以 BEANCKUP_* 环境变量的形式提供
+type Env struct {
+	WorkspacePath string // 单目录工作区的路径，多源目录备份集为空
+	WorkspaceName string
+	MetadataDir   string
+	SessionID     int
+	EpisodeID     int
+	PackagePath   string   // 包的路径，分卷时为第一个分卷
+	PackageFiles  []string // 包的全部物理文件 (分卷时为各分卷)
+	EpisodeStatus types.EpisodeStatus
+	Result        string // 例如 "success"、"failure"、"completed"、"paused"
+}
+
+// Run 执行指定阶段配置的钩子命令。未配置命令时直接返回 nil。
+// 命令的退出码非零时返回错误，调用方据此决定是否中止交付。
+func Run(cfg types.HookConfig, stage Stage, env Env) error {
+	command := commandFor(cfg, stage)
+	if command == "" {
+		return nil
+	}
+
+	log.Printf("[信息] 执行 %s 钩子: %s", stage, command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = nil
+	cmd.Env = append(os.Environ(), env.variables(stage)...)
+	if env.WorkspacePath != "" {
+		cmd.Dir = env.WorkspacePath
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s 钩子执行失败: %w", stage, err)
+	}
+	return nil
+}
+
+func commandFor(cfg types.HookConfig, stage Stage) string {
+	switch stage {
+	case StagePreScan:
+		return cfg.PreScan
+	case StagePreEpisode:
+		return cfg.PreEpisode
+	case StagePostEpisode:
+		return cfg.PostEpisode
+	case StagePostSession:
+		return cfg.PostSession
+	}
+	return ""
+}
+
+func (e Env) variables(stage Stage) []string {
+	vars := []string{
+		"BEANCKUP_HOOK=" + string(stage),
+		"BEANCKUP_WORKSPACE=" + e.WorkspacePath,
+		"BEANCKUP_WORKSPACE_NAME=" + e.WorkspaceName,
+		"BEANCKUP_METADATA_DIR=" + e.MetadataDir,
+		"BEANCKUP_SESSION_ID=" + strconv.Itoa(e.SessionID),
+	}
+	if e.EpisodeID > 0 {
+		vars = append(vars, "BEANCKUP_EPISODE_ID="+strconv.Itoa(e.EpisodeID))
+	}
+	if e.PackagePath != "" {
+		vars = append(vars, "BEANCKUP_PACKAGE_PATH="+e.PackagePath)
+	}
+	if len(e.PackageFiles) > 0 {
+		vars = append(vars, "BEANCKUP_PACKAGE_FILES="+strings.Join(e.PackageFiles, "\n"))
+	}
+	if e.EpisodeStatus != "" {
+		vars = append(vars, "BEANCKUP_EPISODE_STATUS="+string(e.EpisodeStatus))
+	}
+	if e.Result != "" {
+		vars = append(vars, "BEANCKUP_RESULT="+e.Result)
+	}
+	return vars
+}
@@ -3,6 +3,7 @@ package indexer
 import (
 	"beanckup-cli/internal/types"
 	"beanckup-cli/internal/util"
+	"beanckup-cli/internal/watcher"
 	"fmt"
 	"log"
 	"os"
@@ -15,7 +16,8 @@ import (
 
 // Indexer 负责扫描工作区并根据历史记录对文件进行分类。
 type Indexer struct {
-	history *types.HistoricalState
+	history    *types.HistoricalState
+	journalDir string // 非空时尝试使用该 .beanckup 目录中的变更日志进行增量扫描
 }
 
 // Job 包含一个要处理的文件路径及其文件信息
@@ -35,21 +37,51 @@ func NewIndexer(history *types.HistoricalState) *Indexer {
 	return &Indexer{history: history}
 }
 
-// ScanWithProgress 使用生产者-消费者模型并行扫描文件，以提高I/O和CPU效率。
-func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func(string)) ([]*types.FileNode, error) {
+// 【核心修正】: 根目录扫描时，定义系统排除项
+var systemExclusions = map[string]bool{
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"pagefile.sys":              true,
+	"swapfile.sys":              true,
+	"hiberfil.sys":              true,
+	"dumpstack.log.tmp":         true,
+}
+
+// EnableJournal 允许 ScanWithProgress 在监视器的变更日志可用时，只重新检查自上次会话以来发生变化的路径。
+func (idx *Indexer) EnableJournal(beanckupDir string) {
+	idx.journalDir = beanckupDir
+}
+
+// ScanWithProgress 扫描备份集中的所有源目录，返回的节点路径带有源目录命名空间。
+// 若启用了变更日志且日志完整覆盖了上次会话以来的时间，则只重新检查变化的路径。
+func (idx *Indexer) ScanWithProgress(set *types.BackupSet, progressCallback func(string)) ([]*types.FileNode, error) {
+	if idx.journalDir != "" && len(idx.history.PathToNode) > 0 {
+		changes, err := watcher.ChangesSince(idx.journalDir, idx.history.MaxSessionID)
+		if err == nil {
+			log.Printf("[信息] 根据变更日志增量扫描，共 %d 个变化的路径", len(changes))
+			return idx.scanChanges(set, changes, progressCallback), nil
+		}
+		log.Printf("[信息] 变更日志不可用 (%v)，将完整扫描工作区", err)
+	}
+
+	var allNodes []*types.FileNode
+	for i := range set.Roots {
+		nodes, err := idx.scanRoot(set, &set.Roots[i], progressCallback)
+		if err != nil {
+			return nil, err
+		}
+		allNodes = append(allNodes, nodes...)
+	}
+	return allNodes, nil
+}
+
+// scanRoot 使用生产者-消费者模型并行扫描单个源目录，以提高I/O和CPU效率。
+func (idx *Indexer) scanRoot(set *types.BackupSet, root *types.SourceRoot, progressCallback func(string)) ([]*types.FileNode, error) {
+	workspacePath := root.Path
 	var allNodes []*types.FileNode
 	var filesToScan []string
 
-	// 【核心修正】: 根目录扫描时，定义系统排除项
 	isRootScan := util.IsRoot(workspacePath)
-	systemExclusions := map[string]bool{
-		"$recycle.bin":              true,
-		"system volume information": true,
-		"pagefile.sys":              true,
-		"swapfile.sys":              true,
-		"hiberfil.sys":              true,
-		"dumpstack.log.tmp":         true,
-	}
 
 	// 1. 生产者准备：预扫描以获取文件总数，用于进度条
 	filepath.Walk(workspacePath, func(path string, info os.FileInfo, err error) error {
@@ -73,7 +105,7 @@ func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func
 				return nil
 			}
 			filesToScan = append(filesToScan, path)
-		} else if info.IsDir() && info.Name() == ".beanckup" {
+		} else if info.IsDir() && (info.Name() == ".beanckup" || path == set.MetadataDir) {
 			return filepath.SkipDir
 		}
 		return nil
@@ -104,9 +136,9 @@ func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func
 					results <- Result{Err: fmt.Errorf("无法获取相对路径: %w", err)}
 					continue
 				}
-				relPath = filepath.ToSlash(relPath)
+				relPath = set.NodePath(root, relPath)
 
-				node := idx.classifyFile(workspacePath, relPath, job.Info)
+				node := idx.classifyFile(job.Path, relPath, job.Info)
 				results <- Result{Node: node}
 
 				// 在worker中安全地更新进度
@@ -141,7 +173,7 @@ func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func
 			}
 		}
 
-		if info.IsDir() && info.Name() == ".beanckup" {
+		if info.IsDir() && (info.Name() == ".beanckup" || path == set.MetadataDir) {
 			return filepath.SkipDir
 		}
 
@@ -152,7 +184,7 @@ func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func
 		if info.IsDir() {
 			// 目录节点直接在主协程处理，因为它们不涉及耗时操作
 			relPath, _ := filepath.Rel(workspacePath, path)
-			relPath = filepath.ToSlash(relPath)
+			relPath = set.NodePath(root, relPath)
 			allNodes = append(allNodes, &types.FileNode{Dir: relPath, ModTime: info.ModTime().UTC()})
 		} else {
 			// 文件任务放入通道，交由worker处理
@@ -192,10 +224,83 @@ func (idx *Indexer) ScanWithProgress(workspacePath string, progressCallback func
 	return allNodes, nil
 }
 
-// classifyFile 函数的逻辑保持不变，它现在被 worker 并发调用
-func (idx *Indexer) classifyFile(workspaceRoot, relPath string, info os.FileInfo) *types.FileNode {
-	fullPath := filepath.Join(workspaceRoot, relPath)
+// scanChanges 以最新会话结束时的文件列表为基础，只重新检查变更日志中记录的路径。
+// 变化的目录会被整体遍历，已不存在的路径即视为删除。
+func (idx *Indexer) scanChanges(set *types.BackupSet, changes []string, progressCallback func(string)) []*types.FileNode {
+	changed := make(map[string]bool, len(changes))
+	for _, path := range changes {
+		changed[path] = true
+	}
+	// ancestorChanged 判断 path 的某个上级目录是否也在变化列表中
+	ancestorChanged := func(path string) bool {
+		for i := strings.LastIndex(path, "/"); i > 0; i = strings.LastIndex(path, "/") {
+			path = path[:i]
+			if changed[path] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var allNodes []*types.FileNode
+	for path, node := range idx.history.PathToNode {
+		if node.IsDirectory() || changed[path] || ancestorChanged(path) {
+			continue
+		}
+		unchanged := *node
+		allNodes = append(allNodes, &unchanged)
+	}
 
+	addFile := func(fullPath, nodePath string, info os.FileInfo) {
+		if strings.EqualFold(info.Name(), "Thumbs.db") {
+			return
+		}
+		allNodes = append(allNodes, idx.classifyFile(fullPath, nodePath, info))
+	}
+	for i, nodePath := range changes {
+		progressCallback(fmt.Sprintf("增量扫描进度: %d/%d 路径 - %s", i+1, len(changes), nodePath))
+		if ancestorChanged(nodePath) {
+			continue // 已由上级目录的遍历覆盖
+		}
+		root, relPath, ok := set.SplitPath(nodePath)
+		if !ok {
+			continue
+		}
+		if top, _, _ := strings.Cut(relPath, "/"); util.IsRoot(root.Path) && systemExclusions[strings.ToLower(top)] {
+			continue
+		}
+		fullPath := filepath.Join(root.Path, filepath.FromSlash(relPath))
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			continue // 路径已被删除
+		}
+		if !info.IsDir() {
+			addFile(fullPath, nodePath, info)
+			continue
+		}
+		filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				if info.Name() == ".beanckup" || path == set.MetadataDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root.Path, path)
+			if err != nil {
+				return nil
+			}
+			addFile(path, set.NodePath(root, rel), info)
+			return nil
+		})
+	}
+	return allNodes
+}
+
+// classifyFile 函数的逻辑保持不变，它现在被 worker 并发调用
+func (idx *Indexer) classifyFile(fullPath, relPath string, info os.FileInfo) *types.FileNode {
 	node := &types.FileNode{Path: relPath, Size: info.Size(), ModTime: info.ModTime().UTC()}
 	cTime, err := util.GetCreationTime(fullPath)
 	if err == nil {
@@ -208,6 +313,8 @@ func (idx *Indexer) classifyFile(workspaceRoot, relPath string, info os.FileInfo
 		lastState.ModTime.Equal(node.ModTime) && lastState.CreateTime.Equal(node.CreateTime) {
 		node.Hash = lastState.Hash
 		node.Reference = lastState.Reference
+		node.Compression = lastState.Compression
+		node.Chunks = lastState.Chunks
 		return node
 	}
 
@@ -223,9 +330,49 @@ func (idx *Indexer) classifyFile(workspaceRoot, relPath string, info os.FileInfo
 	// 哈希比对
 	if originalNode, ok := idx.history.HashToNode[hash]; ok {
 		node.Reference = originalNode.Reference
+		node.Compression = originalNode.Compression
+		node.Chunks = originalNode.Chunks
 	} else {
 		node.Reference = ""
 	}
 
 	return node
 }
+
+// FindChangedFiles 重新检查文件的大小和修改时间，返回自扫描以来已被修改、仍在写入或已被删除的文件。
+func FindChangedFiles(set *types.BackupSet, nodes []*types.FileNode) []*types.FileNode {
+	var changed []*types.FileNode
+	for _, node := range nodes {
+		if node.IsDirectory() {
+			continue
+		}
+		info, err := os.Stat(set.AbsPath(node.Path))
+		if err != nil || info.Size() != node.Size || !info.ModTime().UTC().Equal(node.ModTime) {
+			changed = append(changed, node)
+		}
+	}
+	return changed
+}
+
+// RefreshNode 以文件当前的状态重新填充节点 (大小、时间戳和哈希)，并清空其引用和块列表，使其作为新文件 (按整个文件) 重新交付。
+func RefreshNode(set *types.BackupSet, node *types.FileNode) error {
+	fullPath := set.AbsPath(node.Path)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	hash, err := util.CalculateSHA256(fullPath)
+	if err != nil {
+		return err
+	}
+	node.Size = info.Size()
+	node.ModTime = info.ModTime().UTC()
+	if cTime, err := util.GetCreationTime(fullPath); err == nil {
+		node.CreateTime = cTime.UTC()
+	}
+	node.Hash = hash
+	node.Reference = ""
+	node.Compression = ""
+	node.Chunks = nil
+	return nil
+}
@@ -0,0 +1,48 @@
+package inventory
+
+import (
+	"beanckup-cli/internal/util"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Copy 将包的各分卷从 srcDir 复制到 dstDir，并按记录重新计算哈希校验。
+// 分卷先写入临时文件再改名，校验失败时删除已复制的分卷。
+func (p *Package) Copy(srcDir, dstDir string) error {
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return fmt.Errorf("无法创建交付目录: %w", err)
+	}
+	for _, v := range p.Volumes {
+		if err := copyVolume(filepath.Join(srcDir, v.Name), filepath.Join(dstDir, v.Name)); err != nil {
+			p.remove(dstDir)
+			return fmt.Errorf("复制 %s 失败: %w", v.Name, err)
+		}
+	}
+	if problems := p.Check(dstDir, true); len(problems) > 0 {
+		p.remove(dstDir)
+		return fmt.Errorf("复制后校验失败: %s", problems[0])
+	}
+	return nil
+}
+
+func copyVolume(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return util.WriteAtomic(dstPath, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// remove 删除目录中该包的各分卷
+func (p *Package) remove(dir string) {
+	for _, v := range p.Volumes {
+		os.Remove(filepath.Join(dir, v.Name))
+	}
+}
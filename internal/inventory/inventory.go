@@ -0,0 +1,271 @@
+package inventory
+
+import (
+	"beanckup-cli/internal/signing"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 会话索引记录一个会话中每个已完成交付包的文件清单: 各分卷的文件名、字节数和 SHA-256。
+// 索引同时保存在元数据目录的 indexes/ 下和交付目录中包的旁边，恢复时用它在解压前
+// 发现缺失、被截断或被替换的分卷。
+const (
+	FormatVersion = "1.0"
+
+	// Ext 是会话索引文件的后缀
+	Ext = ".index.json"
+
+	indexDirName = "indexes"
+)
+
+var recordMu sync.Mutex
+
+// Volume 是交付包的一个物理文件 (未分卷的包或某个 .NNN 分卷)
+type Volume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Package 是一个已完成交付包的文件清单
+type Package struct {
+	Name      string    `json:"name"` // 基础包名，不含 .001
+	EpisodeID int       `json:"episode_id"`
+	Volumes   []*Volume `json:"volumes"`
+}
+
+// Index 是一个会话的索引
+type Index struct {
+	FormatVersion string     `json:"format_version"`
+	WorkspaceName string     `json:"workspace_name"`
+	SessionID     int        `json:"session_id"`
+	Updated       time.Time  `json:"updated"`
+	Packages      []*Package `json:"packages"`
+	// SessionNote 是会话的标签、备注和标记，恢复时无需解压清单即可显示和筛选
+	types.SessionNote
+}
+
+// 问题类型
+const (
+	ProblemMissing   = "missing"   // 分卷或整个包不存在
+	ProblemTruncated = "truncated" // 大小与记录不符
+	ProblemModified  = "modified"  // 哈希与记录不符，可能已被替换
+	ProblemUnknown   = "unknown"   // 存在未记录的多余分卷
+)
+
+// Problem 描述交付目录中与索引不符的一处问题
+type Problem struct {
+	Package string
+	Volume  string
+	Kind    string
+	Detail  string
+}
+
+func (p Problem) String() string {
+	switch p.Kind {
+	case ProblemMissing:
+		if p.Volume == "" {
+			return fmt.Sprintf("包 %s 不在交付目录中", p.Package)
+		}
+		return fmt.Sprintf("缺少分卷 %s", p.Volume)
+	case ProblemTruncated:
+		return fmt.Sprintf("分卷 %s 大小不符 (%s)", p.Volume, p.Detail)
+	case ProblemModified:
+		return fmt.Sprintf("分卷 %s 的内容与记录不符，可能已被替换", p.Volume)
+	default:
+		return fmt.Sprintf("分卷 %s 未被记录", p.Volume)
+	}
+}
+
+// FileName 返回会话索引的文件名
+func FileName(workspaceName string, sessionID int) string {
+	return fmt.Sprintf("%s-S%02d%s", workspaceName, sessionID, Ext)
+}
+
+// MetadataPath 返回会话索引在元数据目录中的路径
+func MetadataPath(beanckupDir, workspaceName string, sessionID int) string {
+	return filepath.Join(beanckupDir, indexDirName, FileName(workspaceName, sessionID))
+}
+
+// Describe 读取交付目录中一个刚完成的包，计算其各分卷的大小和哈希
+func Describe(deliveryPath, packageName string, episodeID int) (*Package, error) {
+	paths, err := VolumePaths(deliveryPath, packageName)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("交付目录中找不到包 %s", packageName)
+	}
+	pkg := &Package{Name: packageName, EpisodeID: episodeID}
+	for _, path := range paths {
+		size, sum, err := hashFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("无法计算 %s 的哈希: %w", filepath.Base(path), err)
+		}
+		pkg.Volumes = append(pkg.Volumes, &Volume{Name: filepath.Base(path), Size: size, SHA256: sum})
+	}
+	return pkg, nil
+}
+
+// VolumePaths 返回目录中属于该包的全部物理文件，分卷按序号排序
+func VolumePaths(dir, packageName string) ([]string, error) {
+	packagePath := filepath.Join(dir, packageName)
+	if _, err := os.Stat(packagePath); err == nil {
+		return []string{packagePath}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, globEscape(packageName)+".[0-9][0-9][0-9]"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func globEscape(name string) string {
+	return strings.NewReplacer(`[`, `\[`, `]`, `\]`, `*`, `\*`, `?`, `\?`).Replace(name)
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Record 将一个已完成的包写入会话索引 (同一 episode 的旧记录被替换)，
+// 并将更新后的索引保存到元数据目录和交付目录中
+func Record(beanckupDir, deliveryPath, workspaceName string, sessionID int, note types.SessionNote, pkg *Package) error {
+	// 同时打包的多个包会先后更新同一个会话索引
+	recordMu.Lock()
+	defer recordMu.Unlock()
+
+	metaPath := MetadataPath(beanckupDir, workspaceName, sessionID)
+	index, err := Load(metaPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		index = &Index{WorkspaceName: workspaceName, SessionID: sessionID}
+	}
+	index.FormatVersion = FormatVersion
+	index.SessionNote = note
+	index.Updated = time.Now().UTC()
+	replaced := false
+	for i, existing := range index.Packages {
+		if existing.EpisodeID == pkg.EpisodeID {
+			index.Packages[i] = pkg
+			replaced = true
+		}
+	}
+	if !replaced {
+		index.Packages = append(index.Packages, pkg)
+	}
+	sort.Slice(index.Packages, func(i, j int) bool { return index.Packages[i].EpisodeID < index.Packages[j].EpisodeID })
+
+	if err := save(index, metaPath); err != nil {
+		return err
+	}
+	return save(index, filepath.Join(deliveryPath, FileName(workspaceName, sessionID)))
+}
+
+// save 原子地写入索引并为其签名
+func save(index *Index, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("无法创建索引目录: %w", err)
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化会话索引失败: %w", err)
+	}
+	if err := util.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("写入会话索引失败: %w", err)
+	}
+	return signing.Default().SignFile(path)
+}
+
+// Load 读取并验证一个会话索引文件
+func Load(path string) (*Index, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	data, err := signing.Default().ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("解析会话索引 %s 失败: %w", filepath.Base(path), err)
+	}
+	return &index, nil
+}
+
+// IsIndexFile 判断文件名是否为会话索引
+func IsIndexFile(name string) bool {
+	return strings.HasSuffix(name, Ext)
+}
+
+// Check 对照记录检查目录中包的各分卷。full 为 false 时只检查是否存在及大小，
+// 为 true 时还会重新计算哈希。
+func (p *Package) Check(dir string, full bool) []Problem {
+	paths, err := VolumePaths(dir, p.Name)
+	if err != nil || len(paths) == 0 {
+		return []Problem{{Package: p.Name, Kind: ProblemMissing}}
+	}
+	present := make(map[string]string, len(paths))
+	for _, path := range paths {
+		present[filepath.Base(path)] = path
+	}
+
+	var problems []Problem
+	for _, v := range p.Volumes {
+		path, ok := present[v.Name]
+		if !ok {
+			problems = append(problems, Problem{Package: p.Name, Volume: v.Name, Kind: ProblemMissing})
+			continue
+		}
+		delete(present, v.Name)
+		info, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, Problem{Package: p.Name, Volume: v.Name, Kind: ProblemMissing, Detail: err.Error()})
+			continue
+		}
+		if info.Size() != v.Size {
+			problems = append(problems, Problem{Package: p.Name, Volume: v.Name, Kind: ProblemTruncated,
+				Detail: fmt.Sprintf("应为 %d 字节，实际 %d 字节", v.Size, info.Size())})
+			continue
+		}
+		if !full {
+			continue
+		}
+		if _, sum, err := hashFile(path); err != nil {
+			problems = append(problems, Problem{Package: p.Name, Volume: v.Name, Kind: ProblemMissing, Detail: err.Error()})
+		} else if sum != v.SHA256 {
+			problems = append(problems, Problem{Package: p.Name, Volume: v.Name, Kind: ProblemModified})
+		}
+	}
+	for name := range present {
+		problems = append(problems, Problem{Package: p.Name, Volume: name, Kind: ProblemUnknown})
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Volume < problems[j].Volume })
+	return problems
+}
@@ -0,0 +1,171 @@
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 锁文件是建议性的: 写入元数据目录或交付目录的进程先创建锁文件，结束后删除。
+// 锁文件记录持有者的 PID 和主机名。同一主机上的持有进程已不存在、或其他主机上的持有者
+// 超过 staleAfter 没有刷新锁文件时，锁被视为残留并自动清除。
+const (
+	// FileName 是锁文件的名称。不使用 .json 后缀，以免在元数据目录中被当作清单。
+	FileName = "beanckup.lock"
+
+	// refreshInterval 是持有者刷新锁文件修改时间的间隔
+	refreshInterval = time.Minute
+	// staleAfter 超过该时间没有刷新的锁视为残留 (用于无法检查进程是否存在的其他主机)
+	staleAfter = 10 * time.Minute
+)
+
+// Info 是锁文件的内容
+type Info struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Purpose string    `json:"purpose"` // 持有者正在执行的操作，如 "备份"
+	Started time.Time `json:"started"`
+}
+
+// LockedError 表示目录正被另一个进程锁定
+type LockedError struct {
+	Path string
+	Info Info
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s 正被另一个 BeanCKUP 进程使用 (%s，PID %d，主机 %s，开始于 %s)。如果确认该进程已经结束，可以删除锁文件 %s",
+		filepath.Dir(e.Path), e.Info.Purpose, e.Info.PID, e.Info.Host, e.Info.Started.Local().Format("2006-01-02 15:04:05"), e.Path)
+}
+
+// IsLocked 判断错误是否由目录已被锁定引起
+func IsLocked(err error) bool {
+	var lockedErr *LockedError
+	return errors.As(err, &lockedErr)
+}
+
+// Lock 是一个已获得的锁，持有期间定期刷新锁文件
+type Lock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Acquire 在目录中创建锁文件。目录已被其他进程锁定时返回 *LockedError；残留的锁会被清除后重新获取。
+func Acquire(dir, purpose string) (*Lock, error) {
+	host, _ := os.Hostname()
+	info := Info{PID: os.Getpid(), Host: host, Purpose: purpose, Started: time.Now()}
+	data, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, FileName)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("无法写入锁文件: %w", err)
+			}
+			l := &Lock{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.refresh()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("无法创建锁文件: %w", err)
+		}
+
+		existing, content, stale := inspect(path, host)
+		if !stale {
+			return nil, &LockedError{Path: path, Info: existing}
+		}
+		if err := removeStale(path, content); err != nil {
+			if IsLocked(err) {
+				existing, _, _ := inspect(path, host)
+				return nil, &LockedError{Path: path, Info: existing}
+			}
+			return nil, err
+		}
+		if content != nil {
+			log.Printf("已清除残留的锁文件 %s (PID %d，主机 %s)", path, existing.PID, existing.Host)
+		}
+	}
+	return nil, fmt.Errorf("无法获取锁文件 %s", path)
+}
+
+// inspect 读取已有的锁文件，判断其是否为残留的锁。锁文件刚被创建、尚未写入内容时不视为残留。
+func inspect(path, host string) (Info, []byte, bool) {
+	var info Info
+	stat, err := os.Stat(path)
+	if err != nil {
+		return info, nil, os.IsNotExist(err)
+	}
+	age := time.Since(stat.ModTime())
+	content, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(content, &info) != nil {
+		return info, content, age > 2*refreshInterval
+	}
+	if info.Host == host {
+		return info, content, info.PID != os.Getpid() && !processAlive(info.PID)
+	}
+	return info, content, age > staleAfter
+}
+
+// removeStale 删除残留的锁文件。先将其改名，再核对内容仍是判断时读到的锁，
+// 避免两个进程同时清除残留锁时误删对方刚获得的锁。
+func removeStale(path string, content []byte) error {
+	stalePath := fmt.Sprintf("%s.stale.%d", path, os.Getpid())
+	if err := os.Rename(path, stalePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("无法清除残留的锁文件: %w", err)
+	}
+	renamed, err := os.ReadFile(stalePath)
+	if err == nil && !bytes.Equal(renamed, content) {
+		os.Rename(stalePath, path)
+		return &LockedError{Path: path}
+	}
+	os.Remove(stalePath)
+	return nil
+}
+
+// refresh 定期更新锁文件的修改时间，使其他主机能够区分仍在运行的持有者和残留的锁
+func (l *Lock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// Release 停止刷新并删除锁文件，可以重复调用
+func (l *Lock) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		os.Remove(l.path)
+	})
+}
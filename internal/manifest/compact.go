@@ -0,0 +1,383 @@
+package manifest
+
+import (
+	"beanckup-cli/internal/types"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 紧凑清单格式 (.jsonl.gz): gzip 压缩的 JSON Lines。
+// 第一行是清单头 (compactHeader)，其中的包名表 (packages) 收录了所有被引用的包名；
+// 之后每行一个文件记录 (compactRecord)，引用只保存包名表的序号，
+// 包内路径仅在与文件自身路径不同时才保存。删除记录 (x 字段非零) 写在所有文件记录之后。
+// 按块存储的文件在 b 字段中列出各块，块所在的包同样只保存包名表的序号。
+const (
+	CompactExt = ".jsonl.gz"
+	LegacyExt  = ".json"
+)
+
+// compactHeader 是紧凑清单的第一行
+type compactHeader struct {
+	FormatVersion  string   `json:"format_version"`
+	WorkspaceName  string   `json:"workspace_name"`
+	SessionID      int      `json:"session_id"`
+	EpisodeID      int      `json:"episode_id"`
+	Timestamp      string   `json:"timestamp"`
+	PackageName    string   `json:"package_name"`
+	Roots          []string `json:"roots,omitempty"`
+	Packages       []string `json:"packages,omitempty"` // 被引用的包名表
+	FileCount      int      `json:"file_count"`
+	TombstoneCount int      `json:"tombstone_count,omitempty"`
+	Archiver       string   `json:"archiver,omitempty"`
+	types.SessionNote
+}
+
+// compactRecord 是紧凑清单中的一条文件记录，时间以 Unix 纳秒保存
+type compactRecord struct {
+	Path        string                  `json:"p,omitempty"`
+	Dir         string                  `json:"d,omitempty"`
+	Size        int64                   `json:"s,omitempty"`
+	ModTime     int64                   `json:"m,omitempty"`
+	CreateTime  int64                   `json:"c,omitempty"`
+	Hash        string                  `json:"h,omitempty"`
+	Package     int                     `json:"k,omitempty"` // 包名表序号 + 1，0 表示没有引用
+	RefPath     string                  `json:"r,omitempty"` // 包内路径，与文件路径相同时省略
+	Compression types.CompressionMethod `json:"z,omitempty"`
+	Deleted     int                     `json:"x,omitempty"` // 删除记录: 发现删除的会话号
+	Chunks      []compactChunk          `json:"b,omitempty"`
+}
+
+// compactChunk 是紧凑清单中的一个块
+type compactChunk struct {
+	Hash    string `json:"h"`
+	Size    int64  `json:"s"`
+	Package int    `json:"k,omitempty"` // 包名表序号 + 1，0 表示尚未交付
+	RefPath string `json:"r,omitempty"` // 块包在包内的路径
+	Offset  int64  `json:"o,omitempty"`
+}
+
+func isCompactFile(path string) bool {
+	return strings.HasSuffix(path, CompactExt)
+}
+
+// splitReference 将 "packagename.7z/path/in/package" 拆分为包名和包内路径
+func splitReference(ref string) (string, string) {
+	pkg, inPkg, _ := strings.Cut(ref, "/")
+	return pkg, inPkg
+}
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// writeCompact 以紧凑格式写出清单
+func writeCompact(m *types.Manifest, w io.Writer) error {
+	header := compactHeader{
+		FormatVersion:  m.FormatVersion,
+		WorkspaceName:  m.WorkspaceName,
+		SessionID:      m.SessionID,
+		EpisodeID:      m.EpisodeID,
+		Timestamp:      m.Timestamp,
+		PackageName:    m.PackageName,
+		Roots:          m.Roots,
+		FileCount:      len(m.Files),
+		TombstoneCount: len(m.Tombstones),
+		Archiver:       m.Archiver,
+		SessionNote:    m.SessionNote,
+	}
+	packageIndex := make(map[string]int)
+	intern := func(ref string) {
+		if ref == "" {
+			return
+		}
+		pkg, _ := splitReference(ref)
+		if _, ok := packageIndex[pkg]; !ok {
+			packageIndex[pkg] = len(header.Packages)
+			header.Packages = append(header.Packages, pkg)
+		}
+	}
+	for _, node := range m.Files {
+		intern(node.Reference)
+		for _, c := range node.Chunks {
+			intern(c.Reference)
+		}
+	}
+	for _, t := range m.Tombstones {
+		intern(t.Reference)
+		for _, c := range t.Chunks {
+			intern(c.Reference)
+		}
+	}
+	encodeRef := func(rec *compactRecord, ref, path string) {
+		if ref == "" {
+			return
+		}
+		pkg, inPkg := splitReference(ref)
+		rec.Package = packageIndex[pkg] + 1
+		if inPkg != path {
+			rec.RefPath = inPkg
+		}
+	}
+	encodeChunks := func(chunks []types.Chunk) []compactChunk {
+		var encoded []compactChunk
+		for _, c := range chunks {
+			cc := compactChunk{Hash: c.Hash, Size: c.Size, Offset: c.Offset}
+			if c.Reference != "" {
+				pkg, inPkg := splitReference(c.Reference)
+				cc.Package, cc.RefPath = packageIndex[pkg]+1, inPkg
+			}
+			encoded = append(encoded, cc)
+		}
+		return encoded
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	for _, node := range m.Files {
+		rec := compactRecord{
+			Path:        node.Path,
+			Dir:         node.Dir,
+			Size:        node.Size,
+			ModTime:     toUnixNano(node.ModTime),
+			CreateTime:  toUnixNano(node.CreateTime),
+			Hash:        node.Hash,
+			Compression: node.Compression,
+			Chunks:      encodeChunks(node.Chunks),
+		}
+		encodeRef(&rec, node.Reference, node.GetPath())
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+	for _, t := range m.Tombstones {
+		rec := compactRecord{Path: t.Path, Size: t.Size, Hash: t.Hash, Deleted: t.SessionID, Chunks: encodeChunks(t.Chunks)}
+		encodeRef(&rec, t.Reference, t.Path)
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// Reader 逐条读取清单中的文件记录，紧凑格式的清单不会一次性载入内存。
+type Reader struct {
+	header     *types.Manifest
+	packages   []string
+	gz         *gzip.Reader
+	dec        *json.Decoder
+	legacy     []*types.FileNode // 旧 JSON 清单已整体解析，从这里依次返回
+	tombstones []*types.Tombstone
+	closer     io.Closer
+}
+
+// OpenManifest 打开清单文件 (紧凑格式或旧 JSON 格式) 并读取清单头。
+// Header() 返回的清单不含 Files，文件记录通过 Next 依次读取。
+func OpenManifest(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取清单文件: %w", err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewReader 从数据流创建清单读取器，根据 gzip 魔数自动识别格式。
+func NewReader(src io.Reader) (*Reader, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取清单: %w", err)
+		}
+		m, err := parseLegacy(data)
+		if err != nil {
+			return nil, err
+		}
+		files, tombstones := m.Files, m.Tombstones
+		m.Files, m.Tombstones = nil, nil
+		return &Reader{header: m, legacy: files, tombstones: tombstones}, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("无法解压清单: %w", err)
+	}
+	dec := json.NewDecoder(gz)
+	var header compactHeader
+	if err := dec.Decode(&header); err != nil {
+		gz.Close()
+		return nil, fmt.Errorf("解析清单头失败: %w", err)
+	}
+	if err := checkVersion(header.FormatVersion); err != nil {
+		gz.Close()
+		return nil, err
+	}
+	return &Reader{
+		header: &types.Manifest{
+			FormatVersion: header.FormatVersion,
+			WorkspaceName: header.WorkspaceName,
+			SessionID:     header.SessionID,
+			EpisodeID:     header.EpisodeID,
+			Timestamp:     header.Timestamp,
+			PackageName:   header.PackageName,
+			Roots:         header.Roots,
+			SessionNote:   header.SessionNote,
+			Archiver:      header.Archiver,
+		},
+		packages: header.Packages,
+		gz:       gz,
+		dec:      dec,
+	}, nil
+}
+
+// Header 返回清单头 (不含文件列表)
+func (r *Reader) Header() *types.Manifest {
+	return r.header
+}
+
+// Next 返回下一条文件记录，读完时返回 io.EOF
+func (r *Reader) Next() (*types.FileNode, error) {
+	if r.dec == nil {
+		if len(r.legacy) == 0 {
+			return nil, io.EOF
+		}
+		node := r.legacy[0]
+		r.legacy = r.legacy[1:]
+		return node, nil
+	}
+
+	for {
+		var rec compactRecord
+		if err := r.dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("解析清单记录失败: %w", err)
+		}
+		ref, err := r.decodeRef(&rec)
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := r.decodeChunks(rec.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Deleted != 0 {
+			r.tombstones = append(r.tombstones, &types.Tombstone{
+				Path:      rec.Path,
+				Size:      rec.Size,
+				Hash:      rec.Hash,
+				Reference: ref,
+				SessionID: rec.Deleted,
+				Chunks:    chunks,
+			})
+			continue
+		}
+		return &types.FileNode{
+			Path:        rec.Path,
+			Dir:         rec.Dir,
+			Size:        rec.Size,
+			ModTime:     fromUnixNano(rec.ModTime),
+			CreateTime:  fromUnixNano(rec.CreateTime),
+			Hash:        rec.Hash,
+			Reference:   ref,
+			Compression: rec.Compression,
+			Chunks:      chunks,
+		}, nil
+	}
+}
+
+// decodeRef 由包名表序号和包内路径还原引用
+func (r *Reader) decodeRef(rec *compactRecord) (string, error) {
+	if rec.Package == 0 {
+		return "", nil
+	}
+	if rec.Package > len(r.packages) {
+		return "", fmt.Errorf("清单记录引用了不存在的包序号 %d", rec.Package)
+	}
+	inPkg := rec.RefPath
+	if inPkg == "" {
+		inPkg = rec.Path
+		if inPkg == "" {
+			inPkg = rec.Dir
+		}
+	}
+	return r.packages[rec.Package-1] + "/" + inPkg, nil
+}
+
+// decodeChunks 还原块列表中各块的引用
+func (r *Reader) decodeChunks(encoded []compactChunk) ([]types.Chunk, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	chunks := make([]types.Chunk, len(encoded))
+	for i, cc := range encoded {
+		chunks[i] = types.Chunk{Hash: cc.Hash, Size: cc.Size, Offset: cc.Offset}
+		if cc.Package == 0 {
+			continue
+		}
+		if cc.Package > len(r.packages) {
+			return nil, fmt.Errorf("清单记录引用了不存在的包序号 %d", cc.Package)
+		}
+		chunks[i].Reference = r.packages[cc.Package-1] + "/" + cc.RefPath
+	}
+	return chunks, nil
+}
+
+// Tombstones 返回清单中的删除记录，须在 Next 返回 io.EOF 之后调用
+func (r *Reader) Tombstones() []*types.Tombstone {
+	return r.tombstones
+}
+
+// Close 关闭读取器及其底层文件
+func (r *Reader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// readAll 读取全部文件记录，返回完整的清单对象
+func (r *Reader) readAll() (*types.Manifest, error) {
+	m := *r.header
+	m.Files = make([]*types.FileNode, 0)
+	for {
+		node, err := r.Next()
+		if err == io.EOF {
+			m.Tombstones = r.tombstones
+			return &m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, node)
+	}
+}
@@ -1,25 +1,53 @@
 package manifest
 
 import (
+	"beanckup-cli/internal/archive"
 	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// GeneratePackageName 生成符合规范的、带 .7z 后缀的唯一包文件名。
-func GeneratePackageName(workspaceName string, sessionID int, episodeID int) string {
+// FormatVersion 是本程序写入的清单格式版本。
+// 主版本号变化表示旧程序无法正确理解的不兼容修改，次版本号变化只增加可忽略的字段。
+const FormatVersion = "2.0"
+
+// supportedMajor 是本程序能够读取的最高主版本号
+const supportedMajor = 2
+
+// migrations 按顺序列出从旧版本升级清单的步骤，每一步把 from 版本的清单升级为 to 版本
+var migrations = []struct {
+	from, to string
+	apply    func(*types.Manifest)
+}{
+	// 无版本号的旧清单与 1.0 的结构相同，只需补上版本号
+	{from: "", to: "1.0", apply: func(*types.Manifest) {}},
+	// 1.1 增加了会话的标签、备注和标记，旧清单没有这些字段
+	{from: "1.0", to: "1.1", apply: func(*types.Manifest) {}},
+	// 1.2 记录写入包的归档后端，此前的包都由 7z 写入
+	{from: "1.1", to: "1.2", apply: func(m *types.Manifest) { m.Archiver = archive.Format7z }},
+	// 2.0 的文件可以按块存储 (chunks)，旧程序无法恢复这类文件；旧清单中没有按块存储的文件
+	{from: "1.2", to: "2.0", apply: func(*types.Manifest) {}},
+}
+
+// GeneratePackageName 生成符合规范的唯一包文件名，ext 为归档后端的扩展名 (如 .7z)。
+func GeneratePackageName(workspaceName string, sessionID int, episodeID int, ext string) string {
 	// 【核心修正】: 更新时间戳格式为 YYMMDD_HHMMSS
 	timestamp := time.Now().Format("060102_150405")
-	return fmt.Sprintf("%s-S%02dE%02d-%s.7z", workspaceName, sessionID, episodeID, timestamp)
+	return fmt.Sprintf("%s-S%02dE%02d-%s%s", workspaceName, sessionID, episodeID, timestamp, ext)
 }
 
 // CreateManifest 根据给定的参数创建一个新的清单对象。
 func CreateManifest(workspaceName string, sessionID int, episodeID int, packageName string, files []*types.FileNode) *types.Manifest {
 	return &types.Manifest{
+		FormatVersion: FormatVersion,
 		WorkspaceName: workspaceName,
 		SessionID:     sessionID,
 		EpisodeID:     episodeID,
@@ -29,21 +57,141 @@ func CreateManifest(workspaceName string, sessionID int, episodeID int, packageN
 	}
 }
 
-// SaveManifest 将清单对象序列化为 JSON 并保存到指定目录。
+// ManifestFileName 返回包对应的清单文件名 (紧凑格式)，与 restorer 从包内提取清单的逻辑保持一致
+func ManifestFileName(packageName string) string {
+	return archive.BaseName(packageName) + CompactExt
+}
+
+// LegacyManifestFileName 返回旧版本写入的 JSON 清单文件名
+func LegacyManifestFileName(packageName string) string {
+	return archive.BaseName(packageName) + LegacyExt
+}
+
+// IsManifestFile 判断 .beanckup 目录中的文件名是否为清单文件 (排除计划、配置等其他 JSON 文件)
+func IsManifestFile(name string) bool {
+	if strings.HasSuffix(name, CompactExt) {
+		return true
+	}
+	return strings.HasSuffix(name, LegacyExt) && !strings.HasPrefix(name, "Delivery_Status_") && !strings.HasPrefix(name, "config")
+}
+
+// SaveManifest 将清单对象以紧凑格式保存到指定目录。
 func SaveManifest(manifest *types.Manifest, dir string) (string, error) {
 	// 清单文件名基于包的基础名，确保与 restorer 逻辑一致
-	baseName := strings.TrimSuffix(manifest.PackageName, ".7z")
-	manifestFilename := baseName + ".json"
-	filePath := filepath.Join(dir, manifestFilename)
+	filePath := filepath.Join(dir, ManifestFileName(manifest.PackageName))
+	if err := WriteManifest(manifest, filePath); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// WriteManifest 将清单对象写入指定文件，按扩展名选择紧凑格式或旧 JSON 格式。
+func WriteManifest(manifest *types.Manifest, filePath string) error {
+	// 原子地写入，查询命令不会读到写了一半的清单
+	if isCompactFile(filePath) {
+		return util.WriteAtomic(filePath, func(w io.Writer) error { return WriteCompact(manifest, w) })
+	}
 
 	data, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
-		return "", fmt.Errorf("无法序列化清单: %w", err)
+		return fmt.Errorf("无法序列化清单: %w", err)
 	}
 
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return "", fmt.Errorf("无法写入清单文件: %w", err)
+	if err := util.WriteFileAtomic(filePath, data); err != nil {
+		return fmt.Errorf("无法写入清单文件: %w", err)
 	}
+	return nil
+}
 
-	return filePath, nil
+// WriteCompact 以紧凑格式将清单写入 w
+func WriteCompact(manifest *types.Manifest, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := writeCompact(manifest, bw); err != nil {
+		return fmt.Errorf("无法写入清单文件: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("无法写入清单文件: %w", err)
+	}
+	return nil
+}
+
+// ParseManifest 解析清单数据 (紧凑格式或旧 JSON 格式)。
+// 主版本号高于本程序支持版本的清单会被拒绝，以免被错误地理解。
+func ParseManifest(data []byte) (*types.Manifest, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.readAll()
+}
+
+// LoadManifest 读取并解析清单文件。
+func LoadManifest(filePath string) (*types.Manifest, error) {
+	r, err := OpenManifest(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.readAll()
+}
+
+// parseLegacy 解析旧 JSON 格式的清单
+func parseLegacy(data []byte) (*types.Manifest, error) {
+	var manifest types.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("解析清单JSON失败: %w", err)
+	}
+	if err := checkVersion(manifest.FormatVersion); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// checkVersion 拒绝主版本号高于本程序支持版本的清单
+func checkVersion(version string) error {
+	major, _, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	if major > supportedMajor {
+		return fmt.Errorf("清单格式版本 %s 高于本程序支持的版本 (%d.x)，请升级 BeanCKUP", version, supportedMajor)
+	}
+	return nil
+}
+
+// NeedsMigration 判断清单是否低于当前格式版本
+func NeedsMigration(manifest *types.Manifest) bool {
+	return manifest.FormatVersion != FormatVersion
+}
+
+// Migrate 依次应用升级步骤，将清单升级到当前格式版本。
+func Migrate(manifest *types.Manifest) error {
+	for _, step := range migrations {
+		if manifest.FormatVersion == step.from {
+			step.apply(manifest)
+			manifest.FormatVersion = step.to
+		}
+	}
+	if manifest.FormatVersion != FormatVersion {
+		return fmt.Errorf("无法将格式版本 %s 的清单升级到 %s", manifest.FormatVersion, FormatVersion)
+	}
+	return nil
+}
+
+// parseVersion 解析 "主版本.次版本" 格式的版本号，空版本号视为 0.0
+func parseVersion(version string) (major, minor int, err error) {
+	if version == "" {
+		return 0, 0, nil
+	}
+	majorStr, minorStr, _ := strings.Cut(version, ".")
+	if major, err = strconv.Atoi(majorStr); err != nil {
+		return 0, 0, fmt.Errorf("无法识别的清单格式版本: %s", version)
+	}
+	if minorStr != "" {
+		if minor, err = strconv.Atoi(minorStr); err != nil {
+			return 0, 0, fmt.Errorf("无法识别的清单格式版本: %s", version)
+		}
+	}
+	return major, minor, nil
 }
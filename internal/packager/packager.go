@@ -1,17 +1,13 @@
 package packager
 
 import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/signing"
 	"beanckup-cli/internal/types"
-	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
 )
 
 // Progress 结构体定义了打包过程中的进度信息
@@ -23,172 +19,268 @@ type Progress struct {
 }
 
 // Packager 结构体封装了打包相关的功能
-type Packager struct{}
+type Packager struct {
+	// BeforeManifest 在所有数据文件写入之后、清单文件写入之前调用，可用于校验文件并改写清单。
+	BeforeManifest func() error
+	// SplitVolumes 为 true 时即使压缩包未超过单包大小限制也输出为分卷格式 (.001)，
+	// 使其与规划时按估算大小写入清单的引用名一致。
+	SplitVolumes bool
+	// PackDir 是块包的暂存目录，Packs 中的块包 (路径相对于 PackDir，即包内路径) 在数据文件之后、清单之前写入
+	PackDir string
+	Packs   []*types.FileNode
 
-// NewPackager 创建一个新的 Packager 实例
-func NewPackager() *Packager {
-	return &Packager{}
+	archiver archive.Archiver
 }
 
-// CreatePackage 使用最简单、最可靠的"一次性打包"模型。
-// 它接收一个包含所有数据文件和清单文件的列表，然后执行一次 `7z a` 命令。
+// NewPackager 创建一个使用指定归档后端写入交付包的 Packager 实例
+func NewPackager(archiver archive.Archiver) *Packager {
+	return &Packager{archiver: archiver}
+}
+
+// CreatePackage 按文件的压缩方式分组打包。
+// 每组写入一次，已压缩过的内容仅存储，其余按各自的方法压缩；清单文件总是最后写入包内的 .beanckup 目录。
+// 如需分卷，则在全部写入完成后再将压缩包按字节切分为 .001、.002 ... 分卷，是否分卷按压缩包的实际大小判断。
 func (p *Packager) CreatePackage(
 	deliveryPath string,
 	packageName string, // 只需要包名用于显示
-	workspaceRoot string,
-	filesToPack []*types.FileNode, // 包含数据文件和清单文件
+	packRoot string, // 打包的工作目录，dataFiles 中的路径相对于它
+	dataFiles []*types.FileNode,
+	manifestFilePath string,
 	password string,
 	compressionLevel int,
 	packageSizeLimitMB int,
 	progressCallback func(Progress),
 ) error {
-	// 1. 在系统临时目录创建 listfile.txt
+	// 1. 在系统临时目录创建存放待打包清单的目录
 	tempListDir, err := os.MkdirTemp("", "beanckup_list_*")
 	if err != nil {
 		return fmt.Errorf("无法创建临时列表目录: %w", err)
 	}
 	defer os.RemoveAll(tempListDir)
 
-	listFilePath := filepath.Join(tempListDir, "listfile.txt")
-	listFile, err := os.Create(listFilePath)
+	packageFilePath := filepath.Join(deliveryPath, packageName)
+	groups := groupByCompression(dataFiles, compressionLevel, p.archiver)
+	if len(p.Packs) > 0 {
+		packs := &packGroup{method: p.archiver.Method(defaultMethod(compressionLevel)), files: p.Packs, dir: p.PackDir}
+		for _, pack := range p.Packs {
+			packs.size += pack.Size
+		}
+		groups = append(groups, packs)
+	}
+
+	manifestInfo, err := os.Stat(manifestFilePath)
 	if err != nil {
-		return fmt.Errorf("无法创建文件列表: %w", err)
+		return fmt.Errorf("无法读取清单文件: %w", err)
 	}
-	for _, node := range filesToPack {
-		// 写入所有文件的相对路径
-		listFile.WriteString(node.Path + "\n")
+	manifestStageDir := filepath.Join(tempListDir, "manifest")
+	manifestMethod := p.archiver.Method(defaultMethod(compressionLevel))
+	manifestGroup := &packGroup{
+		method:     manifestMethod,
+		files:      []*types.FileNode{{Path: ".beanckup/" + filepath.Base(manifestFilePath), Size: manifestInfo.Size()}},
+		size:       manifestInfo.Size(),
+		isManifest: true,
 	}
-	listFile.Close()
+	groups = append(groups, manifestGroup)
 
-	// 2. 准备7z命令参数
-	packageFilePath := filepath.Join(deliveryPath, packageName)
-	args := []string{
-		"a",
-		packageFilePath,     // 最终输出的压缩包基础名
-		"@" + listFilePath,  // 让7z根据列表读取文件
-		"-w" + deliveryPath, // 强制临时文件在交付目录生成
-		fmt.Sprintf("-mx=%d", compressionLevel),
-		"-mmt=on",
-		"-bb3",
-		"-bsp1",
-		"-bso1",
-	}
-
-	// 3. 判断是否需要分卷
 	var episodeTotalSize int64
-	for _, node := range filesToPack {
+	for _, group := range groups {
 		// 注意：清单文件本身很小，其大小对是否分卷的判断影响可忽略
-		episodeTotalSize += node.Size
-	}
-	packageSizeLimitBytes := int64(packageSizeLimitMB) * 1024 * 1024
-	if packageSizeLimitMB > 0 && episodeTotalSize > packageSizeLimitBytes {
-		args = append(args, fmt.Sprintf("-v%dm", packageSizeLimitMB))
+		episodeTotalSize += group.size
 	}
 
-	if password != "" {
-		args = append(args, "-p"+password, "-mhe=on")
+	writer, err := p.archiver.Create(packageFilePath, archive.Options{
+		Password:         password,
+		CompressionLevel: compressionLevel,
+		WorkDir:          deliveryPath, // 临时文件在交付目录生成
+	})
+	if err != nil {
+		removePackageFiles(packageFilePath)
+		return fmt.Errorf("创建压缩包失败: %w", err)
+	}
+	// fail 在写入失败时关闭并删除未完成的包
+	fail := func(err error) error {
+		writer.Close()
+		removePackageFiles(packageFilePath)
+		return err
 	}
 
-	// [新增] 打印7z命令参数和工作目录
-	log.Printf("[DEBUG] 7z 命令参数: 7z %s", strings.Join(args, " "))
-	log.Printf("[DEBUG] 工作目录: %s", workspaceRoot)
-
-	// 4. 执行一次性的 `7z a` 命令
-	cmd := exec.Command("7z", args...)
-	cmd.Dir = workspaceRoot // 将工作目录设置为源工作区，以便7z能通过相对路径找到所有文件
+	// 2. 逐组写入，进度按各组的字节数加权汇总
+	var doneSize int64
+	for _, group := range groups {
+		cwd := packRoot
+		if group.dir != "" {
+			cwd = group.dir
+		}
+		if group.isManifest {
+			if p.BeforeManifest != nil {
+				if err := p.BeforeManifest(); err != nil {
+					return fail(fmt.Errorf("写入清单前的检查失败: %w", err))
+				}
+			}
+			// 清单文件 (及其签名) 被复制到临时目录的 .beanckup 下再打包，使其在包内的路径与元数据目录的位置无关
+			staged, err := stageManifest(manifestFilePath, manifestStageDir)
+			if err != nil {
+				return fail(err)
+			}
+			group.files = staged
+			cwd = manifestStageDir
+		}
 
-	if err := run7zAndHandleProgress(cmd, packageName, "打包文件和清单", progressCallback); err != nil {
-		// 如果打包失败，尝试删除可能产生的未完成的包
-		os.Remove(packageFilePath)
-		// 同时尝试清理可能产生的分卷文件
-		globPattern := packageFilePath + ".0*"
-		if files, _ := filepath.Glob(globPattern); files != nil {
-			for _, f := range files {
-				os.Remove(f)
+		groupStart := doneSize
+		stage := fmt.Sprintf("打包文件 (%s)", group.method)
+		err := writer.Add(cwd, group.files, group.method, func(percentage int, currentFile string) {
+			pr := Progress{Percentage: percentage, PackageName: packageName, CurrentFile: currentFile, Stage: stage}
+			if episodeTotalSize > 0 {
+				pr.Percentage = int((groupStart + group.size*int64(percentage)/100) * 100 / episodeTotalSize)
 			}
+			progressCallback(pr)
+		})
+		if err != nil {
+			return fail(fmt.Errorf("创建压缩包失败: %w", err))
 		}
+		doneSize += group.size
+	}
+	if err := writer.Close(); err != nil {
+		removePackageFiles(packageFilePath)
 		return fmt.Errorf("创建压缩包失败: %w", err)
 	}
 
+	// 3. 判断是否需要分卷: 按压缩后的实际大小判断
+	packageSizeLimitBytes := int64(packageSizeLimitMB) * 1024 * 1024
+	archiveInfo, err := os.Stat(packageFilePath)
+	if err != nil {
+		removePackageFiles(packageFilePath)
+		return fmt.Errorf("无法读取压缩包: %w", err)
+	}
+	if packageSizeLimitMB > 0 && (archiveInfo.Size() > packageSizeLimitBytes || p.SplitVolumes) {
+		if err := splitIntoVolumes(packageFilePath, packageSizeLimitBytes); err != nil {
+			removePackageFiles(packageFilePath)
+			return fmt.Errorf("分卷失败: %w", err)
+		}
+	}
+
 	progressCallback(Progress{Percentage: 100, PackageName: packageName, Stage: "完成"})
 	return nil
 }
 
-// run7zAndHandleProgress 保持不变，它能很好地处理进度
-func run7zAndHandleProgress(cmd *exec.Cmd, packageName, stage string, progressCallback func(Progress)) error {
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("无法获取 stdout pipe: %w", err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("无法获取 stderr pipe: %w", err)
-	}
+// packGroup 是使用同一压缩方式、一次写入的一组文件
+type packGroup struct {
+	method     types.CompressionMethod
+	files      []*types.FileNode
+	size       int64
+	dir        string // 非空时文件路径相对于该目录而不是 packRoot
+	isManifest bool
+}
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("启动 7z 命令失败: %w", err)
+// defaultMethod 返回没有指定压缩方式的文件使用的压缩方式
+func defaultMethod(compressionLevel int) types.CompressionMethod {
+	if compressionLevel == 0 {
+		return types.CompressionStore
 	}
+	return types.CompressionLZMA2
+}
 
-	var stderrBuf strings.Builder
-	go func() {
-		io.Copy(&stderrBuf, stderr)
-	}()
-
-	reader := bufio.NewReader(stdout)
-	for {
-		line, err := reader.ReadString('\r')
-		if len(line) > 0 {
-			progress := parse7zProgress(line, packageName, stage)
-			if progress.Percentage > 0 || strings.Contains(line, "%") {
-				progressCallback(progress)
-			}
+// groupByCompression 按压缩方式对数据文件分组，仅存储的组排在最前。后端不支持的压缩方式由其替换为最接近的一种。
+func groupByCompression(nodes []*types.FileNode, compressionLevel int, archiver archive.Archiver) []*packGroup {
+	order := []types.CompressionMethod{types.CompressionStore, types.CompressionLZMA2, types.CompressionPPMd, types.CompressionGzip}
+	byMethod := make(map[types.CompressionMethod]*packGroup)
+	for _, node := range nodes {
+		method := node.Compression
+		if method == "" {
+			method = defaultMethod(compressionLevel)
 		}
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("读取7z输出时出错: %v", err)
-			}
-			break
+		method = archiver.Method(method)
+		group, ok := byMethod[method]
+		if !ok {
+			group = &packGroup{method: method}
+			byMethod[method] = group
 		}
+		group.files = append(group.files, node)
+		group.size += node.Size
 	}
 
-	waitErr := cmd.Wait()
-	if waitErr != nil {
-		if exitErr, ok := waitErr.(*exec.ExitError); ok {
-			// Exit code 1 是 7z 的非致命警告 (例如，有文件被锁定无法访问)
-			// 我们应该记录它，但不应将其视为整个打包过程的失败。
-			if exitErr.ExitCode() == 1 {
-				log.Printf("[警告] 7z 执行时返回非致命错误 (代码 1)，打包可能已部分成功。错误详情: %s", stderrBuf.String())
-				return nil // 视为成功
+	var groups []*packGroup
+	for _, method := range order {
+		if group, ok := byMethod[method]; ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// stageManifest 将清单文件及其签名 (如有) 复制到 stageDir/.beanckup/ 下，返回待打包的文件列表
+func stageManifest(manifestFilePath, stageDir string) ([]*types.FileNode, error) {
+	targetDir := filepath.Join(stageDir, ".beanckup")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return nil, fmt.Errorf("无法创建清单暂存目录: %w", err)
+	}
+	var staged []*types.FileNode
+	for _, path := range []string{manifestFilePath, signing.SigPath(manifestFilePath)} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if path != manifestFilePath && os.IsNotExist(err) {
+				continue
 			}
+			return nil, fmt.Errorf("无法读取清单文件: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, filepath.Base(path)), data, 0644); err != nil {
+			return nil, fmt.Errorf("无法暂存清单文件: %w", err)
 		}
-		// 其他错误 (包括其他退出代码) 视为致命错误。
-		log.Printf("[ERROR] 7z 命令执行失败: %v", waitErr)
-		log.Printf("[ERROR] 7z 标准错误输出: %s", stderrBuf.String())
-		return fmt.Errorf("7z 命令执行失败: %w\n7z stderr: %s", waitErr, stderrBuf.String())
+		staged = append(staged, &types.FileNode{Path: ".beanckup/" + filepath.Base(path), Size: int64(len(data))})
 	}
-	return nil
+	return staged, nil
 }
 
-// parse7zProgress 保持不变
-func parse7zProgress(line, packageName, stage string) Progress {
-	progress := Progress{
-		PackageName: packageName,
-		Stage:       stage,
+// splitIntoVolumes 将压缩包按字节切分为 7z 兼容的分卷 (name.7z.001, name.7z.002 ...)，原生格式的包按同样的方式切分。
+// 从尾部开始逐卷切出并截断原文件，因此额外占用的磁盘空间不超过一个分卷。
+func splitIntoVolumes(packageFilePath string, volumeSize int64) error {
+	info, err := os.Stat(packageFilePath)
+	if err != nil {
+		return err
+	}
+	total := info.Size()
+	count := int((total + volumeSize - 1) / volumeSize)
+	if count == 0 {
+		count = 1
 	}
 
-	rePercent := regexp.MustCompile(`(\d+)\%`)
-	matchesPercent := rePercent.FindStringSubmatch(line)
-	if len(matchesPercent) > 1 {
-		if p, err := strconv.Atoi(matchesPercent[1]); err == nil {
-			progress.Percentage = p
+	src, err := os.OpenFile(packageFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	for i := count; i >= 2; i-- {
+		start := int64(i-1) * volumeSize
+		volumePath := fmt.Sprintf("%s.%03d", packageFilePath, i)
+		dst, err := os.Create(volumePath)
+		if err != nil {
+			src.Close()
+			return err
+		}
+		_, err = io.Copy(dst, io.NewSectionReader(src, start, total-start))
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
 		}
+		if err == nil {
+			err = src.Truncate(start)
+		}
+		if err != nil {
+			src.Close()
+			return err
+		}
+		total = start
 	}
-
-	reFile := regexp.MustCompile(`\s(U|A|Compressing)\s+(.+)`)
-	matchesFile := reFile.FindStringSubmatch(line)
-	if len(matchesFile) > 2 {
-		progress.CurrentFile = strings.TrimSpace(matchesFile[2])
+	if err := src.Close(); err != nil {
+		return err
 	}
+	return os.Rename(packageFilePath, packageFilePath+".001")
+}
 
-	return progress
+// removePackageFiles 删除可能产生的未完成的包及其分卷文件
+func removePackageFiles(packageFilePath string) {
+	os.Remove(packageFilePath)
+	if files, _ := filepath.Glob(packageFilePath + ".0*"); files != nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
 }
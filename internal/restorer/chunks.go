@@ -0,0 +1,196 @@
+package restorer
+
+import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/chunker"
+	"beanckup-cli/internal/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// chunkSource 从交付包中解压块包并按位置读取块。每个块包只在首次用到时解压一次 (到临时目录中)，
+// 块所在的包有会话索引记录时，解压前先完整校验该包。
+type chunkSource struct {
+	r        *Restorer
+	dir      string
+	password string
+	packs    map[string]*os.File // 块包引用到其本地副本
+	failed   map[string]error    // 无法取得的块包
+	checked  map[string]error    // 已校验过的包 (基础包名) 及其结果
+}
+
+func (r *Restorer) newChunkSource(dir, password string) *chunkSource {
+	return &chunkSource{
+		r:        r,
+		dir:      dir,
+		password: password,
+		packs:    make(map[string]*os.File),
+		failed:   make(map[string]error),
+		checked:  make(map[string]error),
+	}
+}
+
+// open 返回块包的本地副本
+func (s *chunkSource) open(ref string) (*os.File, error) {
+	if f, ok := s.packs[ref]; ok {
+		return f, nil
+	}
+	if err, ok := s.failed[ref]; ok {
+		return nil, err
+	}
+	f, err := s.extract(ref)
+	if err != nil {
+		s.failed[ref] = err
+		return nil, err
+	}
+	s.packs[ref] = f
+	return f, nil
+}
+
+func (s *chunkSource) extract(ref string) (*os.File, error) {
+	packageName, inPackage, ok := strings.Cut(ref, "/")
+	if !ok {
+		return nil, fmt.Errorf("块包引用格式错误: '%s'", ref)
+	}
+	basePackageNameWithTS := archive.BaseName(packageName)
+	sourcePackagePath, ok := s.r.allPackages[basePackageNameWithTS]
+	if !ok {
+		return nil, fmt.Errorf("交付目录中找不到包 '%s'", packageName)
+	}
+	if pkg, ok := s.r.inventory[basePackageNameWithTS]; ok {
+		err, done := s.checked[basePackageNameWithTS]
+		if !done {
+			if problems := pkg.Check(filepath.Dir(sourcePackagePath), true); len(problems) > 0 {
+				err = fmt.Errorf("交付包 %s 未通过校验: %s", pkg.Name, problems[0])
+			}
+			s.checked[basePackageNameWithTS] = err
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.CreateTemp(s.dir, "pack_*")
+	if err != nil {
+		return nil, fmt.Errorf("无法创建临时文件: %w", err)
+	}
+	if err := s.r.archiverFor(basePackageNameWithTS).ExtractFile(sourcePackagePath, inPackage, s.password, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("解压块包 %s 失败: %w", ref, err)
+	}
+	return f, nil
+}
+
+// writeFile 按块列表依次写出文件的内容，并核对每个块的哈希
+func (s *chunkSource) writeFile(node *types.FileNode, w io.Writer) error {
+	buf := make([]byte, chunker.MaxSize)
+	for _, c := range node.Chunks {
+		if c.Reference == "" {
+			return fmt.Errorf("块 %s 没有记录所在的块包", c.Hash)
+		}
+		if c.Size < 0 || c.Size > chunker.MaxSize {
+			return fmt.Errorf("块 %s 的大小 %d 无效", c.Hash, c.Size)
+		}
+		f, err := s.open(c.Reference)
+		if err != nil {
+			return err
+		}
+		data := buf[:c.Size]
+		if _, err := f.ReadAt(data, c.Offset); err != nil {
+			return fmt.Errorf("读取块 %s 失败 (块包: %s): %w", c.Hash, c.Reference, err)
+		}
+		if chunker.HashChunk(data) != c.Hash {
+			return fmt.Errorf("块 %s 的内容与记录的哈希不符 (块包: %s)", c.Hash, c.Reference)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭并删除解压出的块包
+func (s *chunkSource) Close() {
+	for _, f := range s.packs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.packs = make(map[string]*os.File)
+}
+
+// extractChunkedFile 由块包拼接出按块存储的文件写入 w，并核对整个文件的哈希
+func (r *Restorer) extractChunkedFile(node *types.FileNode, password string, w io.Writer) error {
+	tempDir, err := os.MkdirTemp("", "beanckup_chunks_*")
+	if err != nil {
+		return fmt.Errorf("无法创建临时目录: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	src := r.newChunkSource(tempDir, password)
+	defer src.Close()
+
+	hasher := sha256.New()
+	if err := src.writeFile(node, io.MultiWriter(w, hasher)); err != nil {
+		return fmt.Errorf("解压失败: %w", err)
+	}
+	if node.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != node.Hash {
+		return fmt.Errorf("拼接出的内容与记录的哈希不符")
+	}
+	return nil
+}
+
+// restoreChunkedFiles 由块包拼接出按块存储的文件，解压出的块包暂存在 tempBaseDir 中。
+// 拼接出的内容与记录的哈希不符的文件不予保留。
+func (r *Restorer) restoreChunkedFiles(items []restoreItem, tempBaseDir, fullRestorePath, password string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Printf("\n正在拼接 %d 个按块存储的文件...\n", len(items))
+	src := r.newChunkSource(tempBaseDir, password)
+	defer src.Close()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].targetPath < items[j].targetPath })
+	for _, item := range items {
+		node := item.node
+		finalPath := filepath.Join(fullRestorePath, filepath.FromSlash(item.targetPath))
+		if err := assembleFile(src, node, finalPath); err != nil {
+			fmt.Printf("警告: 恢复文件 '%s' 失败: %v\n", node.Path, err)
+			continue
+		}
+		if !node.ModTime.IsZero() && !node.CreateTime.IsZero() {
+			if err := os.Chtimes(finalPath, node.CreateTime, node.ModTime); err != nil {
+				fmt.Printf("警告: 更新文件 '%s' 时间戳失败: %v\n", node.Path, err)
+			}
+		}
+	}
+}
+
+// assembleFile 将按块存储的文件拼接写入 finalPath
+func assembleFile(src *chunkSource, node *types.FileNode, finalPath string) error {
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(finalPath)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	err = src.writeFile(node, io.MultiWriter(f, hasher))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && node.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != node.Hash {
+		err = fmt.Errorf("拼接出的内容与记录的哈希不符")
+	}
+	if err != nil {
+		os.Remove(finalPath)
+		return err
+	}
+	return nil
+}
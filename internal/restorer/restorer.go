@@ -1,15 +1,19 @@
 package restorer
 
 import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/history"
+	"beanckup-cli/internal/inventory"
 	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/signing"
 	"beanckup-cli/internal/types"
 	"beanckup-cli/internal/util"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
 	"log"
-	"os/exec"
+	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -21,6 +25,20 @@ import (
 type Restorer struct {
 	deliveryDir string
 	allPackages map[string]string // 存储包的基础名(带时间戳)到其入口文件路径的映射
+	metadataDir string            // 可选: 工作区的元数据目录，设置后优先从其目录索引读取会话内容
+	// rawManifests 保存清单的原始文件内容及签名，恢复 .beanckup 时原样写回，使签名保持有效
+	rawManifests map[*types.Manifest]*rawManifest
+	// inventory 是交付目录中会话索引记录的各包分卷信息，以基础包名(带时间戳，不含扩展名)为键
+	inventory  map[string]*inventory.Package
+	indexFiles map[int]string // 会话号到交付目录中会话索引文件的路径
+	// archivers 是已加载的清单中记录的写入各包的归档后端，以基础包名为键
+	archivers map[string]string
+}
+
+type rawManifest struct {
+	name string
+	data []byte
+	sig  []byte
 }
 
 type DeliverySession struct {
@@ -28,34 +46,70 @@ type DeliverySession struct {
 	Timestamp           time.Time
 	Manifests           []*types.Manifest
 	HistoricalManifests []*types.Manifest
+	// Problems 是发现会话时对照会话索引检查出的问题 (缺失或大小不符的分卷)
+	Problems []inventory.Problem
+	// Note 是会话索引中记录的标签、备注和标记，无需解压清单即可用于显示和筛选
+	Note types.SessionNote
 }
 
 func NewRestorer(deliveryDir string) (*Restorer, error) {
 	return &Restorer{
-		deliveryDir: deliveryDir,
-		allPackages: make(map[string]string),
+		deliveryDir:  deliveryDir,
+		allPackages:  make(map[string]string),
+		rawManifests: make(map[*types.Manifest]*rawManifest),
+		inventory:    make(map[string]*inventory.Package),
+		indexFiles:   make(map[int]string),
+		archivers:    make(map[string]string),
 	}, nil
 }
 
 func (r *Restorer) DiscoverDeliverySessions() ([]*DeliverySession, error) {
 	sessionMap := make(map[int]*DeliverySession)
 
-	re := regexp.MustCompile(`(?i)\.7z(\.001)?$`)
-
+	var indexes []*inventory.Index
 	filepath.Walk(r.deliveryDir, func(path string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() && re.MatchString(info.Name()) {
+		if err == nil && !info.IsDir() && inventory.IsIndexFile(info.Name()) {
+			index, err := inventory.Load(path)
+			if err != nil {
+				fmt.Printf("警告: 无法读取会话索引 %s: %v\n", info.Name(), err)
+				return nil
+			}
+			indexes = append(indexes, index)
+			r.indexFiles[index.SessionID] = path
+			return nil
+		}
+		if err == nil && !info.IsDir() && archive.IsPackageFile(info.Name()) {
 			sessionID, _, _ := parsePackageName(info.Name())
 			if sessionID > 0 {
 				if _, exists := sessionMap[sessionID]; !exists {
 					sessionMap[sessionID] = &DeliverySession{SessionID: sessionID}
 				}
-				baseNameWithTS := strings.TrimSuffix(strings.TrimSuffix(info.Name(), ".001"), ".7z")
+				baseNameWithTS := archive.BaseName(info.Name())
 				r.allPackages[baseNameWithTS] = path
 			}
 		}
 		return nil
 	})
 
+	// 对照会话索引检查各包的分卷是否齐全、大小是否一致；哈希留到恢复前再完整校验
+	for _, index := range indexes {
+		session, ok := sessionMap[index.SessionID]
+		if !ok {
+			continue
+		}
+		session.Note = index.SessionNote
+		for _, pkg := range index.Packages {
+			baseNameWithTS := archive.BaseName(pkg.Name)
+			r.inventory[baseNameWithTS] = pkg
+			// 找不到入口文件时 (例如首个分卷丢失) 在索引所在目录中检查，以报告具体缺失的分卷
+			dir := filepath.Dir(r.indexFiles[index.SessionID])
+			if entryPath, found := r.allPackages[baseNameWithTS]; found {
+				dir = filepath.Dir(entryPath)
+			}
+			session.Problems = append(session.Problems, pkg.Check(dir, false)...)
+		}
+	}
+
 	var sessions []*DeliverySession
 	for _, session := range sessionMap {
 		sessions = append(sessions, session)
@@ -66,7 +120,20 @@ func (r *Restorer) DiscoverDeliverySessions() ([]*DeliverySession, error) {
 	return sessions, nil
 }
 
+// UseCatalog 设置工作区的元数据目录。加载会话时优先使用其中的目录索引和清单，无需从每个包中解压清单。
+func (r *Restorer) UseCatalog(beanckupDir string) {
+	r.metadataDir = beanckupDir
+}
+
 func (r *Restorer) LoadSessionManifests(session *DeliverySession, password string) error {
+	if r.metadataDir != "" {
+		err := r.loadSessionFromCatalog(session)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("警告: 无法从目录索引加载会话 S%d (%v)，将从交付包中读取清单。\n", session.SessionID, err)
+	}
+
 	var targetManifests []*types.Manifest
 	var historicalManifests []*types.Manifest
 	var firstTimestamp time.Time
@@ -74,7 +141,7 @@ func (r *Restorer) LoadSessionManifests(session *DeliverySession, password strin
 	for _, packagePath := range r.allPackages {
 		m, err := r.extractManifestFromPackage(packagePath, password)
 		if err != nil {
-			if password != "" {
+			if password != "" || signing.IsVerificationError(err) {
 				fmt.Printf("警告: 从包 %s 提取清单失败: %v\n", filepath.Base(packagePath), err)
 			}
 			continue
@@ -104,6 +171,60 @@ func (r *Restorer) LoadSessionManifests(session *DeliverySession, password strin
 	return nil
 }
 
+// loadSessionFromCatalog 从元数据目录的目录索引取得会话的完整文件列表，并直接读取其中的历史清单。
+// 恢复不持有工作区锁，目录索引以只读方式打开。
+func (r *Restorer) loadSessionFromCatalog(session *DeliverySession) error {
+	cat, err := history.OpenCatalogReadOnly(r.metadataDir)
+	if err != nil {
+		return err
+	}
+	info, ok := cat.Session(session.SessionID)
+	if !ok {
+		return fmt.Errorf("目录中没有会话 S%d", session.SessionID)
+	}
+	files, err := cat.SessionFiles(session.SessionID)
+	if err != nil {
+		return err
+	}
+	paths, err := history.ManifestPaths(r.metadataDir, session.SessionID)
+	if err != nil {
+		return err
+	}
+	var historicalManifests []*types.Manifest
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("无法读取清单文件: %w", err)
+		}
+		sig, _ := os.ReadFile(signing.SigPath(path))
+		if err := signing.Default().Check(filepath.Base(path), data, sig); err != nil {
+			return err
+		}
+		m, err := manifest.ParseManifest(data)
+		if err != nil {
+			return fmt.Errorf("无法加载清单文件 %s: %w", path, err)
+		}
+		r.rawManifests[m] = &rawManifest{name: filepath.Base(path), data: data, sig: sig}
+		r.noteArchiver(m)
+		historicalManifests = append(historicalManifests, m)
+	}
+
+	if ts, err := time.Parse(time.RFC3339, info.Timestamp); err == nil {
+		session.Timestamp = ts
+	}
+	session.Manifests = []*types.Manifest{{
+		FormatVersion: manifest.FormatVersion,
+		WorkspaceName: info.WorkspaceName,
+		SessionID:     session.SessionID,
+		Timestamp:     info.Timestamp,
+		Roots:         info.Roots,
+		Files:         files,
+		SessionNote:   info.SessionNote,
+	}}
+	session.HistoricalManifests = historicalManifests
+	return nil
+}
+
 func (r *Restorer) extractManifestFromPackage(packagePath, password string) (*types.Manifest, error) {
 	tempDir, err := os.MkdirTemp("", "beanckup_manifest_*")
 	if err != nil {
@@ -111,90 +232,217 @@ func (r *Restorer) extractManifestFromPackage(packagePath, password string) (*ty
 	}
 	defer os.RemoveAll(tempDir)
 
-	baseNameWithTS := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(packagePath), ".001"), ".7z")
-	manifestFilename := baseNameWithTS + ".json"
-	manifestPathInPackage := filepath.ToSlash(filepath.Join(".beanckup", manifestFilename))
+	baseNameWithTS := archive.BaseName(filepath.Base(packagePath))
+	// 新包使用紧凑格式的清单，旧包中是 JSON 清单，两种文件名都尝试解压，并一同解压签名文件
+	candidates := []string{
+		filepath.ToSlash(filepath.Join(".beanckup", manifest.ManifestFileName(baseNameWithTS))),
+		filepath.ToSlash(filepath.Join(".beanckup", manifest.LegacyManifestFileName(baseNameWithTS))),
+	}
+	var names []string
+	for _, candidate := range candidates {
+		names = append(names, candidate, signing.SigPath(candidate))
+	}
 
-	args := []string{"x", packagePath, "-o" + tempDir, manifestPathInPackage, "-y"}
-	if password != "" {
-		args = append(args, "-p"+password)
+	// 读取清单之前还不知道写入包的后端，按扩展名判断
+	extractErr := archive.ForFile(packagePath).Extract(packagePath, names, tempDir, password)
+	for _, manifestPathInPackage := range candidates {
+		extracted := filepath.Join(tempDir, manifestPathInPackage)
+		data, err := os.ReadFile(extracted)
+		if err != nil {
+			continue
+		}
+		sig, _ := os.ReadFile(signing.SigPath(extracted))
+		if err := signing.Default().Check(filepath.Base(extracted), data, sig); err != nil {
+			return nil, err
+		}
+		m, err := manifest.ParseManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		r.rawManifests[m] = &rawManifest{name: filepath.Base(extracted), data: data, sig: sig}
+		r.noteArchiver(m)
+		return m, nil
+	}
+	if extractErr != nil {
+		return nil, fmt.Errorf("解压清单失败: %w", extractErr)
 	}
+	return nil, fmt.Errorf("包 %s 中未找到清单文件", filepath.Base(packagePath))
+}
 
-	cmd := exec.Command("7z", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		if _, statErr := os.Stat(filepath.Join(tempDir, manifestPathInPackage)); statErr != nil {
-			return nil, fmt.Errorf("解压清单失败 (包: %s): %s", filepath.Base(packagePath), string(output))
+// ReattachWorkspace 从交付目录的各个包中提取属于指定工作区的清单，写入元数据目录，
+// 用于 .beanckup 丢失后重建历史记录。元数据目录中已有的清单保持不变。
+// 须先调用 DiscoverDeliverySessions。返回写入的清单数以及交付目录中出现过的工作区名。
+func (r *Restorer) ReattachWorkspace(workspaceName, beanckupDir, password string) (int, []string, error) {
+	if err := os.MkdirAll(beanckupDir, 0755); err != nil {
+		return 0, nil, fmt.Errorf("无法创建 .beanckup 目录: %w", err)
+	}
+	if err := util.SetHidden(beanckupDir); err != nil {
+		log.Printf("警告: 无法将 .beanckup 文件夹设置为隐藏: %v", err)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	restored := 0
+	var lastSession int
+	for _, packagePath := range r.allPackages {
+		m, err := r.extractManifestFromPackage(packagePath, password)
+		if err != nil {
+			fmt.Printf("警告: 从包 %s 提取清单失败: %v\n", filepath.Base(packagePath), err)
+			continue
+		}
+		if !seen[m.WorkspaceName] {
+			seen[m.WorkspaceName] = true
+			names = append(names, m.WorkspaceName)
 		}
+		if m.WorkspaceName != workspaceName {
+			continue
+		}
+		if m.SessionID > lastSession {
+			lastSession = m.SessionID
+		}
+		name := manifest.ManifestFileName(m.PackageName)
+		if raw, ok := r.rawManifests[m]; ok {
+			name = raw.name
+		}
+		if _, err := os.Stat(filepath.Join(beanckupDir, name)); err == nil {
+			continue
+		}
+		if err := r.restoreManifest(m, beanckupDir); err != nil {
+			return restored, names, fmt.Errorf("写入清单 %s 失败: %w", name, err)
+		}
+		restored++
+	}
+	if lastSession > 0 {
+		r.restoreIndexes(workspaceName, lastSession, beanckupDir)
 	}
+	sort.Strings(names)
+	return restored, names, nil
+}
 
-	data, err := os.ReadFile(filepath.Join(tempDir, manifestPathInPackage))
-	if err != nil {
-		return nil, fmt.Errorf("读取清单文件 '%s' 失败: %w", manifestPathInPackage, err)
+// ExtractFile 从交付目录中解压单个文件的内容写入 w，并核对内容的哈希。须先调用 DiscoverDeliverySessions。
+// 所在的包有会话索引记录时，解压前先完整校验包的各分卷。
+func (r *Restorer) ExtractFile(node *types.FileNode, password string, w io.Writer) error {
+	if len(node.Chunks) > 0 {
+		return r.extractChunkedFile(node, password, w)
+	}
+	parts := strings.SplitN(node.Reference, "/", 2)
+	if len(parts) < 2 {
+		return fmt.Errorf("文件 '%s' 引用格式错误: '%s'", node.Path, node.Reference)
+	}
+	basePackageNameWithTS := archive.BaseName(parts[0])
+	sourcePackagePath, ok := r.allPackages[basePackageNameWithTS]
+	if !ok {
+		return fmt.Errorf("交付目录中找不到包 '%s'", parts[0])
+	}
+	if pkg, ok := r.inventory[basePackageNameWithTS]; ok {
+		if problems := pkg.Check(filepath.Dir(sourcePackagePath), true); len(problems) > 0 {
+			return fmt.Errorf("交付包 %s 未通过校验: %s", pkg.Name, problems[0])
+		}
+	}
+
+	hasher := sha256.New()
+	if err := r.archiverFor(basePackageNameWithTS).ExtractFile(sourcePackagePath, parts[1], password, io.MultiWriter(w, hasher)); err != nil {
+		return fmt.Errorf("解压失败: %w", err)
+	}
+	if node.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != node.Hash {
+		return fmt.Errorf("解压出的内容与记录的哈希不符 (包: %s)", filepath.Base(sourcePackagePath))
 	}
-	var manifest types.Manifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		return nil, fmt.Errorf("解析清单JSON失败: %w", err)
+	return nil
+}
+
+// SessionRoots 返回会话所属备份集中各源目录的名称，单目录工作区返回 nil
+func (session *DeliverySession) SessionRoots() []string {
+	for _, m := range session.Manifests {
+		if len(m.Roots) > 0 {
+			return m.Roots
+		}
 	}
-	return &manifest, nil
+	return nil
 }
 
-func (r *Restorer) RestoreFromSession(session *DeliverySession, restorePath, password string) error {
+// RestoreFromSession 将会话恢复到 restorePath 下新建的恢复目录中，并返回该目录。
+// rootName 非空时只恢复多源目录备份集中的该源目录，文件直接恢复到恢复目录下 (不带命名空间前缀)，且不恢复历史清单。
+func (r *Restorer) RestoreFromSession(session *DeliverySession, rootName, restorePath, password string) (string, error) {
 	if len(session.Manifests) == 0 {
-		return fmt.Errorf("会话 S%d 无清单文件", session.SessionID)
+		return "", fmt.Errorf("会话 S%d 无清单文件", session.SessionID)
 	}
 	workspaceName := session.Manifests[0].WorkspaceName
 	ts := session.Timestamp.Format("060102_150405") // 【核心修正】: 更新时间戳格式
-	fullRestorePath := filepath.Join(restorePath, fmt.Sprintf("%s_S%d_%s_Recovery", workspaceName, session.SessionID, ts))
+	recoveryDir := fmt.Sprintf("%s_S%d_%s_Recovery", workspaceName, session.SessionID, ts)
+	if rootName != "" {
+		recoveryDir = fmt.Sprintf("%s_S%d_%s_%s_Recovery", workspaceName, session.SessionID, ts, rootName)
+	}
+	fullRestorePath := filepath.Join(restorePath, recoveryDir)
 	if err := os.MkdirAll(fullRestorePath, 0755); err != nil {
-		return fmt.Errorf("无法创建恢复目录: %w", err)
+		return "", fmt.Errorf("无法创建恢复目录: %w", err)
 	}
 
-	beanckupDir := filepath.Join(fullRestorePath, ".beanckup")
-	if err := os.MkdirAll(beanckupDir, 0755); err != nil {
-		return fmt.Errorf("无法创建 .beanckup 目录: %w", err)
-	}
-	// 【核心修正】: 将恢复的 .beanckup 目录也设为隐藏
-	if err := util.SetHidden(beanckupDir); err != nil {
-		log.Printf("警告: 无法将恢复的 .beanckup 文件夹设置为隐藏: %v", err)
-	}
+	if rootName == "" {
+		beanckupDir := filepath.Join(fullRestorePath, ".beanckup")
+		if err := os.MkdirAll(beanckupDir, 0755); err != nil {
+			return "", fmt.Errorf("无法创建 .beanckup 目录: %w", err)
+		}
+		// 【核心修正】: 将恢复的 .beanckup 目录也设为隐藏
+		if err := util.SetHidden(beanckupDir); err != nil {
+			log.Printf("警告: 无法将恢复的 .beanckup 文件夹设置为隐藏: %v", err)
+		}
 
-	fmt.Println("正在恢复历史清单文件...")
-	for _, m := range session.HistoricalManifests {
-		if _, err := manifest.SaveManifest(m, beanckupDir); err != nil {
-			fmt.Printf("警告: 恢复清单 '%s' 失败: %v\n", m.PackageName, err)
+		fmt.Println("正在恢复历史清单文件...")
+		for _, m := range session.HistoricalManifests {
+			if err := r.restoreManifest(m, beanckupDir); err != nil {
+				fmt.Printf("警告: 恢复清单 '%s' 失败: %v\n", m.PackageName, err)
+			}
 		}
+		r.restoreIndexes(workspaceName, session.SessionID, beanckupDir)
 	}
 
+	// finalFileSet 以恢复目录内的目标相对路径为键
 	finalFileSet := make(map[string]*types.FileNode)
 	for _, m := range session.Manifests {
 		for _, node := range m.Files {
-			finalFileSet[node.GetPath()] = node
+			targetPath := node.GetPath()
+			if rootName != "" {
+				rel, ok := strings.CutPrefix(targetPath, rootName+"/")
+				if !ok {
+					continue
+				}
+				targetPath = rel
+			}
+			finalFileSet[targetPath] = node
 		}
 	}
 	fmt.Printf("文件将恢复到: %s\n分析完成，共需恢复 %d 个文件。\n", fullRestorePath, len(finalFileSet))
 
-	filesBySourcePackage := make(map[string][]*types.FileNode)
-	for _, node := range finalFileSet {
+	filesBySourcePackage := make(map[string][]restoreItem)
+	var chunkedFiles []restoreItem // 按块存储的文件，在其余文件之后由块包拼接
+	for targetPath, node := range finalFileSet {
 		if node.IsDirectory() {
 			continue
 		}
+		if len(node.Chunks) > 0 {
+			chunkedFiles = append(chunkedFiles, restoreItem{node: node, targetPath: targetPath})
+			continue
+		}
 		parts := strings.SplitN(node.Reference, "/", 2)
 		if len(parts) < 2 {
 			fmt.Printf("警告: 文件 '%s' 引用格式错误: '%s'，跳过。\n", node.Path, node.Reference)
 			continue
 		}
 		sourcePackageIdentifier := parts[0]
-		basePackageNameWithTS := strings.TrimSuffix(strings.TrimSuffix(sourcePackageIdentifier, ".001"), ".7z")
+		basePackageNameWithTS := archive.BaseName(sourcePackageIdentifier)
 
-		filesBySourcePackage[basePackageNameWithTS] = append(filesBySourcePackage[basePackageNameWithTS], node)
+		filesBySourcePackage[basePackageNameWithTS] = append(filesBySourcePackage[basePackageNameWithTS], restoreItem{node: node, targetPath: targetPath})
 	}
 
 	tempBaseDir := filepath.Join(fullRestorePath, ".beanckup_temp_restore")
 	if err := os.MkdirAll(tempBaseDir, 0755); err != nil {
-		return fmt.Errorf("无法创建临时恢复目录: %w", err)
+		return "", fmt.Errorf("无法创建临时恢复目录: %w", err)
 	}
 	defer os.RemoveAll(tempBaseDir)
 
+	// 解压开始前先对照会话索引完整校验所需的包，分卷缺失、被截断或被替换的包不予解压
+	r.verifyPackages(filesBySourcePackage)
+
 	for basePackageNameWithTS, files := range filesBySourcePackage {
 		sourcePackagePath, ok := r.allPackages[basePackageNameWithTS]
 		if !ok {
@@ -204,30 +452,20 @@ func (r *Restorer) RestoreFromSession(session *DeliverySession, restorePath, pas
 
 		fmt.Printf("\n正在从包: %s 恢复 %d 个文件...\n", filepath.Base(sourcePackagePath), len(files))
 
-		tempListFile, _ := os.CreateTemp(tempBaseDir, "listfile-*.txt")
-		for _, node := range files {
-			pathInPackage := strings.SplitN(node.Reference, "/", 2)[1]
-			io.WriteString(tempListFile, filepath.ToSlash(pathInPackage)+"\n")
-		}
-		tempListFile.Close()
-
-		args := []string{"x", sourcePackagePath, "-o" + tempBaseDir, "-aoa", "@" + tempListFile.Name()}
-		if password != "" {
-			args = append(args, "-p"+password)
+		var names []string
+		for _, item := range files {
+			names = append(names, strings.SplitN(item.node.Reference, "/", 2)[1])
 		}
-
-		cmd := exec.Command("7z", args...)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			fmt.Printf("警告: 7z 批量解压失败 (包: %s): %s\n", filepath.Base(sourcePackagePath), string(output))
-			os.Remove(tempListFile.Name())
+		if err := r.archiverFor(basePackageNameWithTS).Extract(sourcePackagePath, names, tempBaseDir, password); err != nil {
+			fmt.Printf("警告: 批量解压失败 (包: %s): %v\n", filepath.Base(sourcePackagePath), err)
 			continue
 		}
-		os.Remove(tempListFile.Name())
 
-		for _, node := range files {
+		for _, item := range files {
+			node := item.node
 			pathInPackage := strings.SplitN(node.Reference, "/", 2)[1]
 			tempPath := filepath.Join(tempBaseDir, pathInPackage)
-			finalPath := filepath.Join(fullRestorePath, node.Path)
+			finalPath := filepath.Join(fullRestorePath, filepath.FromSlash(item.targetPath))
 
 			if _, err := os.Stat(tempPath); os.IsNotExist(err) {
 				fmt.Printf("警告: 临时文件 '%s' 不存在。\n", tempPath)
@@ -247,10 +485,104 @@ func (r *Restorer) RestoreFromSession(session *DeliverySession, restorePath, pas
 		}
 	}
 
+	r.restoreChunkedFiles(chunkedFiles, tempBaseDir, fullRestorePath, password)
+
 	fmt.Println("\n恢复完成。")
+	return fullRestorePath, nil
+}
+
+// verifyPackages 重新计算所需各包分卷的哈希并与会话索引比对，将未通过校验的包从待解压列表中移除。
+// 没有会话索引记录的包 (旧版本交付的包) 不做检查。
+func (r *Restorer) verifyPackages(filesBySourcePackage map[string][]restoreItem) {
+	var names []string
+	for basePackageNameWithTS := range filesBySourcePackage {
+		if _, ok := r.inventory[basePackageNameWithTS]; ok {
+			if _, found := r.allPackages[basePackageNameWithTS]; found {
+				names = append(names, basePackageNameWithTS)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	fmt.Printf("正在校验 %d 个交付包...\n", len(names))
+	for _, name := range names {
+		pkg := r.inventory[name]
+		problems := pkg.Check(filepath.Dir(r.allPackages[name]), true)
+		if len(problems) == 0 {
+			continue
+		}
+		fmt.Printf("警告: 交付包 %s 未通过校验，跳过其中的 %d 个文件:\n", pkg.Name, len(filesBySourcePackage[name]))
+		for _, problem := range problems {
+			fmt.Printf("  - %s\n", problem)
+		}
+		delete(filesBySourcePackage, name)
+	}
+}
+
+// restoreIndexes 将交付目录中该工作区截至指定会话的会话索引复制到 .beanckup/indexes 下
+func (r *Restorer) restoreIndexes(workspaceName string, sessionID int, beanckupDir string) {
+	for id, path := range r.indexFiles {
+		if id > sessionID {
+			continue
+		}
+		index, err := inventory.Load(path)
+		if err != nil || index.WorkspaceName != workspaceName {
+			continue
+		}
+		dst := inventory.MetadataPath(beanckupDir, index.WorkspaceName, index.SessionID)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			fmt.Printf("警告: 无法恢复会话索引: %v\n", err)
+			return
+		}
+		for _, pair := range [][2]string{{path, dst}, {signing.SigPath(path), signing.SigPath(dst)}} {
+			data, err := os.ReadFile(pair[0])
+			if err != nil {
+				continue
+			}
+			if err := os.WriteFile(pair[1], data, 0644); err != nil {
+				fmt.Printf("警告: 恢复会话索引 %s 失败: %v\n", filepath.Base(path), err)
+			}
+		}
+	}
+}
+
+// restoreManifest 将历史清单写回恢复目录的 .beanckup。读取时保留了原始内容的清单原样写回 (连同签名)。
+func (r *Restorer) restoreManifest(m *types.Manifest, beanckupDir string) error {
+	raw, ok := r.rawManifests[m]
+	if !ok {
+		_, err := manifest.SaveManifest(m, beanckupDir)
+		return err
+	}
+	path := filepath.Join(beanckupDir, raw.name)
+	if err := os.WriteFile(path, raw.data, 0644); err != nil {
+		return err
+	}
+	if len(raw.sig) > 0 {
+		return os.WriteFile(signing.SigPath(path), raw.sig, 0644)
+	}
 	return nil
 }
 
+// noteArchiver 记录清单中写入其包的归档后端
+func (r *Restorer) noteArchiver(m *types.Manifest) {
+	if m.PackageName != "" && m.Archiver != "" {
+		r.archivers[archive.BaseName(m.PackageName)] = m.Archiver
+	}
+}
+
+// archiverFor 返回读取指定包使用的后端: 优先使用清单中记录的后端，没有记录时按包的扩展名判断
+func (r *Restorer) archiverFor(basePackageNameWithTS string) archive.Archiver {
+	return archive.ForFormat(r.archivers[basePackageNameWithTS], r.allPackages[basePackageNameWithTS])
+}
+
+// restoreItem 是一个待恢复的文件及其在恢复目录内的目标路径
+type restoreItem struct {
+	node       *types.FileNode
+	targetPath string
+}
+
 func moveFile(src, dst string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return err
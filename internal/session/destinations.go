@@ -0,0 +1,81 @@
+package session
+
+import (
+	"beanckup-cli/internal/types"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Destinations 返回全部交付目录，主交付目录在前
+func (p *DeliveryParams) Destinations() []string {
+	return append([]string{p.DeliveryPath}, p.Mirrors...)
+}
+
+// DestinationAvailable 判断交付目录当前是否可用，即目录本身已存在。
+// 镜像目录从不自动创建: 网络存储或移动硬盘未挂载时，其挂载点往往仍是一个本地空目录，
+// 在其中创建交付目录会把副本写到本地磁盘上，并且不会再被补齐。
+func DestinationAvailable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// CreateDeliveryPath 在主交付目录不存在、但其上级目录存在时创建它 (例如默认的 ./delivery)。
+// 上级目录也不存在时 (例如移动硬盘未挂载) 不创建，该目录保持不可用。
+func CreateDeliveryPath(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("无法创建交付目录 %s: %w", path, err)
+	}
+	return nil
+}
+
+// AddDestinations 将交付目录加入计划中各包的记录，已记录的目录保留原有状态。
+// 在记录交付目录之前就已完成的包 (由旧版本创建的计划) 不知道位于何处，不参与补齐。
+func AddDestinations(plan *types.Plan, paths []string) {
+	for i := range plan.Episodes {
+		episode := &plan.Episodes[i]
+		if episode.Status == types.EpisodeStatusCompleted && len(episode.Destinations) == 0 {
+			continue
+		}
+		for _, path := range paths {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			if destinationIndex(episode, path) < 0 {
+				episode.Destinations = append(episode.Destinations, types.DestinationStatus{Path: path, Status: types.EpisodeStatusPending})
+			}
+		}
+	}
+}
+
+// MarkDestination 将包在某个交付目录中的状态标记为已完成
+func MarkDestination(episode *types.Episode, path string) {
+	if i := destinationIndex(episode, path); i >= 0 {
+		episode.Destinations[i].Status = types.EpisodeStatusCompleted
+	}
+}
+
+// BuildDestination 返回本次打包写入的目录: 第一个尚未写入且当前可用的交付目录，没有时返回空字符串
+func BuildDestination(episode *types.Episode) string {
+	for _, path := range episode.PendingDestinations() {
+		if DestinationAvailable(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func destinationIndex(episode *types.Episode, path string) int {
+	for i, d := range episode.Destinations {
+		if d.Path == path {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,73 @@
+package session
+
+import (
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"fmt"
+	"path/filepath"
+)
+
+// MediumReserveBytes 是换盘模式下为会话索引和文件系统开销在每张介质上保留的空间
+const MediumReserveBytes = 8 * 1024 * 1024
+
+// MediumLimit 返回本张介质可交付的字节数: 剩余空间减去保留空间，同时不超过总大小限制 (0 表示无限制)。
+// 返回值至少为 1，以免被当作无限制。
+func MediumLimit(media *util.MediaInfo, totalLimitBytes int64) int64 {
+	limit := max(media.FreeBytes-MediumReserveBytes, 1)
+	if totalLimitBytes > 0 && totalLimitBytes < limit {
+		limit = totalLimitBytes
+	}
+	return limit
+}
+
+// VolumeLimitMB 返回打包时使用的分卷大小: 介质的文件系统限制了单个文件的大小 (如 FAT32) 时，
+// 分卷不超过该限制；media 为 nil 时即计划的单包大小限制。
+func VolumeLimitMB(packageSizeLimitMB int, media *util.MediaInfo) int {
+	if media == nil || media.MaxFileBytes <= 0 {
+		return packageSizeLimitMB
+	}
+	maxMB := int(media.MaxFileBytes / 1024 / 1024)
+	if packageSizeLimitMB == 0 || packageSizeLimitMB > maxMB {
+		return maxMB
+	}
+	return packageSizeLimitMB
+}
+
+// PrimaryDestination 返回换盘模式下包写入的目录 (主交付目录)，该目录已有此包或当前不可用时返回空字符串
+func PrimaryDestination(episode *types.Episode, deliveryPath string) string {
+	if abs, err := filepath.Abs(deliveryPath); err == nil {
+		deliveryPath = abs
+	}
+	if i := destinationIndex(episode, deliveryPath); i < 0 || episode.Destinations[i].Status == types.EpisodeStatusCompleted {
+		return ""
+	}
+	if !DestinationAvailable(deliveryPath) {
+		return ""
+	}
+	return deliveryPath
+}
+
+// LastMedium 返回计划中已使用的最大介质序号
+func LastMedium(plan *types.Plan) int {
+	last := 0
+	for _, episode := range plan.Episodes {
+		last = max(last, episode.Medium)
+	}
+	return last
+}
+
+// CountOnMedium 统计写入某张介质的包数量
+func CountOnMedium(plan *types.Plan, medium int) int {
+	count := 0
+	for _, episode := range plan.Episodes {
+		if episode.Medium == medium {
+			count++
+		}
+	}
+	return count
+}
+
+// MediumLabel 返回介质的标签，如 "Photos-S05-M02"
+func MediumLabel(workspaceName string, sessionID, medium int) string {
+	return fmt.Sprintf("%s-S%02d-M%02d", workspaceName, sessionID, medium)
+}
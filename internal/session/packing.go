@@ -0,0 +1,146 @@
+package session
+
+import (
+	"beanckup-cli/internal/types"
+	"sort"
+	"strings"
+)
+
+// packItem 是分包时不再拆分的一组文件，size 为其规划大小之和
+type packItem struct {
+	files []*types.FileNode
+	size  int64
+}
+
+func fileItems(files []*types.FileNode) []packItem {
+	items := make([]packItem, 0, len(files))
+	for _, file := range files {
+		items = append(items, packItem{files: []*types.FileNode{file}, size: file.PlannedSize()})
+	}
+	return items
+}
+
+// packFirstFitDecreasing 按大小从大到小依次将每组文件放入第一个放得下的包，
+// 都放不下时开始新包；超过限制的一组单独成包。包内的文件仍按路径排序。
+func packFirstFitDecreasing(items []packItem, packageSizeLimitBytes int64) []types.Episode {
+	sort.SliceStable(items, func(i, j int) bool { return items[i].size > items[j].size })
+
+	var episodes []types.Episode
+	for _, item := range items {
+		target := -1
+		if item.size <= packageSizeLimitBytes {
+			for i := range episodes {
+				if episodes[i].EstimatedSize+item.size <= packageSizeLimitBytes {
+					target = i
+					break
+				}
+			}
+		}
+		if target < 0 {
+			episodes = append(episodes, types.Episode{})
+			target = len(episodes) - 1
+		}
+		for _, file := range item.files {
+			addFile(&episodes[target], file)
+		}
+	}
+	for i := range episodes {
+		files := episodes[i].Files
+		sort.Slice(files, func(a, b int) bool { return files[a].Path < files[b].Path })
+	}
+	return episodes
+}
+
+// packLocality 以顶层目录为单位分包，尽量让同一目录的文件位于同一个包中，使恢复单个目录时涉及的包尽可能少。
+// 放得进一个包的目录整体参与首次适应递减；超过限制的目录先按路径顺序切出装满的包，剩余部分再参与分配。
+// 结果按各包中第一个文件的路径排序。
+func packLocality(newFiles []*types.FileNode, packageSizeLimitBytes int64) []types.Episode {
+	newFiles = append([]*types.FileNode{}, newFiles...)
+	sort.SliceStable(newFiles, func(i, j int) bool { return newFiles[i].Path < newFiles[j].Path })
+
+	var groups []packItem
+	var current *packItem
+	currentDir := ""
+	for _, file := range newFiles { // 按路径排序后同一目录的文件相邻
+		dir := topLevelDir(file.Path)
+		if current == nil || dir != currentDir {
+			groups = append(groups, packItem{})
+			current = &groups[len(groups)-1]
+			currentDir = dir
+		}
+		current.files = append(current.files, file)
+		current.size += file.PlannedSize()
+	}
+
+	var episodes []types.Episode
+	var items []packItem
+	for _, group := range groups {
+		if group.size <= packageSizeLimitBytes {
+			items = append(items, group)
+			continue
+		}
+		chunks := packSequential(group.files, packageSizeLimitBytes)
+		last := chunks[len(chunks)-1]
+		if last.EstimatedSize <= packageSizeLimitBytes {
+			chunks = chunks[:len(chunks)-1]
+			items = append(items, packItem{files: last.Files, size: last.EstimatedSize})
+		}
+		episodes = append(episodes, chunks...)
+	}
+	episodes = append(episodes, packFirstFitDecreasing(items, packageSizeLimitBytes)...)
+
+	sort.SliceStable(episodes, func(i, j int) bool { return episodes[i].Files[0].Path < episodes[j].Files[0].Path })
+	return episodes
+}
+
+// topLevelDir 返回路径的第一级目录，位于根目录的文件返回空字符串
+func topLevelDir(path string) string {
+	if dir, _, ok := strings.Cut(path, "/"); ok {
+		return dir
+	}
+	return ""
+}
+
+// FillEfficiency 返回计划中各包对包大小限制的平均利用率 (0-1)，按各包的规划大小计算，
+// 超过限制的包按其分卷数计算容量。未设置包大小限制或没有新文件时返回 1。
+func FillEfficiency(plan *types.Plan) float64 {
+	limit := int64(plan.PackageSizeLimitMB) * 1024 * 1024
+	if limit <= 0 || len(plan.Episodes) == 0 {
+		return 1
+	}
+	var used, capacity int64
+	for _, episode := range plan.Episodes {
+		size := episode.PlannedSize()
+		volumes := (size + limit - 1) / limit
+		if volumes == 0 {
+			volumes = 1
+		}
+		used += size
+		capacity += volumes * limit
+	}
+	return float64(used) / float64(capacity)
+}
+
+// SplitDirectories 返回新文件分布在多个包中的顶层目录数
+func SplitDirectories(plan *types.Plan) int {
+	episodesByDir := make(map[string]map[int]bool)
+	for _, episode := range plan.Episodes {
+		for _, file := range episode.Files {
+			dir := topLevelDir(file.Path)
+			if dir == "" {
+				continue
+			}
+			if episodesByDir[dir] == nil {
+				episodesByDir[dir] = make(map[int]bool)
+			}
+			episodesByDir[dir][episode.ID] = true
+		}
+	}
+	split := 0
+	for _, episodes := range episodesByDir {
+		if len(episodes) > 1 {
+			split++
+		}
+	}
+	return split
+}
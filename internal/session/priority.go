@@ -0,0 +1,72 @@
+package session
+
+import (
+	"beanckup-cli/internal/types"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// priorityTiers 按优先级规则将新文件分组，返回的各组按优先级从高到低排列，组内按 Order 排序。
+// 没有规则时所有文件为同一组。
+func priorityTiers(files []*types.FileNode, priority types.PriorityConfig, now time.Time) [][]*types.FileNode {
+	tiers := make([][]*types.FileNode, len(priority.Rules)+1)
+	for _, file := range files {
+		tier := len(priority.Rules)
+		for i, rule := range priority.Rules {
+			if matchRule(rule, file, now) {
+				tier = i
+				break
+			}
+		}
+		tiers[tier] = append(tiers[tier], file)
+	}
+	for _, tier := range tiers {
+		sortTier(tier, priority.Order)
+	}
+	return tiers
+}
+
+// matchRule 判断文件是否满足规则中设置的全部条件
+func matchRule(rule types.PriorityRule, file *types.FileNode, now time.Time) bool {
+	if rule.Path != "" && !matchPath(rule.Path, file.Path) {
+		return false
+	}
+	if rule.NewerThanDays > 0 && file.ModTime.Before(now.AddDate(0, 0, -rule.NewerThanDays)) {
+		return false
+	}
+	if rule.MaxSizeMB > 0 && file.Size > int64(rule.MaxSizeMB)*1024*1024 {
+		return false
+	}
+	return true
+}
+
+// matchPath 判断清单路径是否匹配规则中的路径: 可以是目录前缀，也可以是匹配完整路径的通配符
+func matchPath(pattern, nodePath string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if strings.HasPrefix(nodePath, pattern+"/") || nodePath == pattern {
+		return true
+	}
+	matched, _ := path.Match(pattern, nodePath)
+	return matched
+}
+
+func sortTier(files []*types.FileNode, order string) {
+	switch order {
+	case "newest":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	case "smallest":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size < files[j].Size })
+	}
+}
+
+// HasPriorities 判断计划中是否有不同优先级的包
+func HasPriorities(plan *types.Plan) bool {
+	for _, episode := range plan.Episodes {
+		if episode.Priority > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package session
+
+import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/manifest"
+	"beanckup-cli/internal/types"
+	"beanckup-cli/internal/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scanStateDir 是保存扫描状态的子目录。扫描状态是创建计划时扫描到的完整节点列表，
+// 以紧凑清单格式保存，使中断后恢复的交付仍能写出与未中断时相同的清单。
+const scanStateDir = "scans"
+
+// SaveScanState 将计划的扫描结果 (AllNodes) 写入元数据目录，并在计划中记录其相对路径和 SHA-256
+func SaveScanState(beanckupDir string, plan *types.Plan) error {
+	dir := filepath.Join(beanckupDir, scanStateDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("无法创建扫描状态目录: %w", err)
+	}
+	name := fmt.Sprintf("S%04d_%s%s", plan.SessionID, plan.Timestamp.Format("060102_150405"), manifest.CompactExt)
+	finalPath := filepath.Join(dir, name)
+
+	state := &types.Manifest{
+		FormatVersion: manifest.FormatVersion,
+		SessionID:     plan.SessionID,
+		Timestamp:     plan.Timestamp.UTC().Format(time.RFC3339),
+		Files:         plan.AllNodes,
+	}
+	hasher := sha256.New()
+	err := util.WriteAtomic(finalPath, func(w io.Writer) error {
+		return manifest.WriteCompact(state, io.MultiWriter(w, hasher))
+	})
+	if err != nil {
+		return fmt.Errorf("写入扫描状态失败: %w", err)
+	}
+	plan.ScanStatePath = filepath.ToSlash(filepath.Join(scanStateDir, name))
+	plan.ScanStateSHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return nil
+}
+
+// LoadScanState 为从状态文件恢复的计划重新载入 AllNodes。
+// 扫描状态中与各 episode 文件路径相同的节点替换为 episode 中的节点，与未中断时共享同一份节点。
+func LoadScanState(beanckupDir string, plan *types.Plan) error {
+	if plan.ScanStatePath == "" {
+		return fmt.Errorf("交付计划中没有记录扫描状态 (由旧版本创建)")
+	}
+	data, err := os.ReadFile(filepath.Join(beanckupDir, filepath.FromSlash(plan.ScanStatePath)))
+	if err != nil {
+		return fmt.Errorf("无法读取扫描状态: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != plan.ScanStateSHA256 {
+		return fmt.Errorf("扫描状态文件 %s 与计划中记录的校验值不符", plan.ScanStatePath)
+	}
+	state, err := manifest.ParseManifest(data)
+	if err != nil {
+		return fmt.Errorf("无法解析扫描状态: %w", err)
+	}
+
+	episodeNodes := make(map[string]*types.FileNode)
+	for _, episode := range plan.Episodes {
+		for _, node := range episode.Files {
+			episodeNodes[node.GetPath()] = node
+		}
+	}
+	nodes := make([]*types.FileNode, 0, len(state.Files))
+	for _, node := range state.Files {
+		if shared, ok := episodeNodes[node.GetPath()]; ok {
+			node = shared
+		}
+		nodes = append(nodes, node)
+	}
+	plan.AllNodes = nodes
+	return nil
+}
+
+// RemoveScanState 删除计划的扫描状态文件
+func RemoveScanState(beanckupDir string, plan *types.Plan) {
+	if plan.ScanStatePath != "" {
+		os.Remove(filepath.Join(beanckupDir, filepath.FromSlash(plan.ScanStatePath)))
+	}
+}
+
+// ReferenceFiles 返回扫描时已有备份的文件 (未变化或被移动的文件)，写入 E1 清单。
+// 本会话中新交付的文件不包括在内，因此结果与各 episode 的交付顺序以及是否中断过无关。
+func ReferenceFiles(plan *types.Plan) []*types.FileNode {
+	newPaths := make(map[string]bool)
+	for _, episode := range plan.Episodes {
+		for _, node := range episode.Files {
+			newPaths[node.GetPath()] = true
+		}
+	}
+	var files []*types.FileNode
+	for _, node := range types.FilterReferenceFiles(plan.AllNodes) {
+		if !newPaths[node.GetPath()] {
+			files = append(files, node)
+		}
+	}
+	return files
+}
+
+// ResetUnfinishedEpisodes 清除未完成 episode 中文件在上次尝试时设置的引用，
+// 并返回这些 episode 上次尝试使用的包名，以便清理残留的清单和包文件
+func ResetUnfinishedEpisodes(plan *types.Plan) []string {
+	var packageNames []string
+	for i := range plan.Episodes {
+		episode := &plan.Episodes[i]
+		if episode.Status == types.EpisodeStatusCompleted {
+			continue
+		}
+		if name := ResetEpisode(episode); name != "" {
+			packageNames = append(packageNames, name)
+		}
+	}
+	return packageNames
+}
+
+// ResetEpisode 将一个未完成的 episode 恢复为待交付状态: 清除其文件的引用 (包括位于该包内的块的位置) 和包名，返回原包名
+func ResetEpisode(episode *types.Episode) string {
+	for _, node := range episode.Files {
+		node.Reference = ""
+		for i := range node.Chunks {
+			pkg, _, _ := strings.Cut(node.Chunks[i].Reference, "/")
+			if episode.PackageName != "" && archive.BaseName(pkg) == archive.BaseName(episode.PackageName) {
+				node.Chunks[i].Reference, node.Chunks[i].Offset = "", 0
+			}
+		}
+	}
+	packageName := episode.PackageName
+	episode.PackageName = ""
+	if episode.Status == types.EpisodeStatusInProgress {
+		episode.Status = types.EpisodeStatusPending
+	}
+	return packageName
+}
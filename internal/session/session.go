@@ -2,7 +2,6 @@ package session
 
 import (
 	"beanckup-cli/internal/types"
-	"beanckup-cli/internal/util"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -18,16 +17,25 @@ type DeliveryParams struct {
 	PackageSizeLimitMB int
 	TotalSizeLimitMB   int
 	CompressionLevel   int
+	CompressionMethod  types.CompressionMethod // 可压缩文件使用的压缩方法
+	PackingMode        types.PackingMode       // 新文件分配到各包的方式
 	Password           string
+	Mirrors            []string          // 镜像交付目录: 每个包只打包一次，之后复制到这些目录并校验
+	SpanMedia          bool              // 换盘模式: 按主交付目录所在介质的剩余空间交付，写满后提示更换介质
+	ParallelEpisodes   int               // 同时打包的包数，0 或 1 表示逐个打包
+	Archiver           string            // 交付包格式 ("7z" 或 "native")，空表示自动选择
+	Note               types.SessionNote // 本会话的标签、备注和标记
 }
 
-// CreatePlan 根据扫描结果创建交付计划
-func CreatePlan(sessionID int, allNodes []*types.FileNode, packageSizeLimitMB int) *types.Plan {
+// CreatePlan 根据扫描结果创建交付计划。新文件先按优先级规则分组，每组再按 mode 指定的方式分配到各个 episode，
+// 优先级高的 episode 排在前面，受总大小限制时先被交付。
+func CreatePlan(sessionID int, allNodes []*types.FileNode, packageSizeLimitMB int, mode types.PackingMode, priority types.PriorityConfig) *types.Plan {
 	plan := &types.Plan{
-		SessionID: sessionID,
-		Timestamp: time.Now(),
-		Episodes:  []types.Episode{},
-		AllNodes:  allNodes, // 存储所有扫描节点，用于后续逻辑
+		SessionID:   sessionID,
+		Timestamp:   time.Now(),
+		Episodes:    []types.Episode{},
+		AllNodes:    allNodes, // 存储所有扫描节点，用于后续逻辑
+		PackingMode: mode,
 	}
 
 	newFiles := types.FilterNewFiles(allNodes)
@@ -50,48 +58,32 @@ func CreatePlan(sessionID int, allNodes []*types.FileNode, packageSizeLimitMB in
 	var episodes []types.Episode
 	packageSizeLimitBytes := int64(packageSizeLimitMB) * 1024 * 1024
 
-	// 如果不分包，所有文件放入一个 episode
-	if packageSizeLimitMB <= 0 {
-		episodes = append(episodes, types.Episode{
-			Files:     newFiles,
-			TotalSize: totalNewSize,
-		})
-	} else {
-		// 实现基于路径的顺序填充逻辑
-		if len(newFiles) > 0 {
-			currentEpisode := types.Episode{Files: []*types.FileNode{}, TotalSize: 0}
-			for _, file := range newFiles {
-				// 如果是超大文件，则它自己单独成为一个 episode
-				if file.Size > packageSizeLimitBytes {
-					if len(currentEpisode.Files) > 0 {
-						episodes = append(episodes, currentEpisode)
-					}
-					episodes = append(episodes, types.Episode{
-						Files:     []*types.FileNode{file},
-						TotalSize: file.Size,
-					})
-					currentEpisode = types.Episode{Files: []*types.FileNode{}, TotalSize: 0}
-					continue
-				}
-
-				// 如果当前 episode 加上新文件会超限
-				if currentEpisode.TotalSize+file.Size > packageSizeLimitBytes {
-					episodes = append(episodes, currentEpisode)
-					currentEpisode = types.Episode{
-						Files:     []*types.FileNode{file},
-						TotalSize: file.Size,
-					}
-				} else {
-					// 否则，将文件加入当前 episode
-					currentEpisode.Files = append(currentEpisode.Files, file)
-					currentEpisode.TotalSize += file.Size
-				}
+	for tier, files := range priorityTiers(newFiles, priority, plan.Timestamp) {
+		if len(files) == 0 {
+			continue
+		}
+		var tierEpisodes []types.Episode
+		// 如果不分包，同一优先级的文件放入一个 episode
+		if packageSizeLimitMB <= 0 {
+			single := types.Episode{}
+			for _, file := range files {
+				addFile(&single, file)
 			}
-			// 不要忘记循环结束后最后一个正在构建的 episode
-			if len(currentEpisode.Files) > 0 {
-				episodes = append(episodes, currentEpisode)
+			tierEpisodes = append(tierEpisodes, single)
+		} else {
+			switch mode {
+			case types.PackingFFD:
+				tierEpisodes = packFirstFitDecreasing(fileItems(files), packageSizeLimitBytes)
+			case types.PackingLocality:
+				tierEpisodes = packLocality(files, packageSizeLimitBytes)
+			default:
+				tierEpisodes = packSequential(files, packageSizeLimitBytes)
 			}
 		}
+		for i := range tierEpisodes {
+			tierEpisodes[i].Priority = tier
+		}
+		episodes = append(episodes, tierEpisodes...)
 	}
 
 	for i := range episodes {
@@ -103,52 +95,131 @@ func CreatePlan(sessionID int, allNodes []*types.FileNode, packageSizeLimitMB in
 	return plan
 }
 
-// ApplyTotalSizeLimitToPlan 根据总大小限制更新 plan 中各个 episode 的状态
-func ApplyTotalSizeLimitToPlan(plan *types.Plan, totalSizeLimitMB int) {
-	if totalSizeLimitMB <= 0 {
-		for i := range plan.Episodes {
-			if plan.Episodes[i].Status != types.EpisodeStatusCompleted {
-				plan.Episodes[i].Status = types.EpisodeStatusPending
+// packSequential 按路径顺序填充: 当前包放不下下一个文件时开始新包，超过限制的文件单独成包。
+// 是否放得下按文件的规划大小 (有估算时为压缩后的估算大小) 判断。
+func packSequential(newFiles []*types.FileNode, packageSizeLimitBytes int64) []types.Episode {
+	var episodes []types.Episode
+	currentEpisode := types.Episode{Files: []*types.FileNode{}, TotalSize: 0}
+	for _, file := range newFiles {
+		// 如果是超大文件，则它自己单独成为一个 episode
+		if file.PlannedSize() > packageSizeLimitBytes {
+			if len(currentEpisode.Files) > 0 {
+				episodes = append(episodes, currentEpisode)
 			}
+			single := types.Episode{}
+			addFile(&single, file)
+			episodes = append(episodes, single)
+			currentEpisode = types.Episode{Files: []*types.FileNode{}, TotalSize: 0}
+			continue
 		}
-		return
+
+		// 如果当前 episode 加上新文件会超限
+		if currentEpisode.EstimatedSize+file.PlannedSize() > packageSizeLimitBytes {
+			episodes = append(episodes, currentEpisode)
+			currentEpisode = types.Episode{}
+		}
+		addFile(&currentEpisode, file)
+	}
+	// 不要忘记循环结束后最后一个正在构建的 episode
+	if len(currentEpisode.Files) > 0 {
+		episodes = append(episodes, currentEpisode)
 	}
+	return episodes
+}
 
-	totalSizeLimitBytes := int64(totalSizeLimitMB) * 1024 * 1024
-	var cumulativeSize int64
+// addFile 将文件加入 episode 并更新其原始大小和规划大小
+func addFile(episode *types.Episode, file *types.FileNode) {
+	episode.Files = append(episode.Files, file)
+	episode.TotalSize += file.Size
+	episode.EstimatedSize += file.PlannedSize()
+}
 
+// RemoveFiles 从 episode 中移除指定的文件，并相应更新 episode 和计划的大小
+func RemoveFiles(plan *types.Plan, episode *types.Episode, nodes []*types.FileNode) {
+	toRemove := make(map[*types.FileNode]bool, len(nodes))
+	for _, node := range nodes {
+		toRemove[node] = true
+	}
+	var kept []*types.FileNode
+	for _, node := range episode.Files {
+		if toRemove[node] {
+			episode.TotalSize -= node.Size
+			episode.EstimatedSize -= node.PlannedSize()
+			plan.TotalNewSize -= node.Size
+			node.Reference = "" // 文件不再写入本包，其引用 (如已设置) 也随之失效
+			continue
+		}
+		kept = append(kept, node)
+	}
+	episode.Files = kept
+}
+
+// AppendEpisode 将文件重新规划为计划末尾的一个新 episode，并返回其 ID
+func AppendEpisode(plan *types.Plan, nodes []*types.FileNode) int {
+	maxID := 0
+	for _, ep := range plan.Episodes {
+		if ep.ID > maxID {
+			maxID = ep.ID
+		}
+	}
+	episode := types.Episode{ID: maxID + 1, Files: nodes, Status: types.EpisodeStatusPending}
+	for _, node := range nodes {
+		episode.TotalSize += node.Size
+		episode.EstimatedSize += node.PlannedSize()
+	}
+	plan.TotalNewSize += episode.TotalSize
+	plan.Episodes = append(plan.Episodes, episode)
+	return episode.ID
+}
+
+// ApplyTotalSizeLimitToPlan 根据总大小限制更新 plan 中各个 episode 的状态，已完成的 episode 计入总大小
+func ApplyTotalSizeLimitToPlan(plan *types.Plan, totalSizeLimitMB int) {
+	var cumulativeSize int64
 	for i := range plan.Episodes {
 		if plan.Episodes[i].Status == types.EpisodeStatusCompleted {
-			cumulativeSize += plan.Episodes[i].TotalSize
+			if plan.Episodes[i].ActualSize > 0 {
+				cumulativeSize += plan.Episodes[i].ActualSize
+			} else {
+				cumulativeSize += plan.Episodes[i].PlannedSize()
+			}
 		}
 	}
+	ScheduleEpisodes(plan, int64(totalSizeLimitMB)*1024*1024, cumulativeSize)
+}
 
+// ScheduleEpisodes 将未完成的 episode 按顺序标记为待交付或超出限制，limitBytes 为 0 表示无限制，
+// usedBytes 是已占用的大小。某个优先级中有 episode 放不下时，优先级更低的 episode 都不再安排，
+// 即使它们更小，使高优先级的文件总是先被交付。
+func ScheduleEpisodes(plan *types.Plan, limitBytes, usedBytes int64) {
+	blockedBelow := -1
 	for i := range plan.Episodes {
 		episode := &plan.Episodes[i]
 		if episode.Status == types.EpisodeStatusCompleted {
 			continue
 		}
+		if limitBytes <= 0 {
+			episode.Status = types.EpisodeStatusPending
+			continue
+		}
 
-		if cumulativeSize+episode.TotalSize <= totalSizeLimitBytes {
+		if (blockedBelow < 0 || episode.Priority <= blockedBelow) && usedBytes+episode.PlannedSize() <= limitBytes {
 			episode.Status = types.EpisodeStatusPending
+			usedBytes += episode.PlannedSize()
 		} else {
 			episode.Status = types.EpisodeStatusExceededLimit
-		}
-
-		if episode.Status == types.EpisodeStatusPending {
-			cumulativeSize += episode.TotalSize
+			if blockedBelow < 0 || episode.Priority < blockedBelow {
+				blockedBelow = episode.Priority
+			}
 		}
 	}
 }
 
-// SavePlan 保存交付计划到工作区，使用临时文件和重命名确保原子性
-func SavePlan(workspacePath string, plan *types.Plan) (string, error) {
-	beanckupDir := filepath.Join(workspacePath, ".beanckup")
+// SavePlan 保存交付计划到元数据目录，使用临时文件和重命名确保原子性
+func SavePlan(beanckupDir, workspaceName string, plan *types.Plan) (string, error) {
 	if err := os.MkdirAll(beanckupDir, 0755); err != nil {
 		return "", fmt.Errorf("无法创建 .beanckup 目录: %w", err)
 	}
 
-	workspaceName := util.GetWorkspaceName(workspacePath)
 	// 【核心修正】: 更新时间戳格式为 YYMMDD_HHMMSS
 	timestamp := plan.Timestamp.Format("060102_150405")
 	planFileName := fmt.Sprintf("Delivery_Status_%s_S%02d_%s.json", workspaceName, plan.SessionID, timestamp)
@@ -177,16 +248,15 @@ func SavePlan(workspacePath string, plan *types.Plan) (string, error) {
 		return "", fmt.Errorf("重命名计划文件失败: %w", err)
 	}
 
-	go cleanupOldStatusFiles(beanckupDir, plan.SessionID, planPath)
+	go cleanupOldStatusFiles(beanckupDir, workspaceName, plan.SessionID, planPath)
 	return planPath, nil
 }
 
-func cleanupOldStatusFiles(dir string, currentSessionID int, currentPlanPath string) {
+func cleanupOldStatusFiles(dir, workspaceName string, currentSessionID int, currentPlanPath string) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return
 	}
-	workspaceName := util.GetWorkspaceName(filepath.Dir(dir))
 	prefix := fmt.Sprintf("Delivery_Status_%s_S%02d_", workspaceName, currentSessionID)
 	for _, file := range files {
 		path := filepath.Join(dir, file.Name())
@@ -196,9 +266,8 @@ func cleanupOldStatusFiles(dir string, currentSessionID int, currentPlanPath str
 	}
 }
 
-// FindLatestPlan 查找最新的未完成的交付计划
-func FindLatestPlan(workspacePath string) (*types.Plan, string, error) {
-	beanckupDir := filepath.Join(workspacePath, ".beanckup")
+// FindLatestPlan 在元数据目录中查找最新的未完成的交付计划
+func FindLatestPlan(beanckupDir string) (*types.Plan, string, error) {
 	entries, err := os.ReadDir(beanckupDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -241,27 +310,21 @@ func FindLatestPlan(workspacePath string) (*types.Plan, string, error) {
 	return nil, "", nil
 }
 
-// CleanupIncompletePackages 清理与未完成的 episodes 相关的包文件
-func CleanupIncompletePackages(deliveryPath string, plan *types.Plan, workspaceName string) {
+// CleanupIncompletePackages 清理未完成的 episode 上次尝试时在交付目录中残留的包文件 (包括分卷)
+func CleanupIncompletePackages(deliveryPath string, packageNames []string) {
 	if _, err := os.Stat(deliveryPath); os.IsNotExist(err) {
 		return
 	}
-	for i := range plan.Episodes {
-		episode := &plan.Episodes[i]
-		if episode.Status != types.EpisodeStatusCompleted {
-			packageName := fmt.Sprintf("%s-S%02dE%02d.7z", workspaceName, plan.SessionID, episode.ID)
-			packagePath := filepath.Join(deliveryPath, packageName)
-
-			if _, err := os.Stat(packagePath); err == nil {
-				fmt.Printf("清理不完整的交付包: %s\n", packageName)
-				os.Remove(packagePath)
-			}
-
-			globPattern := packagePath + ".*"
-			if files, _ := filepath.Glob(globPattern); files != nil {
-				for _, f := range files {
-					os.Remove(f)
-				}
+	for _, packageName := range packageNames {
+		packagePath := filepath.Join(deliveryPath, packageName)
+		if _, err := os.Stat(packagePath); err == nil {
+			fmt.Printf("清理不完整的交付包: %s\n", packageName)
+			os.Remove(packagePath)
+		}
+		if files, _ := filepath.Glob(packagePath + ".[0-9][0-9][0-9]"); files != nil {
+			fmt.Printf("清理不完整的交付包分卷: %s.*\n", packageName)
+			for _, f := range files {
+				os.Remove(f)
 			}
 		}
 	}
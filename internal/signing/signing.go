@@ -0,0 +1,284 @@
+package signing
+
+import (
+	"beanckup-cli/internal/util"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 清单签名使用 Ed25519。私钥保存在用户配置目录 (而不是交付目录或 .beanckup) 中，
+// 每个被签名的文件旁边有一个同名加 .sig 后缀的分离签名文件，内容为签名者公钥和签名。
+const (
+	keyFile      = "signing.key"
+	pubFile      = "signing.pub"
+	settingsFile = "signing.json"
+
+	// SigExt 是分离签名文件的后缀
+	SigExt = ".sig"
+)
+
+var (
+	ErrUnsigned  = errors.New("没有签名")
+	ErrInvalid   = errors.New("签名无效，文件可能已被篡改")
+	ErrUntrusted = errors.New("签名者的公钥不在信任列表中")
+)
+
+// Settings 是用户配置目录中的签名设置
+type Settings struct {
+	// Strict 为 true 时拒绝没有签名或签名无效的清单，否则只给出警告
+	Strict bool `json:"strict"`
+	// TrustedKeys 是额外信任的公钥 (base64)，本机的签名公钥总是被信任
+	TrustedKeys []string `json:"trusted_keys,omitempty"`
+}
+
+// Policy 汇总本机的签名密钥和验证设置
+type Policy struct {
+	Strict  bool
+	signer  ed25519.PrivateKey
+	trusted map[string]bool
+
+	warnMu   sync.Mutex
+	unsigned map[string]bool // 已警告过没有签名的文件
+}
+
+// signatureFile 是 .sig 文件的内容
+type signatureFile struct {
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultPolicy *Policy
+)
+
+// Default 返回从用户配置目录加载的签名策略 (只加载一次)。
+// 设置文件存在但无法读取时按严格模式处理，以免在配置损坏时静默接受被篡改的清单。
+func Default() *Policy {
+	defaultOnce.Do(func() {
+		p, err := Load()
+		if err != nil {
+			log.Printf("错误: 无法加载签名设置，将按严格模式验证清单: %v", err)
+			p = &Policy{Strict: true, trusted: make(map[string]bool)}
+		}
+		defaultPolicy = p
+	})
+	return defaultPolicy
+}
+
+// ConfigDir 返回保存签名密钥和设置的目录
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("无法确定用户配置目录: %w", err)
+	}
+	return filepath.Join(dir, "beanckup"), nil
+}
+
+// Load 从用户配置目录读取签名密钥和设置，均不存在时返回一个不签名、不严格验证的策略
+func Load() (*Policy, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{trusted: make(map[string]bool)}
+
+	data, err := os.ReadFile(filepath.Join(dir, settingsFile))
+	if err == nil {
+		var settings Settings
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("解析 %s 失败: %w", settingsFile, err)
+		}
+		p.Strict = settings.Strict
+		for _, key := range settings.TrustedKeys {
+			if _, err := decodePublicKey(key); err != nil {
+				return nil, fmt.Errorf("信任列表中的公钥 '%s' 无效: %w", key, err)
+			}
+			p.trusted[strings.TrimSpace(key)] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("无法读取 %s: %w", settingsFile, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, keyFile))
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("签名私钥 %s 格式无效", keyFile)
+		}
+		p.signer = ed25519.NewKeyFromSeed(seed)
+		p.trusted[p.PublicKey()] = true
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("无法读取签名私钥: %w", err)
+	}
+	return p, nil
+}
+
+// GenerateKey 在用户配置目录中生成新的签名密钥对，已存在密钥时拒绝覆盖。返回公钥 (base64)。
+func GenerateKey() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, keyFile)); err == nil {
+		return "", fmt.Errorf("签名私钥已存在: %s", filepath.Join(dir, keyFile))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("无法创建配置目录: %w", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("生成密钥失败: %w", err)
+	}
+	pubText := base64.StdEncoding.EncodeToString(pub)
+	if err := os.WriteFile(filepath.Join(dir, keyFile), []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("无法保存签名私钥: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, pubFile), []byte(pubText+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("无法保存签名公钥: %w", err)
+	}
+	return pubText, nil
+}
+
+func decodePublicKey(text string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("不是有效的 Ed25519 公钥")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// CanSign 判断本机是否配置了签名私钥
+func (p *Policy) CanSign() bool {
+	return p.signer != nil
+}
+
+// PublicKey 返回本机签名公钥 (base64)，没有私钥时为空
+func (p *Policy) PublicKey() string {
+	if p.signer == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(p.signer.Public().(ed25519.PublicKey))
+}
+
+// SigPath 返回文件对应的分离签名文件路径
+func SigPath(path string) string {
+	return path + SigExt
+}
+
+// Sign 返回数据的分离签名文件内容
+func (p *Policy) Sign(data []byte) ([]byte, error) {
+	if p.signer == nil {
+		return nil, errors.New("未配置签名私钥")
+	}
+	return json.Marshal(&signatureFile{
+		Key:       p.PublicKey(),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(p.signer, data)),
+	})
+}
+
+// SignFile 为文件写入分离签名。没有签名私钥时删除可能残留的旧签名并直接返回。
+func (p *Policy) SignFile(path string) error {
+	if p.signer == nil {
+		os.Remove(SigPath(path))
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("无法读取待签名文件: %w", err)
+	}
+	sig, err := p.Sign(data)
+	if err != nil {
+		return err
+	}
+	// 原子地替换，验证签名的进程不会读到写了一半的签名
+	if err := util.WriteFileAtomic(SigPath(path), sig); err != nil {
+		return fmt.Errorf("无法写入签名文件: %w", err)
+	}
+	return nil
+}
+
+// Verify 用签名文件内容验证数据，sig 为空表示没有签名
+func (p *Policy) Verify(data, sig []byte) error {
+	if len(sig) == 0 {
+		return ErrUnsigned
+	}
+	var sf signatureFile
+	if err := json.Unmarshal(sig, &sf); err != nil {
+		return ErrInvalid
+	}
+	key, err := decodePublicKey(sf.Key)
+	if err != nil {
+		return ErrInvalid
+	}
+	signature, err := base64.StdEncoding.DecodeString(sf.Signature)
+	if err != nil || !ed25519.Verify(key, data, signature) {
+		return ErrInvalid
+	}
+	if !p.trusted[strings.TrimSpace(sf.Key)] {
+		return ErrUntrusted
+	}
+	return nil
+}
+
+// Check 按策略验证数据: 有签名但验证失败 (数据被修改或签名者不受信任) 时总是返回错误。
+// 没有签名的文件 (例如旧版本写入的清单) 只在严格模式下被拒绝，否则被接受；但本机配置了签名密钥或信任列表时
+// 签名可能是被删除的，每个文件警告一次。
+func (p *Policy) Check(name string, data, sig []byte) error {
+	err := p.Verify(data, sig)
+	if err == nil {
+		return nil
+	}
+	if p.Strict || !errors.Is(err, ErrUnsigned) {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if len(p.trusted) > 0 && p.warnUnsigned(name) {
+		log.Printf("警告: %s 没有签名，无法确认其未被篡改 (在 signing.json 中设置 \"strict\": true 可拒绝没有签名的文件)", name)
+	}
+	return nil
+}
+
+// warnUnsigned 记录没有签名的文件，首次遇到时返回 true
+func (p *Policy) warnUnsigned(name string) bool {
+	p.warnMu.Lock()
+	defer p.warnMu.Unlock()
+	if p.unsigned[name] {
+		return false
+	}
+	if p.unsigned == nil {
+		p.unsigned = make(map[string]bool)
+	}
+	p.unsigned[name] = true
+	return true
+}
+
+// IsVerificationError 判断错误是否由签名验证失败引起
+func IsVerificationError(err error) bool {
+	return errors.Is(err, ErrUnsigned) || errors.Is(err, ErrInvalid) || errors.Is(err, ErrUntrusted)
+}
+
+// ReadFile 读取文件，并按策略用其旁边的 .sig 文件验证。返回的正是经过验证的内容，
+// 调用方应解析这份内容，而不是再次读取文件。
+func (p *Policy) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取文件: %w", err)
+	}
+	sig, err := os.ReadFile(SigPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("无法读取签名文件: %w", err)
+	}
+	if err := p.Check(filepath.Base(path), data, sig); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
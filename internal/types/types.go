@@ -1,31 +1,208 @@
 package types
 
-import "time"
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
 
 // --- 配置相关 ---
 
 // Config 保存了用户的所有设置
 type Config struct {
-	WorkspacePath      string `json:"workspace_path"`
-	DeliveryPath       string `json:"delivery_path"`
-	RestorePath        string `json:"restore_path"`
-	PackageSizeLimitMB int    `json:"package_size_limit_mb"`
-	TotalSizeLimitMB   int    `json:"total_size_limit_mb"` // 0 表示无限制
-	CompressionLevel   int    `json:"compression_level"`
-	Password           string `json:"password"`
+	WorkspacePath      string         `json:"workspace_path"`
+	DeliveryPath       string         `json:"delivery_path"`
+	RestorePath        string         `json:"restore_path"`
+	PackageSizeLimitMB int            `json:"package_size_limit_mb"`
+	TotalSizeLimitMB   int            `json:"total_size_limit_mb"` // 0 表示无限制
+	CompressionLevel   int            `json:"compression_level"`
+	Password           string         `json:"password"`
+	Hooks              HookConfig     `json:"hooks"`
+	PackingMode        PackingMode    `json:"packing_mode,omitempty"` // 分包方式，空表示按路径顺序填充
+	Priority           PriorityConfig `json:"priority"`
+	ParallelEpisodes   int            `json:"parallel_episodes,omitempty"` // 同时打包的包数，0 或 1 表示逐个打包
+	Archiver           string         `json:"archiver,omitempty"`          // 交付包格式: "7z" 或 "native"，空表示已安装 7z 时使用 7z，否则使用 native
+	Chunking           ChunkingConfig `json:"chunking"`
+}
+
+// ChunkingConfig 是块级去重的设置。启用后，大文件按内容切分为块，每个不同的块只存储一次，
+// 大文件的少量修改只需交付变化的块。
+type ChunkingConfig struct {
+	Enabled   bool `json:"enabled,omitempty"`
+	MinFileMB int  `json:"min_file_mb,omitempty"` // 不小于此大小的文件按块存储，0 表示使用默认值 (64 MB)
+}
+
+// PriorityConfig 决定受总大小限制时哪些新文件先交付。
+// 文件按第一条匹配的规则分为若干优先级 (规则的顺序即优先级顺序)，不匹配任何规则的文件优先级最低。
+type PriorityConfig struct {
+	Rules []PriorityRule `json:"rules,omitempty"`
+	// Order 是同一优先级内文件的顺序: "path" (默认，按路径)、"newest" (最近修改的在前)、"smallest" (小文件在前)
+	Order string `json:"order,omitempty"`
+}
+
+// PriorityRule 是一条优先级规则，设置的各项条件须同时满足
+type PriorityRule struct {
+	Path          string `json:"path,omitempty"`            // 目录前缀或通配符，如 "Documents" 或 "*/reports/*.xlsx"
+	NewerThanDays int    `json:"newer_than_days,omitempty"` // 最近 N 天内修改过
+	MaxSizeMB     int    `json:"max_size_mb,omitempty"`     // 不超过 N MB
+}
+
+// HookConfig 定义在交付各阶段执行的外部命令，空字符串表示不执行
+type HookConfig struct {
+	PreScan     string `json:"pre_scan,omitempty"`     // 扫描工作区之前
+	PreEpisode  string `json:"pre_episode,omitempty"`  // 每个交付包打包之前
+	PostEpisode string `json:"post_episode,omitempty"` // 每个交付包打包之后 (无论成功与否)
+	PostSession string `json:"post_session,omitempty"` // 本次交付结束之后
+}
+
+// --- 备份集相关 ---
+
+// SourceRoot 是备份集中的一个源目录
+type SourceRoot struct {
+	Name string `json:"name"` // 命名空间前缀，清单中的路径形如 "name/相对路径"；单目录工作区为空
+	Path string `json:"path"` // 源目录的绝对路径
+}
+
+// BackupSet 描述一组共享同一份历史记录和清单链的源目录。
+// 单目录工作区是只有一个未命名源目录、元数据目录位于其 .beanckup 中的备份集。
+type BackupSet struct {
+	Name        string       `json:"name"`
+	MetadataDir string       `json:"metadata_dir,omitempty"` // 存放清单、计划等元数据的目录，可以位于源目录之外
+	Roots       []SourceRoot `json:"roots"`
+}
+
+// IsMultiRoot 判断备份集中的路径是否带有源目录命名空间
+func (s *BackupSet) IsMultiRoot() bool {
+	return len(s.Roots) != 1 || s.Roots[0].Name != ""
+}
+
+// RootNames 返回所有命名源目录的名称，单目录工作区返回 nil
+func (s *BackupSet) RootNames() []string {
+	if !s.IsMultiRoot() {
+		return nil
+	}
+	names := make([]string, 0, len(s.Roots))
+	for _, root := range s.Roots {
+		names = append(names, root.Name)
+	}
+	return names
+}
+
+// NodePath 将源目录内的相对路径转换为清单中使用的路径 (带命名空间，使用 / 分隔)
+func (s *BackupSet) NodePath(root *SourceRoot, relPath string) string {
+	relPath = filepath.ToSlash(relPath)
+	if root.Name == "" {
+		return relPath
+	}
+	return root.Name + "/" + relPath
+}
+
+// SplitPath 将清单中的路径拆分为所属源目录和源目录内的相对路径
+func (s *BackupSet) SplitPath(nodePath string) (*SourceRoot, string, bool) {
+	if !s.IsMultiRoot() {
+		return &s.Roots[0], nodePath, true
+	}
+	name, rel, _ := strings.Cut(nodePath, "/")
+	for i := range s.Roots {
+		if s.Roots[i].Name == name {
+			return &s.Roots[i], rel, true
+		}
+	}
+	return nil, "", false
+}
+
+// AbsPath 返回清单路径对应的文件在本机上的绝对路径
+func (s *BackupSet) AbsPath(nodePath string) string {
+	root, rel, ok := s.SplitPath(nodePath)
+	if !ok {
+		return ""
+	}
+	return filepath.Join(root.Path, filepath.FromSlash(rel))
+}
+
+// PackRoot 返回所有源目录的公共上级目录，打包时以它为工作目录，使包内路径在各源目录之间保持唯一
+func (s *BackupSet) PackRoot() (string, error) {
+	if len(s.Roots) == 0 {
+		return "", fmt.Errorf("备份集 '%s' 没有任何源目录", s.Name)
+	}
+	common := filepath.Clean(s.Roots[0].Path)
+	for _, root := range s.Roots[1:] {
+		for {
+			rel, err := filepath.Rel(common, root.Path)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			parent := filepath.Dir(common)
+			if parent == common {
+				return "", fmt.Errorf("源目录 '%s' 与其他源目录不在同一个卷上", root.Path)
+			}
+			common = parent
+		}
+	}
+	return common, nil
+}
+
+// PackPath 返回清单路径对应的文件在交付包内的路径
+func (s *BackupSet) PackPath(nodePath string) string {
+	if !s.IsMultiRoot() {
+		return nodePath
+	}
+	packRoot, err := s.PackRoot()
+	if err != nil {
+		return nodePath
+	}
+	rel, err := filepath.Rel(packRoot, s.AbsPath(nodePath))
+	if err != nil {
+		return nodePath
+	}
+	return filepath.ToSlash(rel)
 }
 
 // --- 文件与扫描相关 ---
 
+// CompressionMethod 表示单个文件在交付包中使用的压缩方式
+type CompressionMethod string
+
+const (
+	CompressionStore CompressionMethod = "store" // 仅存储，用于已压缩过的内容
+	CompressionLZMA2 CompressionMethod = "lzma2"
+	CompressionPPMd  CompressionMethod = "ppmd"
+	CompressionGzip  CompressionMethod = "gzip" // 原生格式 (archiver 为 native) 使用
+)
+
+// PackingMode 表示新文件分配到各交付包的方式
+type PackingMode string
+
+const (
+	PackingSequential PackingMode = "sequential" // 按路径顺序填充，放不下时开始新包
+	PackingFFD        PackingMode = "ffd"        // 首次适应递减，尽量减少包的数量
+	PackingLocality   PackingMode = "locality"   // 尽量将同一顶层目录的文件放在同一个包中
+)
+
 // FileNode 代表一个文件或目录在某个时间点的状态。
 type FileNode struct {
-	Path       string    `json:"path,omitempty"`       // 文件在工作区的相对路径 (e.g., "data/image.jpg")
-	Dir        string    `json:"dir,omitempty"`        // 目录路径，与path互斥
-	Size       int64     `json:"size,omitempty"`       // 文件大小
-	ModTime    time.Time `json:"mod_time,omitempty"`   // 修改时间
-	CreateTime time.Time `json:"create_time,omitempty"`// 创建时间
-	Hash       string    `json:"hash,omitempty"`       // 文件内容的 SHA256 哈希
-	Reference  string    `json:"reference,omitempty"`  // 格式: "packagename.7z/path/in/package.jpg"
+	Path        string            `json:"path,omitempty"`        // 文件在工作区的相对路径 (e.g., "data/image.jpg")
+	Dir         string            `json:"dir,omitempty"`         // 目录路径，与path互斥
+	Size        int64             `json:"size,omitempty"`        // 文件大小
+	ModTime     time.Time         `json:"mod_time,omitempty"`    // 修改时间
+	CreateTime  time.Time         `json:"create_time,omitempty"` // 创建时间
+	Hash        string            `json:"hash,omitempty"`        // 文件内容的 SHA256 哈希
+	Reference   string            `json:"reference,omitempty"`   // 格式: "packagename.7z/path/in/package.jpg"
+	Compression CompressionMethod `json:"compression,omitempty"` // 该文件在包内使用的压缩方式
+	// EstimatedSize 是规划时估算的压缩后大小，只保存在交付计划中，0 表示未估算
+	EstimatedSize int64 `json:"estimated_size,omitempty"`
+	// Chunks 非空时文件按块存储: 内容由各块依次拼接而成，Reference 只表示交付该版本的包，包内没有该文件本身
+	Chunks []Chunk `json:"chunks,omitempty"`
+}
+
+// Chunk 是按内容切分出的一个文件块
+type Chunk struct {
+	Hash      string `json:"hash"` // 块内容的 SHA256 哈希
+	Size      int64  `json:"size"`
+	Reference string `json:"reference,omitempty"` // 块所在的块包，格式: "packagename.7z/.beanckup/chunks/0001.pack"，空表示尚未交付
+	Offset    int64  `json:"offset,omitempty"`    // 块在块包内的偏移
 }
 
 // IsDirectory 检查是否为目录
@@ -33,6 +210,14 @@ func (n *FileNode) IsDirectory() bool {
 	return n.Dir != ""
 }
 
+// PlannedSize 返回规划交付包时使用的大小: 有压缩后大小的估算值时使用估算值，否则为原始大小
+func (n *FileNode) PlannedSize() int64 {
+	if n.EstimatedSize > 0 {
+		return n.EstimatedSize
+	}
+	return n.Size
+}
+
 // GetPath 获取文件或目录路径
 func (n *FileNode) GetPath() string {
 	if n.IsDirectory() {
@@ -63,11 +248,27 @@ func FilterReferenceFiles(nodes []*FileNode) []*FileNode {
 	return referenceFiles
 }
 
-// HistoricalState 持有从所有过去的 manifest 文件中加载的信息
+// Tombstone 记录一次文件删除: 该路径在 SessionID 会话扫描时已不存在 (包括被移动或改名的文件的原路径)
+type Tombstone struct {
+	Path      string  `json:"path"`
+	Size      int64   `json:"size,omitempty"`
+	Hash      string  `json:"hash,omitempty"`
+	Reference string  `json:"reference,omitempty"` // 被删除文件最后一个版本所在的位置，仍可从中恢复
+	SessionID int     `json:"session_id"`          // 发现删除的会话
+	Chunks    []Chunk `json:"chunks,omitempty"`    // 最后一个版本按块存储时的块列表
+}
+
+// HistoricalState 持有最新会话结束时工作区的状态
 type HistoricalState struct {
-	HashToNode   map[string]*FileNode
+	// HashToNode 包含所有仍可从交付包中取得的内容 (包括已删除文件)，用于识别移动和恢复的文件
+	HashToNode map[string]*FileNode
+	// PathToNode 只包含最新的已结束会话的文件，即该会话结束时工作区的完整文件列表
 	PathToNode   map[string]*FileNode
 	MaxSessionID int
+	// Tombstones 是截至最新会话的所有删除记录
+	Tombstones []*Tombstone
+	// Chunks 包含所有已交付的块 (以块的哈希为键)，按块存储文件时已有的块不再重复交付
+	Chunks map[string]Chunk
 }
 
 // --- 交付计划与会话相关 ---
@@ -83,22 +284,135 @@ const (
 
 // Episode 代表一个具体的交付包计划
 type Episode struct {
-	ID        int         `json:"id"`
-	TotalSize int64       `json:"total_size"`
-	Files     []*FileNode `json:"files"`
+	ID        int           `json:"id"`
+	TotalSize int64         `json:"total_size"`
+	Files     []*FileNode   `json:"files"`
 	Status    EpisodeStatus `json:"status"`
+	// PackageName 是本 episode 当前 (或最近一次) 尝试写入的包名，用于清理中断后残留的清单和包文件
+	PackageName string `json:"package_name,omitempty"`
+	// Priority 是包内文件的优先级，0 最高；未配置优先级规则时都为 0
+	Priority int `json:"priority,omitempty"`
+	// EstimatedSize 是包内文件估算的压缩后大小之和，未估算时为 0
+	EstimatedSize int64 `json:"estimated_size,omitempty"`
+	// ActualSize 是交付完成后包 (全部分卷) 的实际大小
+	ActualSize int64 `json:"actual_size,omitempty"`
+	// Destinations 记录包在各交付目录中的状态。包只打包一次，之后复制到其余目录；
+	// 交付时不可用的目录保持待交付状态，下次运行时补齐。
+	Destinations []DestinationStatus `json:"destinations,omitempty"`
+	// Medium 是换盘模式下包写入的介质序号，从 1 开始；未使用换盘模式时为 0
+	Medium int `json:"medium,omitempty"`
+}
+
+// DestinationStatus 是包在某个交付目录中的状态
+type DestinationStatus struct {
+	Path   string        `json:"path"`
+	Status EpisodeStatus `json:"status"`
+}
+
+// PendingDestinations 返回包尚未写入的交付目录
+func (e *Episode) PendingDestinations() []string {
+	var paths []string
+	for _, d := range e.Destinations {
+		if d.Status != EpisodeStatusCompleted {
+			paths = append(paths, d.Path)
+		}
+	}
+	return paths
+}
+
+// PlannedSize 返回规划时使用的包大小: 有估算值时使用估算值，否则为文件原始大小之和
+func (e *Episode) PlannedSize() int64 {
+	if e.EstimatedSize > 0 {
+		return e.EstimatedSize
+	}
+	return e.TotalSize
+}
+
+// SessionNote 是用户为一次会话设置的标签、备注和标记 (tag)，
+// 保存在交付计划、会话的每份清单和会话索引中，可用于在选择会话时筛选
+type SessionNote struct {
+	Label string   `json:"label,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// IsEmpty 判断是否没有设置任何标签、备注或标记
+func (n SessionNote) IsEmpty() bool {
+	return n.Label == "" && n.Notes == "" && len(n.Tags) == 0
+}
+
+// String 返回用于列表显示的简短描述，如 `"季度归档" #archive #keep`，不含备注
+func (n SessionNote) String() string {
+	var parts []string
+	if n.Label != "" {
+		parts = append(parts, fmt.Sprintf("%q", n.Label))
+	}
+	for _, tag := range n.Tags {
+		parts = append(parts, "#"+tag)
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasTag 判断是否带有指定标记 (不区分大小写)
+func (n SessionNote) HasTag(tag string) bool {
+	for _, t := range n.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches 判断是否满足筛选条件: "tag:<标记>" 或 "#<标记>" 要求带有该标记，
+// 其余文字在标签和备注中查找 (不区分大小写)。空条件匹配所有会话。
+func (n SessionNote) Matches(filter string) bool {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return true
+	}
+	if tag, ok := strings.CutPrefix(filter, "tag:"); ok {
+		return n.HasTag(strings.TrimSpace(tag))
+	}
+	if tag, ok := strings.CutPrefix(filter, "#"); ok {
+		return n.HasTag(tag)
+	}
+	filter = strings.ToLower(filter)
+	return strings.Contains(strings.ToLower(n.Label), filter) || strings.Contains(strings.ToLower(n.Notes), filter)
+}
+
+// ParseTags 将以逗号或空白分隔的标记列表拆分为去重后的标记，忽略开头的 #
+func ParseTags(s string) []string {
+	var tags []string
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '，' || unicode.IsSpace(r) }) {
+		tag := strings.TrimPrefix(field, "#")
+		if tag != "" && !(SessionNote{Tags: tags}).HasTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
 // Plan 代表一次完整的交付会话计划
 type Plan struct {
-	SessionID          int       `json:"session_id"`
-	Timestamp          time.Time `json:"timestamp"`
-	TotalNewSize       int64     `json:"total_new_size"`
+	SessionID    int       `json:"session_id"`
+	Timestamp    time.Time `json:"timestamp"`
+	TotalNewSize int64     `json:"total_new_size"`
 	// 【核心修正】: 将包大小限制持久化到Plan中
-	PackageSizeLimitMB int       `json:"package_size_limit_mb"`
-	Episodes           []Episode `json:"episodes"`
-	AllNodes           []*FileNode `json:"-"`
-	StatusFilePath     string    `json:"-"`
+	PackageSizeLimitMB int         `json:"package_size_limit_mb"`
+	PackingMode        PackingMode `json:"packing_mode,omitempty"`
+	Episodes           []Episode   `json:"episodes"`
+	// ScanStartedAt 是本会话扫描开始的时间，交付完成后用于标记变更日志的起点
+	ScanStartedAt time.Time `json:"scan_started_at,omitempty"`
+	// Tombstones 是本会话扫描时发现的删除，写入 E1 清单和会话快照
+	Tombstones []*Tombstone `json:"tombstones,omitempty"`
+	// ScanStatePath 是扫描状态文件相对于元数据目录的路径，保存了扫描到的完整节点列表 (AllNodes)，
+	// ScanStateSHA256 是其校验值。恢复中断的计划时据此重新载入 AllNodes。
+	ScanStatePath   string `json:"scan_state,omitempty"`
+	ScanStateSHA256 string `json:"scan_state_sha256,omitempty"`
+	// SessionNote 是本会话的标签、备注和标记，写入会话的每份清单
+	SessionNote
+	AllNodes       []*FileNode `json:"-"`
+	StatusFilePath string      `json:"-"`
 }
 
 // IsCompleted 检查整个交付计划是否已完成
@@ -107,7 +421,7 @@ func (p *Plan) IsCompleted() bool {
 		return len(FilterNewFiles(p.AllNodes)) == 0
 	}
 	for _, ep := range p.Episodes {
-		if ep.Status != EpisodeStatusCompleted {
+		if ep.Status != EpisodeStatusCompleted || len(ep.PendingDestinations()) > 0 {
 			return false
 		}
 	}
@@ -125,11 +439,11 @@ func (p *Plan) CountPending() int {
 	return count
 }
 
-// CountUnfinished 统计所有未完成的包
+// CountUnfinished 统计所有未完成的包 (包括尚未复制到全部交付目录的包)
 func (p *Plan) CountUnfinished() int {
 	count := 0
 	for _, ep := range p.Episodes {
-		if ep.Status != EpisodeStatusCompleted {
+		if ep.Status != EpisodeStatusCompleted || len(ep.PendingDestinations()) > 0 {
 			count++
 		}
 	}
@@ -140,10 +454,15 @@ func (p *Plan) CountUnfinished() int {
 
 // Manifest 代表单个交付包内容的精确描述
 type Manifest struct {
-	WorkspaceName string      `json:"workspace_name"`
-	SessionID     int         `json:"session_id"`
-	EpisodeID     int         `json:"episode_id"`
-	Timestamp     string      `json:"timestamp"`
-	PackageName   string      `json:"package_name"`
-	Files         []*FileNode `json:"files"`
+	FormatVersion string       `json:"format_version,omitempty"` // 清单格式版本 "主版本.次版本"，旧清单为空
+	WorkspaceName string       `json:"workspace_name"`
+	SessionID     int          `json:"session_id"`
+	EpisodeID     int          `json:"episode_id"`
+	Timestamp     string       `json:"timestamp"`
+	PackageName   string       `json:"package_name"`
+	Roots         []string     `json:"roots,omitempty"` // 多源目录备份集中各源目录的名称 (路径命名空间)
+	Files         []*FileNode  `json:"files"`
+	Tombstones    []*Tombstone `json:"tombstones,omitempty"` // E1 清单中为本会话的删除记录，会话快照中为截至该会话的全部删除记录
+	SessionNote                // 会话的标签、备注和标记，同一会话的每份清单相同
+	Archiver      string       `json:"archiver,omitempty"` // 写入该包的归档后端 ("7z" 或 "native")，为空的旧清单由 7z 写入
 }
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"io"
+	"os"
+)
+
+// WriteAtomic 原子地替换 path 的内容: write 先写入同目录下的临时文件 (path 加 .tmp 后缀)，
+// 同步到磁盘后再改名为 path。任何一步失败时删除临时文件，path 保持原样。
+func WriteAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// WriteFileAtomic 原子地将 data 写入 path
+func WriteFileAtomic(path string, data []byte) error {
+	return WriteAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// fat32MaxFileSize 是 FAT32 上单个文件的大小上限 (4 GB - 1 字节)
+const fat32MaxFileSize = 4*1024*1024*1024 - 1
+
+// MediaInfo 描述交付目录所在介质的可用空间和文件系统限制
+type MediaInfo struct {
+	FreeBytes    int64  // 当前用户可用的剩余空间
+	MaxFileBytes int64  // 单个文件的大小上限，0 表示没有限制
+	FSType       string // 文件系统类型，无法识别时为空
+}
+
+// existingDir 返回 path 自身或其最近的已存在的上级目录，交付目录可能尚未创建
+func existingDir(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statfs 返回的文件系统类型 (magic number)
+const (
+	msdosSuperMagic = 0x4d44
+	exfatSuperMagic = 0x2011bab0
+	ntfsSuperMagic  = 0x5346544e
+)
+
+// GetMediaInfo 查询交付目录所在文件系统的剩余空间，并识别有单文件大小限制的文件系统 (FAT32)
+func GetMediaInfo(path string) (*MediaInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(existingDir(path), &st); err != nil {
+		return nil, fmt.Errorf("无法查询 %s 的剩余空间: %w", path, err)
+	}
+	info := &MediaInfo{FreeBytes: int64(st.Bavail) * int64(st.Bsize)}
+	switch uint32(st.Type) {
+	case msdosSuperMagic:
+		info.FSType = "vfat"
+		info.MaxFileBytes = fat32MaxFileSize
+	case exfatSuperMagic:
+		info.FSType = "exfat"
+	case ntfsSuperMagic:
+		info.FSType = "ntfs"
+	}
+	return info, nil
+}
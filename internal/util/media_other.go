@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package util
+
+import "fmt"
+
+// GetMediaInfo 在其他系统上不可用，按介质剩余空间交付时须手动设置总大小限制
+func GetMediaInfo(path string) (*MediaInfo, error) {
+	return nil, fmt.Errorf("当前系统不支持查询交付目录的剩余空间")
+}
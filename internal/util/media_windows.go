@@ -0,0 +1,37 @@
+//go:build windows
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// GetMediaInfo 查询交付目录所在卷的剩余空间，并识别有单文件大小限制的文件系统 (FAT/FAT32)
+func GetMediaInfo(path string) (*MediaInfo, error) {
+	dir, err := windows.UTF16PtrFromString(existingDir(path))
+	if err != nil {
+		return nil, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, &total, &totalFree); err != nil {
+		return nil, fmt.Errorf("无法查询 %s 的剩余空间: %w", path, err)
+	}
+	info := &MediaInfo{FreeBytes: int64(free)}
+
+	volume := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(dir, &volume[0], uint32(len(volume))); err != nil {
+		return info, nil
+	}
+	fsName := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumeInformation(&volume[0], nil, 0, nil, nil, nil, &fsName[0], uint32(len(fsName))); err != nil {
+		return info, nil
+	}
+	info.FSType = strings.ToLower(windows.UTF16ToString(fsName))
+	if info.FSType == "fat" || info.FSType == "fat32" {
+		info.MaxFileBytes = fat32MaxFileSize
+	}
+	return info, nil
+}
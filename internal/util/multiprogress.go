@@ -0,0 +1,98 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MultiProgress 汇总同时进行的多个任务的进度，显示在同一行中。总进度按各任务的权重 (如字节数) 加权计算。
+type MultiProgress struct {
+	mu      sync.Mutex
+	display *ProgressDisplay
+	tasks   []*progressTask
+	shown   bool
+}
+
+type progressTask struct {
+	name    string
+	weight  int64
+	percent int
+	started bool
+	done    bool
+}
+
+// NewMultiProgress 创建一个汇总进度显示
+func NewMultiProgress() *MultiProgress {
+	return &MultiProgress{display: NewProgressDisplay()}
+}
+
+// Add 登记一个任务，登记后尚未开始的任务计入总进度，但不单独显示
+func (m *MultiProgress) Add(name string, weight int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tasks = append(m.tasks, &progressTask{name: name, weight: max(weight, 1)})
+}
+
+// Update 更新任务的完成百分比并刷新显示
+func (m *MultiProgress) Update(name string, percent int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if task := m.find(name); task != nil {
+		task.percent = percent
+		task.started = true
+	}
+	m.render()
+}
+
+// Done 标记任务结束 (无论成功与否)
+func (m *MultiProgress) Done(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if task := m.find(name); task != nil {
+		task.done = true
+		task.percent = 100
+	}
+	m.render()
+}
+
+// Finish 结束进度显示
+func (m *MultiProgress) Finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.shown {
+		m.display.Finish()
+		m.shown = false
+	}
+}
+
+func (m *MultiProgress) find(name string) *progressTask {
+	for _, task := range m.tasks {
+		if task.name == name {
+			return task
+		}
+	}
+	return nil
+}
+
+// render 只登记了一个任务时显示其进度，多个时显示总进度和各进行中任务的进度
+func (m *MultiProgress) render() {
+	var total, completed int64
+	var active []string
+	for _, task := range m.tasks {
+		total += task.weight
+		completed += task.weight * int64(task.percent) / 100
+		if task.started && !task.done {
+			active = append(active, fmt.Sprintf("%s %d%%", task.name, task.percent))
+		}
+	}
+	if len(active) == 0 {
+		return
+	}
+	m.shown = true
+	if len(m.tasks) == 1 {
+		m.display.UpdateProgress("  > 正在处理 %s", active[0])
+		return
+	}
+	m.display.UpdateProgress("  > 总进度 %d%% | %s", completed*100/total, strings.Join(active, " | "))
+}
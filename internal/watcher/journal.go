@@ -0,0 +1,235 @@
+package watcher
+
+import (
+	"beanckup-cli/internal/util"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// journalDirName 是变更日志在 .beanckup 目录下的子目录名
+	journalDirName = "watch"
+	journalFile    = "journal.log"
+	statusFile     = "watcher.json"
+	scanMarkFile   = "scan.json"
+
+	// overflowMarker 表示监视器丢失过事件，此后的日志不再可信
+	overflowMarker = "!overflow"
+
+	// HeartbeatInterval 是监视器刷新状态文件的间隔
+	HeartbeatInterval = 10 * time.Second
+	// staleAfter 超过该时间未刷新心跳，即认为监视器未在运行
+	staleAfter = 3 * HeartbeatInterval
+)
+
+// Status 是监视器进程写入的状态文件
+type Status struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Incomplete 表示有目录未能加入监视，此时日志不能代表全部变化
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// ScanMark 记录最近一次已完成交付的会话所对应的扫描开始时间
+type ScanMark struct {
+	SessionID     int       `json:"session_id"`
+	ScanStartedAt time.Time `json:"scan_started_at"`
+}
+
+// JournalDir 返回 .beanckup 目录下的变更日志目录
+func JournalDir(beanckupDir string) string {
+	return filepath.Join(beanckupDir, journalDirName)
+}
+
+// MarkScan 在会话交付完成后调用，记录该会话的扫描开始时间。
+// 下一次扫描只需重新检查在此时间之后发生变化的路径。
+func MarkScan(beanckupDir string, sessionID int, scanStartedAt time.Time) error {
+	dir := JournalDir(beanckupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("无法创建变更日志目录: %w", err)
+	}
+	return writeJSONAtomic(filepath.Join(dir, scanMarkFile), &ScanMark{SessionID: sessionID, ScanStartedAt: scanStartedAt})
+}
+
+// ChangesSince 返回会话 sessionID 的扫描开始以来发生变化的相对路径 (使用 / 分隔)。
+// 若变更日志不能保证覆盖这段时间 (监视器未运行、曾重启、事件溢出或会话不匹配)，返回错误，调用方应回退到完整扫描。
+func ChangesSince(beanckupDir string, sessionID int) ([]string, error) {
+	dir := JournalDir(beanckupDir)
+
+	var mark ScanMark
+	if err := readJSON(filepath.Join(dir, scanMarkFile), &mark); err != nil {
+		return nil, fmt.Errorf("没有可用的扫描标记")
+	}
+	if mark.SessionID != sessionID {
+		return nil, fmt.Errorf("扫描标记属于会话 S%d，而最新会话为 S%d", mark.SessionID, sessionID)
+	}
+
+	var status Status
+	if err := readJSON(filepath.Join(dir, statusFile), &status); err != nil {
+		return nil, fmt.Errorf("监视器未在运行")
+	}
+	if time.Since(status.Heartbeat) > staleAfter {
+		return nil, fmt.Errorf("监视器心跳已超时 (最后心跳: %s)", status.Heartbeat.Format("2006-01-02 15:04:05"))
+	}
+	if status.Incomplete {
+		return nil, fmt.Errorf("监视器未能覆盖所有目录")
+	}
+	if status.StartedAt.After(mark.ScanStartedAt) {
+		return nil, fmt.Errorf("监视器在上次扫描之后才启动")
+	}
+
+	file, err := os.Open(filepath.Join(dir, journalFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("无法读取变更日志: %w", err)
+	}
+	defer file.Close()
+
+	since := mark.ScanStartedAt.UnixNano()
+	seen := make(map[string]bool)
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ts, path, ok := parseJournalLine(scanner.Text())
+		if !ok || ts < since {
+			continue
+		}
+		if path == overflowMarker {
+			return nil, fmt.Errorf("变更日志在上次扫描之后发生过溢出")
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取变更日志失败: %w", err)
+	}
+	return paths, nil
+}
+
+// journalWriter 由监视器进程独占，负责追加和压缩变更日志
+type journalWriter struct {
+	dir  string
+	file *os.File
+}
+
+func openJournal(beanckupDir string) (*journalWriter, error) {
+	dir := JournalDir(beanckupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("无法创建变更日志目录: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开变更日志: %w", err)
+	}
+	return &journalWriter{dir: dir, file: file}, nil
+}
+
+// append 以同一时间戳写入一批路径
+func (j *journalWriter) append(paths []string) error {
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	var sb strings.Builder
+	for _, path := range paths {
+		sb.WriteString(ts)
+		sb.WriteByte('\t')
+		sb.WriteString(path)
+		sb.WriteByte('\n')
+	}
+	_, err := j.file.WriteString(sb.String())
+	return err
+}
+
+// writeStatus 刷新监视器的状态文件 (心跳)
+func (j *journalWriter) writeStatus(status *Status) error {
+	status.Heartbeat = time.Now()
+	return writeJSONAtomic(filepath.Join(j.dir, statusFile), status)
+}
+
+// compact 删除早于最近一次扫描标记的日志记录，避免日志无限增长
+func (j *journalWriter) compact() error {
+	var mark ScanMark
+	if err := readJSON(filepath.Join(j.dir, scanMarkFile), &mark); err != nil {
+		return nil
+	}
+	since := mark.ScanStartedAt.UnixNano()
+
+	journalPath := filepath.Join(j.dir, journalFile)
+	src, err := os.Open(journalPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var kept []string
+	dropped := false
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if ts, _, ok := parseJournalLine(line); ok && ts < since {
+			dropped = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if err := scanner.Err(); err != nil || !dropped {
+		return err
+	}
+
+	content := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		content += "\n"
+	}
+	j.file.Close()
+	writeErr := util.WriteFileAtomic(journalPath, []byte(content))
+	j.file, err = os.OpenFile(journalPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (j *journalWriter) close() {
+	j.file.Close()
+	os.Remove(filepath.Join(j.dir, statusFile))
+}
+
+func parseJournalLine(line string) (int64, string, bool) {
+	tsStr, path, ok := strings.Cut(line, "\t")
+	if !ok {
+		return 0, "", false
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return ts, path, true
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, data)
+}
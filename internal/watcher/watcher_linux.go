@@ -0,0 +1,226 @@
+//go:build linux
+
+package watcher
+
+import (
+	"beanckup-cli/internal/types"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// flushInterval 是批量写入变更日志的间隔，同一路径的多次事件在一个批次中只记录一次
+const flushInterval = time.Second
+
+// Watch 使用 inotify 递归监视备份集的所有源目录，并将发生变化的路径 (带源目录命名空间)
+// 持续写入元数据目录中的变更日志，直到 stop 被关闭。
+func Watch(set *types.BackupSet, stop <-chan struct{}) error {
+	journal, err := openJournal(set.MetadataDir)
+	if err != nil {
+		return err
+	}
+	defer journal.close()
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("无法初始化 inotify: %w", err)
+	}
+	// 非阻塞的 fd 会被注册到 Go 运行时的轮询器中，关闭文件即可中断阻塞的 Read
+	inotifyFile := os.NewFile(uintptr(fd), "inotify")
+
+	w := &linuxWatcher{
+		fd:      fd,
+		set:     set,
+		watches: make(map[int32]watchedDir),
+		pending: make(map[string]bool),
+	}
+	for i := range set.Roots {
+		w.addRecursive(&set.Roots[i], "")
+	}
+
+	hostname, _ := os.Hostname()
+	status := &Status{PID: os.Getpid(), Host: hostname, StartedAt: time.Now(), Incomplete: w.incomplete}
+	if err := journal.writeStatus(status); err != nil {
+		inotifyFile.Close()
+		return fmt.Errorf("无法写入监视器状态: %w", err)
+	}
+	log.Printf("[信息] 正在监视 %s (%d 个源目录, 共 %d 个目录)", set.Name, len(set.Roots), len(w.watches))
+
+	events := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := inotifyFile.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			events <- chunk
+		}
+	}()
+
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+	heartbeatTicker := time.NewTicker(HeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			inotifyFile.Close()
+			return w.flush(journal)
+		case err := <-readErr:
+			inotifyFile.Close()
+			w.flush(journal)
+			return fmt.Errorf("读取 inotify 事件失败: %w", err)
+		case chunk := <-events:
+			w.handleEvents(chunk)
+		case <-flushTicker.C:
+			if err := w.flush(journal); err != nil {
+				log.Printf("警告: 写入变更日志失败: %v", err)
+			}
+		case <-heartbeatTicker.C:
+			if err := journal.compact(); err != nil {
+				log.Printf("警告: 压缩变更日志失败: %v", err)
+			}
+			status.Incomplete = w.incomplete
+			if err := journal.writeStatus(status); err != nil {
+				log.Printf("警告: 刷新监视器状态失败: %v", err)
+			}
+		}
+	}
+}
+
+type linuxWatcher struct {
+	fd         int
+	set        *types.BackupSet
+	watches    map[int32]watchedDir // watch 描述符 -> 被监视的目录
+	pending    map[string]bool      // 尚未写入日志的变化路径
+	overflowed bool                 // 内核事件队列溢出，期间的事件已丢失
+	incomplete bool                 // 部分目录未能加入监视
+}
+
+// watchedDir 是一个被监视的目录，rel 为其在源目录内的相对路径 (根目录为空)
+type watchedDir struct {
+	root *types.SourceRoot
+	rel  string
+}
+
+// addRecursive 为源目录中的 relDir 及其所有子目录添加监视
+func (w *linuxWatcher) addRecursive(root *types.SourceRoot, relDir string) {
+	start := filepath.Join(root.Path, filepath.FromSlash(relDir))
+	filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == ".beanckup" || path == w.set.MetadataDir {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			// 无法监视的目录 (如超出 max_user_watches) 会使日志持续不完整，扫描器将始终回退到完整扫描
+			log.Printf("警告: 无法监视目录 %s: %v", path, err)
+			w.incomplete = true
+			return nil
+		}
+		rel, _ := filepath.Rel(root.Path, path)
+		if rel == "." {
+			rel = ""
+		}
+		w.watches[int32(wd)] = watchedDir{root: root, rel: filepath.ToSlash(rel)}
+		return nil
+	})
+}
+
+// removeRecursive 移除源目录中 relDir 及其所有子目录的监视
+func (w *linuxWatcher) removeRecursive(root *types.SourceRoot, relDir string) {
+	for wd, dir := range w.watches {
+		if dir.root == root && (dir.rel == relDir || strings.HasPrefix(dir.rel, relDir+"/")) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *linuxWatcher) handleEvents(buf []byte) {
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+		mask := binary.NativeEndian.Uint32(buf[offset+4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		name := strings.TrimRight(string(buf[nameStart:nameStart+nameLen]), "\x00")
+		offset = nameStart + nameLen
+
+		if mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.overflowed = true
+			continue
+		}
+		dir, ok := w.watches[wd]
+		if !ok {
+			continue
+		}
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(w.watches, wd)
+			continue
+		}
+
+		relPath := dir.rel
+		if name != "" {
+			relPath = joinRel(dir.rel, name)
+		}
+		if relPath == "" || relPath == ".beanckup" || strings.HasPrefix(relPath, ".beanckup/") {
+			continue
+		}
+		if mask&syscall.IN_ISDIR != 0 && mask&syscall.IN_MOVED_FROM != 0 {
+			// 移出的目录保留着原有的监视，但其路径已失效，需要移除
+			w.removeRecursive(dir.root, relPath)
+		}
+		if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			// 新目录 (包括移入的目录树) 需要补充监视，其内容由扫描器整体遍历
+			w.addRecursive(dir.root, relPath)
+		}
+		w.pending[w.set.NodePath(dir.root, relPath)] = true
+	}
+}
+
+// flush 将累积的变化路径写入日志
+func (w *linuxWatcher) flush(journal *journalWriter) error {
+	if len(w.pending) == 0 && !w.overflowed {
+		return nil
+	}
+	paths := make([]string, 0, len(w.pending)+1)
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	if w.overflowed {
+		paths = append(paths, overflowMarker)
+	}
+	if err := journal.append(paths); err != nil {
+		return err
+	}
+	w.pending = make(map[string]bool)
+	w.overflowed = false
+	return nil
+}
+
+func joinRel(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package watcher
+
+import (
+	"beanckup-cli/internal/types"
+	"fmt"
+)
+
+// Watch 在非 Linux 系统上不可用，扫描将始终回退为完整遍历。
+func Watch(set *types.BackupSet, stop <-chan struct{}) error {
+	return fmt.Errorf("监视模式目前仅支持 Linux (inotify)")
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"beanckup-cli/internal/archive"
+	"beanckup-cli/internal/backupset"
+	"beanckup-cli/internal/chunker"
+	"beanckup-cli/internal/compression"
+	"beanckup-cli/internal/config"
 	"beanckup-cli/internal/history"
+	"beanckup-cli/internal/hooks"
 	"beanckup-cli/internal/indexer"
+	"beanckup-cli/internal/inventory"
+	"beanckup-cli/internal/lock"
 	"beanckup-cli/internal/manifest"
-	"beanckup-cli/internal/packager"
 	"beanckup-cli/internal/restorer"
 	"beanckup-cli/internal/session"
+	"beanckup-cli/internal/signing"
 	"beanckup-cli/internal/types"
 	"beanckup-cli/internal/util"
+	"beanckup-cli/internal/watcher"
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -24,6 +34,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	fmt.Println("欢迎使用 BeanCKUP CLI！")
 
 	for {
@@ -55,6 +69,9 @@ func main() {
 // 【新增函数】: 替换 util.DisplayDeliveryProgress 以提供更详细的信息
 func displayDeliveryProgress(plan *types.Plan, workspaceName string) {
 	fmt.Printf("\n=== 交付进度 (会话 S%d) ===\n", plan.SessionID)
+	if !plan.SessionNote.IsEmpty() {
+		fmt.Printf("标签: %s\n", plan.SessionNote)
+	}
 	fmt.Printf("计划交付总大小: %.2f MB\n", float64(plan.TotalNewSize)/1024/1024)
 
 	if len(plan.Episodes) > 0 {
@@ -63,23 +80,37 @@ func displayDeliveryProgress(plan *types.Plan, workspaceName string) {
 		// 从plan中获取持久化的包大小限制
 		packageSizeLimitBytes := int64(plan.PackageSizeLimitMB) * 1024 * 1024
 
+		showPriority := session.HasPriorities(plan)
 		for i, episode := range plan.Episodes {
 			packageName := fmt.Sprintf("%s-S%02dE%02d", workspaceName, plan.SessionID, episode.ID)
+			if showPriority {
+				packageName += fmt.Sprintf(" [优先级 %d]", episode.Priority+1)
+			}
 
 			// 检查是否会分卷，并生成提示信息
 			volumeNotice := ""
-			if plan.PackageSizeLimitMB > 0 && episode.TotalSize > packageSizeLimitBytes {
+			if plan.PackageSizeLimitMB > 0 && episode.PlannedSize() > packageSizeLimitBytes {
 				volumeNotice = " (超限，将分卷交付)"
 			}
+			sizeNotice := ""
+			if episode.ActualSize > 0 && episode.EstimatedSize != episode.TotalSize {
+				sizeNotice = fmt.Sprintf(", 实际 %.2f MB / 估算 %.2f MB", float64(episode.ActualSize)/1024/1024, float64(episode.EstimatedSize)/1024/1024)
+			} else if episode.EstimatedSize > 0 && episode.EstimatedSize != episode.TotalSize {
+				sizeNotice = fmt.Sprintf(", 估算压缩后 %.2f MB", float64(episode.EstimatedSize)/1024/1024)
+			}
 
-			fmt.Printf("  [%d] %s - %.2f MB (%d 个文件)%s - %s\n",
+			fmt.Printf("  [%d] %s - %.2f MB (%d 个文件%s)%s - %s\n",
 				i+1,
 				packageName,
 				float64(episode.TotalSize)/1024/1024,
 				len(episode.Files),
+				sizeNotice,
 				volumeNotice,
 				episode.Status,
 			)
+			if pending := episode.PendingDestinations(); episode.Status == types.EpisodeStatusCompleted && len(pending) > 0 {
+				fmt.Printf("      尚未复制到: %s\n", strings.Join(pending, ", "))
+			}
 
 			if episode.Status == types.EpisodeStatusCompleted {
 				deliveredSize += episode.TotalSize
@@ -89,24 +120,35 @@ func displayDeliveryProgress(plan *types.Plan, workspaceName string) {
 	}
 }
 
-func selectWorkspace() string {
+// selectWorkspace 询问工作区路径: 可以是一个文件夹，也可以是列出多个源目录的备份集定义文件 (.json)
+func selectWorkspace() *types.BackupSet {
 	for {
-		fmt.Print("\n请输入或拖入工作区文件夹路径: ")
+		fmt.Print("\n请输入或拖入工作区文件夹路径 (或备份集定义文件): ")
 		path, _ := reader.ReadString('\n')
 		path = strings.TrimSpace(path)
 		path = strings.Trim(path, "\"")
 
-		if _, err := os.Stat(path); err == nil {
-			return path
+		set, err := backupset.Open(path)
+		if err == nil {
+			return set
 		}
-		fmt.Printf("错误: 路径 '%s' 不存在或无法访问，请重新输入。\n", path)
+		fmt.Printf("错误: 无法打开工作区 '%s': %v，请重新输入。\n", path, err)
 	}
 }
 
+// hookEnv 返回备份集在钩子命令中的基础环境信息
+func hookEnv(set *types.BackupSet, sessionID int) hooks.Env {
+	env := hooks.Env{WorkspaceName: set.Name, MetadataDir: set.MetadataDir, SessionID: sessionID}
+	if !set.IsMultiRoot() {
+		env.WorkspacePath = set.Roots[0].Path
+	}
+	return env
+}
+
 func handleScanAndDeliver() {
-	workspacePath := selectWorkspace()
-	workspaceName := util.GetWorkspaceName(workspacePath) // 【核心修正】: 使用新的工具函数
-	beanckupDir := filepath.Join(workspacePath, ".beanckup")
+	set := selectWorkspace()
+	workspaceName := set.Name // 【核心修正】: 单目录工作区的名称由 util.GetWorkspaceName 得出
+	beanckupDir := set.MetadataDir
 	if err := os.MkdirAll(beanckupDir, 0755); err != nil {
 		log.Printf("错误: 无法创建 .beanckup 目录: %v", err)
 		return
@@ -115,10 +157,30 @@ func handleScanAndDeliver() {
 	if err := util.SetHidden(beanckupDir); err != nil {
 		log.Printf("警告: 无法将 .beanckup 文件夹设置为隐藏: %v", err)
 	}
+	// 防止另一个进程同时备份同一个工作区 (两者会得到相同的会话号并写出冲突的计划和清单)
+	workspaceLock, err := lock.Acquire(beanckupDir, "备份")
+	if err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return
+	}
+	defer workspaceLock.Release()
 
-	fmt.Printf("\n已选择工作区: %s\n", workspacePath)
+	if set.IsMultiRoot() {
+		fmt.Printf("\n已选择备份集: %s (元数据目录: %s)\n", set.Name, beanckupDir)
+		for _, root := range set.Roots {
+			fmt.Printf("  - %s: %s\n", root.Name, root.Path)
+		}
+	} else {
+		fmt.Printf("\n已选择工作区: %s\n", set.Roots[0].Path)
+	}
+
+	cfg, err := config.Load(beanckupDir)
+	if err != nil {
+		log.Printf("错误: %v", err)
+		return
+	}
 
-	plan, _, err := session.FindLatestPlan(workspacePath)
+	plan, _, err := session.FindLatestPlan(beanckupDir)
 	if err != nil {
 		log.Printf("错误: 检查未完成任务失败: %v", err)
 		return
@@ -128,17 +190,8 @@ func handleScanAndDeliver() {
 		fmt.Printf("\n⚠️  发现未完成的交付任务 (会话 S%d, 还有 %d 个包未完成)\n",
 			plan.SessionID, plan.CountUnfinished())
 
-		// 【断点续传清理】: 清理上次未完成任务可能残留的清单文件
-		for _, ep := range plan.Episodes {
-			if ep.Status == types.EpisodeStatusInProgress {
-				log.Printf("检测到上次交付中断，正在清理会话 S%dE%d 的残留状态...", plan.SessionID, ep.ID)
-				epPackageName := manifest.GeneratePackageName(workspaceName, plan.SessionID, ep.ID)
-				baseName := strings.TrimSuffix(epPackageName, ".7z")
-				manifestFilename := baseName + ".json"
-				manifestPath := filepath.Join(beanckupDir, manifestFilename)
-				os.Remove(manifestPath)
-			}
-		}
+		// 【断点续传清理】: 按计划中记录的包名清理上次未完成任务可能残留的清单文件
+		stalePackages := prepareResume(beanckupDir, plan)
 
 		displayDeliveryProgress(plan, workspaceName) // 【核心修正】: 调用新的显示函数
 		fmt.Println("\n选项:")
@@ -147,19 +200,85 @@ func handleScanAndDeliver() {
 		fmt.Print("请选择 (1-2): ")
 		choice, _ := reader.ReadString('\n')
 		choice = strings.TrimSpace(choice)
-		if choice == "1" {
+		if choice == "1" && checkResumablePlan(set, plan, false) {
 			fmt.Println("将继续未完成的交付...")
 			params := askForResumeDeliveryParams()
 			if params == nil {
 				fmt.Println("取消继续交付。")
 				return
 			}
-			executeDeliveryLoop(workspacePath, workspaceName, beanckupDir, plan, params)
+			params.ParallelEpisodes = cfg.ParallelEpisodes
+			params.Archiver = cfg.Archiver
+			for _, destination := range params.Destinations() {
+				session.CleanupIncompletePackages(destination, stalePackages)
+			}
+			executeDeliveryLoop(set, cfg, plan, params, false)
 			return
 		}
 		fmt.Println("已忽略旧任务，将开始新的扫描...")
 	}
 
+	scan, err := scanWorkspace(set, cfg)
+	if err != nil {
+		log.Printf("错误: %v，已中止本次交付。", err)
+		return
+	}
+	if scan.newCount == 0 && scan.movedCount == 0 && len(scan.deletions) == 0 {
+		fmt.Println("工作区内文件无增量变化，无需交付。")
+		return
+	}
+
+	if !askForConfirmation("\n是否开始交付?") {
+		fmt.Println("取消交付。")
+		return
+	}
+
+	params := askForDeliveryParams(scan.newSize, cfg.PackingMode)
+	if params == nil {
+		fmt.Println("取消交付。")
+		return
+	}
+	params.ParallelEpisodes = cfg.ParallelEpisodes
+	params.Archiver = cfg.Archiver
+
+	newPlan, err := createDeliveryPlan(set, cfg, scan, params)
+	if err != nil {
+		log.Printf("错误: %v，已中止本次交付。", err)
+		return
+	}
+	if newPlan == nil {
+		fmt.Println("根据您的设置，本次扫描未计划任何交付包。")
+		return
+	}
+
+	executeDeliveryLoop(set, cfg, newPlan, params, false)
+}
+
+// prepareResume 清理未完成计划中上次中断的包在元数据目录中残留的清单，返回这些包的包名，
+// 确定交付目录后再用它们清理残留的包文件
+func prepareResume(beanckupDir string, plan *types.Plan) []string {
+	stalePackages := session.ResetUnfinishedEpisodes(plan)
+	for _, name := range stalePackages {
+		log.Printf("检测到上次交付中断，正在清理交付包 %s 的残留状态...", name)
+		removeManifest(filepath.Join(beanckupDir, manifest.ManifestFileName(name)))
+	}
+	return stalePackages
+}
+
+// scanResult 是一次扫描的结果，用于创建交付计划
+type scanResult struct {
+	histState  *types.HistoricalState
+	allNodes   []*types.FileNode
+	deletions  []*types.Tombstone
+	startedAt  time.Time
+	newCount   int
+	movedCount int
+	newSize    int64
+}
+
+// scanWorkspace 载入历史状态并扫描工作区 (包括 pre_scan 钩子)，显示扫描结果
+func scanWorkspace(set *types.BackupSet, cfg *types.Config) (*scanResult, error) {
+	beanckupDir := set.MetadataDir
 	histState, histErr := history.LoadHistoricalState(beanckupDir)
 	if histErr != nil {
 		log.Printf("警告: 加载历史状态失败: %v。将按首次扫描处理。", histErr)
@@ -167,6 +286,7 @@ func handleScanAndDeliver() {
 			HashToNode:   make(map[string]*types.FileNode),
 			PathToNode:   make(map[string]*types.FileNode),
 			MaxSessionID: 0,
+			Chunks:       make(map[string]types.Chunk),
 		}
 	}
 
@@ -176,196 +296,232 @@ func handleScanAndDeliver() {
 		fmt.Printf("检测到历史记录，最大会话ID: S%d\n", histState.MaxSessionID)
 	}
 
+	if err := hooks.Run(cfg.Hooks, hooks.StagePreScan, hookEnv(set, histState.MaxSessionID+1)); err != nil {
+		return nil, err
+	}
+
 	fmt.Println("\n=== 开始扫描工作区 ===")
 	fmt.Println("正在扫描文件...")
+	scan := &scanResult{histState: histState, startedAt: time.Now()}
 	idx := indexer.NewIndexer(histState)
+	idx.EnableJournal(beanckupDir)
 	progressDisplay := util.NewProgressDisplay()
-	allNodes, err := idx.ScanWithProgress(workspacePath, func(progress string) {
-		progressDisplay.UpdateProgress(progress)
+	allNodes, err := idx.ScanWithProgress(set, func(progress string) {
+		progressDisplay.UpdateProgress("%s", progress)
 	})
 	progressDisplay.Finish()
 	if err != nil {
-		log.Printf("错误: 扫描工作区失败: %v\n", err)
-		return
+		return nil, fmt.Errorf("扫描工作区失败: %w", err)
 	}
 
-	newCount, movedCount, deletedCount, newSize := analyzeFileChanges(allNodes, histState)
-	displayScanResults(newCount, movedCount, deletedCount, newSize)
+	scan.allNodes = allNodes
+	scan.deletions = history.FindDeletions(histState, allNodes, histState.MaxSessionID+1)
+	scan.newCount, scan.movedCount, scan.newSize = analyzeFileChanges(allNodes, histState)
+	displayScanResults(scan.newCount, scan.movedCount, len(scan.deletions), scan.newSize)
+	return scan, nil
+}
 
-	if newCount == 0 && movedCount == 0 {
-		fmt.Println("工作区内文件无增量变化，无需交付。")
-		return
-	}
+// createDeliveryPlan 按交付参数为扫描结果创建交付计划并保存扫描状态。
+// 根据设置没有任何可交付的包时返回 nil。
+func createDeliveryPlan(set *types.BackupSet, cfg *types.Config, scan *scanResult, params *session.DeliveryParams) (*types.Plan, error) {
+	beanckupDir := set.MetadataDir
 
-	if !askForConfirmation("\n是否开始交付?") {
-		fmt.Println("取消交付。")
-		return
+	// 启用压缩时按估算的压缩后大小规划各包和总大小限制
+	if params.CompressionLevel > 0 {
+		if estimator, err := compression.LoadEstimator(beanckupDir); err != nil {
+			log.Printf("警告: %v，将按原始大小规划。", err)
+		} else {
+			fmt.Println("正在估算压缩后的大小...")
+			estimated := estimator.Estimate(set, types.FilterNewFiles(scan.allNodes), params.CompressionMethod, params.CompressionLevel)
+			fmt.Printf("预计压缩后大小: %.2f MB (原始 %.2f MB)\n", float64(estimated)/1024/1024, float64(scan.newSize)/1024/1024)
+			if err := estimator.Save(); err != nil {
+				log.Printf("警告: %v", err)
+			}
+		}
 	}
 
-	params := askForDeliveryParams(newSize)
-	if params == nil {
-		fmt.Println("取消交付。")
-		return
+	// 启用块级去重时切分大文件，已交付过的块不再计入规划大小
+	if minSize := chunker.MinFileSize(cfg.Chunking); minSize > 0 {
+		fmt.Println("正在按内容切分大文件...")
+		if files, reused := chunker.Prepare(set, types.FilterNewFiles(scan.allNodes), scan.histState.Chunks, minSize); files > 0 {
+			fmt.Printf("%d 个大文件按块存储，其中 %.2f MB 的块已交付过，无需重复打包\n", files, float64(reused)/1024/1024)
+		}
 	}
 
-	newSessionID := histState.MaxSessionID + 1
-	newPlan := session.CreatePlan(newSessionID, allNodes, params.PackageSizeLimitMB)
+	newSessionID := scan.histState.MaxSessionID + 1
+	newPlan := session.CreatePlan(newSessionID, scan.allNodes, params.PackageSizeLimitMB, params.PackingMode, cfg.Priority)
+	// 没有新文件、但有文件被删除或移动时，仍交付一个只含清单的 E1，记录删除和新的路径
+	if len(newPlan.Episodes) == 0 && (len(scan.deletions) > 0 || scan.movedCount > 0) {
+		newPlan.Episodes = []types.Episode{{ID: 1, Status: types.EpisodeStatusPending}}
+	}
 	newPlan.PackageSizeLimitMB = params.PackageSizeLimitMB
+	if params.PackageSizeLimitMB > 0 {
+		fmt.Printf("分包方式: %s，共 %d 个包，填充率 %.1f%%，跨包的顶层目录 %d 个\n",
+			packingModeName(newPlan.PackingMode), len(newPlan.Episodes), session.FillEfficiency(newPlan)*100, session.SplitDirectories(newPlan))
+	}
+	newPlan.ScanStartedAt = scan.startedAt
+	newPlan.Tombstones = scan.deletions
+	newPlan.SessionNote = params.Note
 	session.ApplyTotalSizeLimitToPlan(newPlan, params.TotalSizeLimitMB)
 
 	if len(newPlan.Episodes) == 0 || newPlan.CountPending() == 0 {
-		fmt.Println("根据您的设置，本次扫描未计划任何交付包。")
-		return
+		return nil, nil
 	}
 
-	executeDeliveryLoop(workspacePath, workspaceName, beanckupDir, newPlan, params)
+	// 保存完整的扫描结果，中断后恢复时据此写出与未中断时相同的 E1 清单
+	if err := session.SaveScanState(beanckupDir, newPlan); err != nil {
+		return nil, err
+	}
+	return newPlan, nil
 }
 
-func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan *types.Plan, params *session.DeliveryParams) {
+// checkResumablePlan 载入计划的扫描状态并与当前工作区比对，返回是否可以继续该计划。
+// E1 尚未完成时必须有完整的扫描状态，否则 E1 清单会缺少未变化的文件。
+// unattended 为 true 时不询问，工作区的变化留待下次扫描处理。
+func checkResumablePlan(set *types.BackupSet, plan *types.Plan, unattended bool) bool {
+	if err := session.LoadScanState(set.MetadataDir, plan); err != nil {
+		if len(plan.Episodes) > 0 && plan.Episodes[0].Status != types.EpisodeStatusCompleted {
+			fmt.Printf("无法继续该交付: %v。需要重新扫描工作区。\n", err)
+			return false
+		}
+		log.Printf("警告: %v", err)
+	}
+
+	nodes := plan.AllNodes
+	if nodes == nil {
+		for _, episode := range plan.Episodes {
+			if episode.Status != types.EpisodeStatusCompleted {
+				nodes = append(nodes, episode.Files...)
+			}
+		}
+	}
+	fmt.Println("正在检查工作区自扫描以来的变化...")
+	changed := indexer.FindChangedFiles(set, nodes)
+	if len(changed) == 0 {
+		return true
+	}
+	fmt.Printf("自创建该计划以来，工作区中有 %d 个文件已变化或被删除:\n", len(changed))
+	for i, node := range changed {
+		if i == 10 {
+			fmt.Printf("  ... 等 %d 个文件\n", len(changed)-i)
+			break
+		}
+		fmt.Printf("  - %s\n", node.Path)
+	}
+	fmt.Println("继续交付时，待交付的变化文件会重新规划，E1 清单仍按扫描时的状态记录其余文件，变化将在下次扫描时处理。")
+	if unattended {
+		return true
+	}
+	return askForConfirmation("是否仍继续该交付? (否则将重新扫描)")
+}
+
+// executeDeliveryLoop 执行交付计划，返回本次交付的结果 (completed、paused 或 aborted)。
+// unattended 为 true 时 (守护进程) 不询问任何问题: 直接开始交付，失败的包留待下次，
+// 受总大小限制未能交付的包也留待下次运行。
+func executeDeliveryLoop(set *types.BackupSet, cfg *types.Config, plan *types.Plan, params *session.DeliveryParams, unattended bool) (sessionResult string) {
 	localReader := bufio.NewReader(os.Stdin)
 	currentPlan := plan
+	workspaceName := set.Name
+	beanckupDir := set.MetadataDir
+
+	// 无论以何种方式结束本次交付，都执行 post_session 钩子
+	sessionResult = "aborted"
+	defer func() {
+		env := hookEnv(set, currentPlan.SessionID)
+		env.Result = sessionResult
+		if err := hooks.Run(cfg.Hooks, hooks.StagePostSession, env); err != nil {
+			log.Printf("警告: %v", err)
+		}
+	}()
 
 	currentParams := &session.DeliveryParams{
 		DeliveryPath:       params.DeliveryPath,
 		Password:           params.Password,
 		CompressionLevel:   params.CompressionLevel,
+		CompressionMethod:  params.CompressionMethod,
 		TotalSizeLimitMB:   params.TotalSizeLimitMB,
 		PackageSizeLimitMB: plan.PackageSizeLimitMB,
+		Mirrors:            params.Mirrors,
+		SpanMedia:          params.SpanMedia,
+		ParallelEpisodes:   params.ParallelEpisodes,
+		Archiver:           params.Archiver,
 	}
+	// 交付包格式在开始交付前确定，未安装 7z 时自动使用原生格式
+	archiver, err := archive.Get(currentParams.Archiver)
+	if err != nil {
+		log.Printf("错误: %v", err)
+		return
+	}
+	if currentParams.Archiver == "" && archiver.Format() != archive.Format7z {
+		fmt.Println("未找到 7z 程序，将使用原生格式 (.bca) 打包。")
+	}
+	// 换盘模式下当前介质的序号，继续之前的计划时从一张新介质开始
+	mediumNumber := session.LastMedium(currentPlan) + 1
+	// 各交付目录的锁，换盘时释放旧介质上的锁
+	deliveryLocks := make(map[string]*lock.Lock)
+	defer func() {
+		for _, l := range deliveryLocks {
+			l.Release()
+		}
+	}()
 
 	for {
+		if err := lockDestinations(currentParams.DeliveryPath, currentParams.Destinations(), deliveryLocks); err != nil {
+			log.Printf("错误: %v", err)
+			return
+		}
+		session.AddDestinations(currentPlan, currentParams.Destinations())
+		catchUpDestinations(beanckupDir, workspaceName, currentPlan)
+
 		runLimitBytes := int64(currentParams.TotalSizeLimitMB) * 1024 * 1024
-		var sizeScheduledForThisRun int64
-		for i := range currentPlan.Episodes {
-			episode := &currentPlan.Episodes[i]
-			if episode.Status == types.EpisodeStatusCompleted {
-				continue
+		var media *util.MediaInfo
+		if currentParams.SpanMedia {
+			var err error
+			if media, err = util.GetMediaInfo(currentParams.DeliveryPath); err != nil {
+				log.Printf("错误: %v", err)
+				return
 			}
-			if runLimitBytes == 0 || (sizeScheduledForThisRun+episode.TotalSize <= runLimitBytes) {
-				episode.Status = types.EpisodeStatusPending
-				sizeScheduledForThisRun += episode.TotalSize
-			} else {
-				episode.Status = types.EpisodeStatusExceededLimit
+			runLimitBytes = session.MediumLimit(media, runLimitBytes)
+			fsNotice := ""
+			if media.MaxFileBytes > 0 {
+				fsNotice = fmt.Sprintf("，%s 单个文件不超过 %.0f MB", media.FSType, float64(media.MaxFileBytes)/1024/1024)
 			}
+			fmt.Printf("\n介质 %d (%s): 剩余空间 %.2f MB%s\n", mediumNumber, currentParams.DeliveryPath, float64(media.FreeBytes)/1024/1024, fsNotice)
 		}
+		session.ScheduleEpisodes(currentPlan, runLimitBytes, 0)
 
 		displayDeliveryProgress(currentPlan, workspaceName) // 【核心修正】: 调用新的显示函数
 
 		if currentPlan.CountPending() == 0 {
-			if !currentPlan.IsCompleted() {
+			if n := countPendingCopies(currentPlan); n > 0 {
+				fmt.Printf("\n有 %d 个包尚未复制到全部交付目录，请在交付目录可用后继续。\n", n)
+			} else if !currentPlan.IsCompleted() && media != nil {
+				fmt.Println("\n当前介质的剩余空间放不下下一个包。如果单个包比整张介质还大，请使用更大的介质，或以不超过介质容量的单包大小限制重新扫描。")
+			} else if !currentPlan.IsCompleted() {
 				fmt.Println("\n根据当前总大小限制，没有可交付的任务。")
 			} else {
 				fmt.Println("\n所有交付任务均已完成。")
 			}
-		} else {
+		} else if !unattended {
 			if !askForConfirmation("是否开始执行交付?") {
 				fmt.Println("取消交付。")
 				return
 			}
 		}
 
-		var deliveryHappened bool
-		for i := range currentPlan.Episodes {
-			episode := &currentPlan.Episodes[i]
-
-			if episode.Status != types.EpisodeStatusPending {
-				continue
-			}
-			deliveryHappened = true
-
-			episode.Status = types.EpisodeStatusInProgress
-			planFilePath, err := session.SavePlan(workspacePath, currentPlan)
-			if err != nil {
-				log.Printf("错误: 保存交付计划失败: %v", err)
-				episode.Status = types.EpisodeStatusPending
-				continue
-			}
-			currentPlan.StatusFilePath = planFilePath
-
-			// --- 【核心流程重构】 ---
-
-			// 1. 生成包名和清单对象
-			episodePackageName := manifest.GeneratePackageName(workspaceName, currentPlan.SessionID, episode.ID)
-
-			// 2. 创建一个包含所有数据文件的临时清单，用于生成 Reference
-			packageManifest := manifest.CreateManifest(workspaceName, currentPlan.SessionID, episode.ID, episodePackageName, episode.Files)
-
-			// 3. 确定引用名 (是否分卷)
-			packageSizeLimitBytes := int64(currentParams.PackageSizeLimitMB) * 1024 * 1024
-			willBeSplit := currentParams.PackageSizeLimitMB > 0 && episode.TotalSize > packageSizeLimitBytes
-
-			// 4. 为清单中的新文件设置正确的引用
-			var finalFilesForManifest []*types.FileNode
-			for _, fileNode := range episode.Files {
-				if fileNode.Reference == "" {
-					refPackageName := episodePackageName
-					if willBeSplit {
-						refPackageName += ".001"
-					}
-					fileNode.Reference = fmt.Sprintf("%s/%s", refPackageName, fileNode.Path)
-				}
-				finalFilesForManifest = append(finalFilesForManifest, fileNode)
-			}
-			if episode.ID == 1 {
-				finalFilesForManifest = append(finalFilesForManifest, types.FilterReferenceFiles(currentPlan.AllNodes)...)
-			}
-			packageManifest.Files = finalFilesForManifest
-
-			// 5. 将最终的清单文件写入工作区的 .beanckup 目录
-			manifestFilePath, err := manifest.SaveManifest(packageManifest, beanckupDir)
-			if err != nil {
-				log.Printf("错误: 无法在工作区创建临时清单: %v", err)
-				episode.Status = types.EpisodeStatusPending
-				session.SavePlan(workspacePath, currentPlan)
-				continue
-			}
-
-			// 6. 准备待打包文件列表，将清单文件也作为一个节点加入
-			filesToPack := make([]*types.FileNode, len(episode.Files))
-			copy(filesToPack, episode.Files)
-
-			manifestRelPath, _ := filepath.Rel(workspacePath, manifestFilePath)
-			manifestInfo, _ := os.Stat(manifestFilePath)
-			manifestNode := &types.FileNode{
-				Path: filepath.ToSlash(manifestRelPath),
-				Size: manifestInfo.Size(),
-			}
-			filesToPack = append(filesToPack, manifestNode)
-
-			// 7. 调用简化的打包器
-			pkg := packager.NewPackager()
-			packageProgress := util.NewProgressDisplay()
-
-			err = pkg.CreatePackage(
-				currentParams.DeliveryPath,
-				episodePackageName,
-				workspacePath,
-				filesToPack,
-				currentParams.Password,
-				currentParams.CompressionLevel,
-				currentParams.PackageSizeLimitMB,
-				func(p packager.Progress) {
-					packageProgress.UpdateProgress("  > 正在处理 [%d/%d]: %d%%", i+1, len(currentPlan.Episodes), p.Percentage)
-				},
-			)
-			packageProgress.Finish()
-
-			// 8. 【核心修正】: 只有在打包失败时才清理临时的清单文件。
-			// 成功后，清单文件必须保留在.beanckup目录作为历史记录。
-			if err != nil {
-				log.Printf("\n错误: 创建交付包 %s 失败: %v", episodePackageName, err)
-				os.Remove(manifestFilePath) // 打包失败，清理掉这个无效的清单
-				episode.Status = types.EpisodeStatusPending
-				session.SavePlan(workspacePath, currentPlan)
-				if !askForConfirmation("交付失败，是否继续尝试下一个包?") {
-					return
-				}
-				continue
-			}
-
-			fmt.Printf("✓ 交付包 %s 已成功创建。\n", episodePackageName)
-			episode.Status = types.EpisodeStatusCompleted
-			session.SavePlan(workspacePath, currentPlan)
+		run := &deliveryRun{
+			set:          set,
+			cfg:          cfg,
+			plan:         currentPlan,
+			params:       currentParams,
+			archiver:     archiver,
+			media:        media,
+			mediumNumber: mediumNumber,
+			unattended:   unattended,
+		}
+		deliveryHappened, aborted := run.deliverPending()
+		if aborted {
+			return
 		}
 
 		if deliveryHappened {
@@ -373,7 +529,19 @@ func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan
 		}
 
 		if currentPlan.IsCompleted() {
+			sessionResult = "completed"
 			fmt.Println("\n★★★ 所有交付任务已成功完成！ ★★★")
+			if err := history.SaveSnapshot(beanckupDir, currentPlan.SessionID); err != nil {
+				log.Printf("警告: 无法保存会话快照: %v", err)
+			} else if err := history.SyncCatalog(beanckupDir); err != nil {
+				log.Printf("警告: 无法更新目录索引: %v", err)
+			}
+			if !currentPlan.ScanStartedAt.IsZero() {
+				if err := watcher.MarkScan(beanckupDir, currentPlan.SessionID, currentPlan.ScanStartedAt); err != nil {
+					log.Printf("警告: 无法更新变更日志的扫描标记: %v", err)
+				}
+			}
+			session.RemoveScanState(beanckupDir, currentPlan)
 			if currentPlan.StatusFilePath != "" {
 				os.Remove(currentPlan.StatusFilePath)
 				fmt.Println("✓ 进度文件已自动清理。")
@@ -381,6 +549,30 @@ func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan
 			return
 		}
 
+		if unattended {
+			sessionResult = "paused"
+			fmt.Println("\n部分交付任务已完成，其余的包将在下次运行时交付。")
+			return
+		}
+
+		// 换盘模式: 当前介质已写满 (或放不下下一个包)，提示标注并更换介质
+		if media != nil {
+			if session.CountOnMedium(currentPlan, mediumNumber) > 0 {
+				fmt.Printf("\n介质 %d 已写满，请在这张介质上标注: %s\n", mediumNumber, session.MediumLabel(workspaceName, currentPlan.SessionID, mediumNumber))
+				mediumNumber++
+			}
+			deliveryLocks[currentParams.DeliveryPath].Release()
+			delete(deliveryLocks, currentParams.DeliveryPath)
+			fmt.Printf("请插入介质 %d 并挂载到 %s，完成后按回车继续 (输入 q 暂停交付): ", mediumNumber, currentParams.DeliveryPath)
+			input, _ := localReader.ReadString('\n')
+			if strings.EqualFold(strings.TrimSpace(input), "q") {
+				sessionResult = "paused"
+				fmt.Println("已暂停交付，您可以稍后重新运行程序继续。")
+				return
+			}
+			continue
+		}
+
 		fmt.Println("\n部分交付任务已完成。")
 		fmt.Println("选项:")
 		fmt.Println("1. 暂时退出程序")
@@ -390,6 +582,7 @@ func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan
 		choice = strings.TrimSpace(choice)
 
 		if choice == "1" {
+			sessionResult = "paused"
 			fmt.Println("已暂停交付，您可以稍后重新运行程序继续。")
 			return
 		} else if choice == "2" {
@@ -400,8 +593,11 @@ func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan
 				return
 			}
 			currentParams.DeliveryPath = resumeParams.DeliveryPath
+			currentParams.Mirrors = resumeParams.Mirrors
+			currentParams.SpanMedia = resumeParams.SpanMedia
 			currentParams.Password = resumeParams.Password
 			currentParams.CompressionLevel = resumeParams.CompressionLevel
+			currentParams.CompressionMethod = resumeParams.CompressionMethod
 			currentParams.TotalSizeLimitMB = resumeParams.TotalSizeLimitMB
 		} else {
 			fmt.Println("无效选择，程序将退出。")
@@ -410,119 +606,221 @@ func executeDeliveryLoop(workspacePath, workspaceName, beanckupDir string, plan
 	}
 }
 
-func executeDelivery(episode *types.Episode, workspacePath, workspaceName, beanckupDir string, plan *types.Plan, params *session.DeliveryParams) {
-	episode.Status = types.EpisodeStatusInProgress
-	session.SavePlan(workspacePath, plan) // 更新状态
-
-	timestamp := time.Now().Format("060102_150405")
-	// 【核心修正】: 文件名使用下划线
-	pkgName := fmt.Sprintf("%s_S%02dE%02d_%s.7z", workspaceName, plan.SessionID, episode.ID, timestamp)
-
-	fmt.Printf("\n--- 正在交付 [E%02d]: %s ---\n", episode.ID, pkgName)
+// lockDestinations 锁定当前可用、尚未锁定的交付目录，并释放已不再使用的交付目录的锁。
+// 只有主交付目录 primary 会在需要时被创建，镜像目录必须已存在。
+// 不可用的目录 (如未挂载的移动硬盘) 在之后变为可用时再锁定。
+func lockDestinations(primary string, destinations []string, held map[string]*lock.Lock) error {
+	if err := session.CreateDeliveryPath(primary); err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, destination := range destinations {
+		inUse[destination] = true
+		if held[destination] != nil || !session.DestinationAvailable(destination) {
+			continue
+		}
+		l, err := lock.Acquire(destination, "交付")
+		if err != nil {
+			return err
+		}
+		held[destination] = l
+	}
+	for destination, l := range held {
+		if !inUse[destination] {
+			l.Release()
+			delete(held, destination)
+		}
+	}
+	return nil
+}
 
-	// 1. 生成包名和清单对象
-	episodePackageName := manifest.GeneratePackageName(workspaceName, plan.SessionID, episode.ID)
+// errMediumFull 表示包的实际大小超过了当前介质的剩余空间
+var errMediumFull = errors.New("当前介质的剩余空间不足")
 
-	// 2. 创建一个包含所有数据文件的临时清单，用于生成 Reference
-	packageManifest := manifest.CreateManifest(workspaceName, plan.SessionID, episode.ID, episodePackageName, episode.Files)
+// moveStagedPackage 将临时目录中打包完成的包复制到介质上并校验。复制前按实际大小检查介质的剩余空间，
+// 放不下时返回 errMediumFull，该包留待下一张介质。
+func moveStagedPackage(stageDir, mediumPath, packageName string, episodeID int) error {
+	inv, err := inventory.Describe(stageDir, packageName, episodeID)
+	if err != nil {
+		return err
+	}
+	media, err := util.GetMediaInfo(mediumPath)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, v := range inv.Volumes {
+		size += v.Size
+	}
+	if size > media.FreeBytes-session.MediumReserveBytes {
+		return fmt.Errorf("%w: 包实际大小 %.2f MB，剩余 %.2f MB", errMediumFull, float64(size)/1024/1024, float64(media.FreeBytes)/1024/1024)
+	}
+	fmt.Printf("  正在写入介质 %s ...\n", mediumPath)
+	return inv.Copy(stageDir, mediumPath)
+}
 
-	// 3. 确定引用名 (是否分卷)
-	packageSizeLimitBytes := int64(params.PackageSizeLimitMB) * 1024 * 1024
-	willBeSplit := params.PackageSizeLimitMB > 0 && episode.TotalSize > packageSizeLimitBytes
+// copyToDestinations 将已完成的包复制到其尚未写入且当前可用的交付目录并校验，返回复制成功的目录，
+// 由调用者将其标记为已完成。不可用或复制失败的目录保持待交付状态，下次运行时补齐。
+func copyToDestinations(beanckupDir, workspaceName string, plan *types.Plan, episode *types.Episode, inv *inventory.Package) []string {
+	source := ""
+	for _, d := range episode.Destinations {
+		if d.Status == types.EpisodeStatusCompleted && len(inv.Check(d.Path, false)) == 0 {
+			source = d.Path
+			break
+		}
+	}
+	if source == "" {
+		log.Printf("警告: 找不到交付包 %s 的完整副本，无法复制到其余交付目录。", inv.Name)
+		return nil
+	}
+	var copied []string
+	for _, destination := range episode.PendingDestinations() {
+		if !session.DestinationAvailable(destination) {
+			log.Printf("警告: 交付目录 %s 当前不可用，交付包 %s 将在下次运行时补齐。", destination, inv.Name)
+			continue
+		}
+		fmt.Printf("  正在复制到 %s ...\n", destination)
+		if err := inv.Copy(source, destination); err != nil {
+			log.Printf("警告: 无法将交付包 %s 复制到 %s: %v", inv.Name, destination, err)
+			continue
+		}
+		if err := inventory.Record(beanckupDir, destination, workspaceName, plan.SessionID, plan.SessionNote, inv); err != nil {
+			log.Printf("警告: 无法更新会话索引: %v", err)
+		}
+		copied = append(copied, destination)
+		fmt.Printf("  ✓ 已复制并校验: %s\n", destination)
+	}
+	return copied
+}
 
-	// 4. 为清单中的新文件设置正确的引用
-	var finalFilesForManifest []*types.FileNode
-	for _, fileNode := range episode.Files {
-		if fileNode.Reference == "" {
-			refPackageName := episodePackageName
-			if willBeSplit {
-				refPackageName += ".001"
+// catchUpDestinations 为之前已完成、但未能写入全部交付目录的包补齐副本
+func catchUpDestinations(beanckupDir, workspaceName string, plan *types.Plan) {
+	if countPendingCopies(plan) == 0 {
+		return
+	}
+	index, err := inventory.Load(inventory.MetadataPath(beanckupDir, workspaceName, plan.SessionID))
+	if err != nil {
+		log.Printf("警告: 无法读取会话索引，暂不补齐交付目录: %v", err)
+		return
+	}
+	for i := range plan.Episodes {
+		episode := &plan.Episodes[i]
+		if episode.Status != types.EpisodeStatusCompleted || len(episode.PendingDestinations()) == 0 {
+			continue
+		}
+		for _, pkg := range index.Packages {
+			if pkg.EpisodeID == episode.ID {
+				fmt.Printf("补齐交付包 %s 的副本:\n", pkg.Name)
+				for _, destination := range copyToDestinations(beanckupDir, workspaceName, plan, episode, pkg) {
+					session.MarkDestination(episode, destination)
+				}
+				break
 			}
-			fileNode.Reference = fmt.Sprintf("%s/%s", refPackageName, fileNode.Path)
 		}
-		finalFilesForManifest = append(finalFilesForManifest, fileNode)
 	}
-	if episode.ID == 1 {
-		finalFilesForManifest = append(finalFilesForManifest, types.FilterReferenceFiles(plan.AllNodes)...)
+	if planFilePath, err := session.SavePlan(beanckupDir, workspaceName, plan); err != nil {
+		log.Printf("警告: 保存交付计划失败: %v", err)
+	} else {
+		plan.StatusFilePath = planFilePath
 	}
-	packageManifest.Files = finalFilesForManifest
+}
 
-	// 5. 将最终的清单文件写入工作区的 .beanckup 目录
-	manifestFilePath, err := manifest.SaveManifest(packageManifest, beanckupDir)
-	if err != nil {
-		log.Printf("错误: 无法保存清单文件到历史记录: %v", err)
-		// 这是一个非关键性错误，只记录日志，不中断流程
-	}
-
-	// 6. 准备待打包文件列表，将清单文件也作为一个节点加入
-	filesToPack := make([]*types.FileNode, len(episode.Files))
-	copy(filesToPack, episode.Files)
-
-	manifestRelPath, _ := filepath.Rel(workspacePath, manifestFilePath)
-	manifestInfo, _ := os.Stat(manifestFilePath)
-	manifestNode := &types.FileNode{
-		Path: filepath.ToSlash(manifestRelPath),
-		Size: manifestInfo.Size(),
-	}
-	filesToPack = append(filesToPack, manifestNode)
-
-	// 7. 调用简化的打包器
-	pkg := packager.NewPackager()
-	packageProgress := util.NewProgressDisplay()
-
-	err = pkg.CreatePackage(
-		params.DeliveryPath,
-		episodePackageName,
-		workspacePath,
-		filesToPack,
-		params.Password,
-		params.CompressionLevel,
-		params.PackageSizeLimitMB,
-		func(p packager.Progress) {
-			packageProgress.UpdateProgress("  > 正在处理 [%d/%d]: %d%%", episode.ID, len(plan.Episodes), p.Percentage)
-		},
-	)
-	packageProgress.Finish()
-
-	// 8. 【核心修正】: 只有在打包失败时才清理临时的清单文件。
-	// 成功后，清单文件必须保留在.beanckup目录作为历史记录。
-	if err != nil {
-		log.Printf("\n错误: 创建交付包 %s 失败: %v", episodePackageName, err)
-		os.Remove(manifestFilePath) // 打包失败，清理掉这个无效的清单
-		episode.Status = types.EpisodeStatusPending
-		session.SavePlan(workspacePath, plan)
-		if !askForConfirmation("交付失败，是否继续尝试下一个包?") {
-			return
+// countPendingCopies 统计已打包、但尚未写入全部交付目录的包数量
+func countPendingCopies(plan *types.Plan) int {
+	count := 0
+	for _, episode := range plan.Episodes {
+		if episode.Status == types.EpisodeStatusCompleted && len(episode.PendingDestinations()) > 0 {
+			count++
 		}
-		return
 	}
+	return count
+}
 
-	fmt.Printf("✅ 交付包 %s 创建成功!\n", pkgName)
+// recordActualSize 记录包的实际大小，并用它与估算值的差异校正之后的压缩估算
+func recordActualSize(beanckupDir string, episode *types.Episode, inv *inventory.Package, params *session.DeliveryParams) {
+	episode.ActualSize = 0
+	for _, v := range inv.Volumes {
+		episode.ActualSize += v.Size
+	}
+	if params.CompressionLevel == 0 || episode.EstimatedSize == 0 || episode.EstimatedSize == episode.TotalSize {
+		return
+	}
+	fmt.Printf("  实际大小 %.2f MB，估算 %.2f MB\n", float64(episode.ActualSize)/1024/1024, float64(episode.EstimatedSize)/1024/1024)
+	estimator, err := compression.LoadEstimator(beanckupDir)
+	if err != nil {
+		log.Printf("警告: %v", err)
+		return
+	}
+	estimator.Observe(params.CompressionMethod, episode)
+	if err := estimator.Save(); err != nil {
+		log.Printf("警告: %v", err)
+	}
+}
 
-	// 9. 更新计划状态并保存
-	episode.Status = types.EpisodeStatusCompleted
-	if _, err := session.SavePlan(workspacePath, plan); err != nil {
-		log.Printf("错误: 更新交付计划失败: %v", err)
+// reportInconsistentFiles 报告在扫描之后内容发生变化 (或仍在写入) 的文件
+func reportInconsistentFiles(files []*types.FileNode) {
+	fmt.Printf("\n⚠️  检测到 %d 个文件在扫描之后发生了变化，其内容与清单中的哈希不一致:\n", len(files))
+	for _, node := range files {
+		fmt.Printf("  - %s\n", node.Path)
 	}
 }
 
-func analyzeFileChanges(allNodes []*types.FileNode, histState *types.HistoricalState) (newCount, movedCount, deletedCount int, newSize int64) {
-	currentFilesByPath := make(map[string]*types.FileNode)
-	for _, node := range allNodes {
-		if !node.IsDirectory() {
-			currentFilesByPath[node.Path] = node
+// replanInconsistentFiles 以文件的当前状态重新计算哈希，并将其追加为计划中的一个新 episode
+func replanInconsistentFiles(plan *types.Plan, set *types.BackupSet, files []*types.FileNode) {
+	if len(files) == 0 {
+		return
+	}
+	var refreshed []*types.FileNode
+	for _, node := range files {
+		node.EstimatedSize = 0 // 内容已变化，原先的压缩估算不再适用
+		if err := indexer.RefreshNode(set, node); err != nil {
+			log.Printf("警告: 文件 '%s' 已无法读取，本次将不再交付: %v", node.Path, err)
+			node.Reference = ""
+			continue
 		}
+		refreshed = append(refreshed, node)
+	}
+	if len(refreshed) > 0 {
+		episodeID := session.AppendEpisode(plan, refreshed)
+		fmt.Printf("已将 %d 个不一致的文件重新规划到交付包 E%02d。\n", len(refreshed), episodeID)
 	}
+}
 
-	historicalFilesByPath := make(map[string]*types.FileNode)
-	if histState != nil {
-		for path, node := range histState.PathToNode {
-			if !node.IsDirectory() {
-				historicalFilesByPath[path] = node
-			}
+// saveSignedManifest 保存清单，并在配置了签名私钥时写入其分离签名
+func saveSignedManifest(m *types.Manifest, beanckupDir string) (string, error) {
+	manifestFilePath, err := manifest.SaveManifest(m, beanckupDir)
+	if err != nil {
+		return "", err
+	}
+	if err := signing.Default().SignFile(manifestFilePath); err != nil {
+		os.Remove(manifestFilePath)
+		return "", fmt.Errorf("无法为清单签名: %w", err)
+	}
+	return manifestFilePath, nil
+}
+
+// removeManifest 删除清单及其签名
+func removeManifest(manifestFilePath string) {
+	os.Remove(manifestFilePath)
+	os.Remove(signing.SigPath(manifestFilePath))
+}
+
+// excludeFiles 返回不包含指定节点的新文件列表
+func excludeFiles(nodes []*types.FileNode, exclude []*types.FileNode) []*types.FileNode {
+	excluded := make(map[*types.FileNode]bool, len(exclude))
+	for _, node := range exclude {
+		excluded[node] = true
+	}
+	var kept []*types.FileNode
+	for _, node := range nodes {
+		if !excluded[node] {
+			kept = append(kept, node)
 		}
 	}
+	return kept
+}
 
+func analyzeFileChanges(allNodes []*types.FileNode, histState *types.HistoricalState) (newCount, movedCount int, newSize int64) {
 	for _, node := range allNodes {
 		if node.IsDirectory() {
 			continue
@@ -530,27 +828,12 @@ func analyzeFileChanges(allNodes []*types.FileNode, histState *types.HistoricalS
 		if node.Reference == "" {
 			newCount++
 			newSize += node.Size
-		} else {
-			if _, exists := historicalFilesByPath[node.Path]; !exists {
+		} else if histState != nil {
+			if _, exists := histState.PathToNode[node.Path]; !exists {
 				movedCount++
 			}
 		}
 	}
-
-	for path, histNode := range historicalFilesByPath {
-		if _, exists := currentFilesByPath[path]; !exists {
-			isMoved := false
-			for _, currentNode := range allNodes {
-				if currentNode.Hash == histNode.Hash {
-					isMoved = true
-					break
-				}
-			}
-			if !isMoved {
-				deletedCount++
-			}
-		}
-	}
 	return
 }
 
@@ -562,35 +845,27 @@ func displayScanResults(newCount, movedCount, deletedCount int, newSize int64) {
 	fmt.Printf("增量文件总大小: %.2f MB\n", float64(newSize)/1024/1024)
 }
 
-func askForDeliveryParams(totalNewSizeBytes int64) *session.DeliveryParams {
+func askForDeliveryParams(totalNewSizeBytes int64, defaultPacking types.PackingMode) *session.DeliveryParams {
 	params := &session.DeliveryParams{}
 	localReader := bufio.NewReader(os.Stdin)
 
 	fmt.Println("\n=== 交付参数设置 ===")
-	fmt.Print("请输入交付包保存路径 (回车使用默认: ./delivery): ")
-	input, _ := localReader.ReadString('\n')
-	params.DeliveryPath = strings.TrimSpace(input)
-	if params.DeliveryPath == "" {
-		params.DeliveryPath = "./delivery"
-	}
+	askForDestinations(localReader, params)
 
 	fmt.Printf("增量文件总大小: %.2f MB\n", float64(totalNewSizeBytes)/1024/1024)
 
-	fmt.Print("请输入本次交付的总大小限制 (MB, 回车表示无限制): ")
-	input, _ = localReader.ReadString('\n')
-	if size, err := strconv.Atoi(strings.TrimSpace(input)); err == nil && size > 0 {
-		params.TotalSizeLimitMB = size
-	} else {
-		params.TotalSizeLimitMB = 0
-	}
+	askForSizeLimit(localReader, params)
 
 	fmt.Print("请输入单个包大小限制 (MB, 回车表示不分割): ")
-	input, _ = localReader.ReadString('\n')
+	input, _ := localReader.ReadString('\n')
 	if size, err := strconv.Atoi(strings.TrimSpace(input)); err == nil && size > 0 {
 		params.PackageSizeLimitMB = size
 	} else {
 		params.PackageSizeLimitMB = 0 // 明确设置为0表示不分割
 	}
+	if params.PackageSizeLimitMB > 0 {
+		params.PackingMode = askForPackingMode(localReader, defaultPacking)
+	}
 
 	fmt.Print("请输入压缩级别 (0-9, 回车使用默认 0): ")
 	input, _ = localReader.ReadString('\n')
@@ -599,24 +874,62 @@ func askForDeliveryParams(totalNewSizeBytes int64) *session.DeliveryParams {
 	} else {
 		params.CompressionLevel = 0
 	}
+	params.CompressionMethod = askForCompressionMethod(localReader, params.CompressionLevel)
 
 	fmt.Print("请输入加密密码 (回车表示不加密): ")
 	input, _ = localReader.ReadString('\n')
 	params.Password = strings.TrimSpace(input)
 
+	params.Note = askForSessionNote(localReader)
+
 	return params
 }
 
-func askForResumeDeliveryParams() *session.DeliveryParams {
-	params := &session.DeliveryParams{}
-	localReader := bufio.NewReader(os.Stdin)
+// askForSessionNote 询问本次备份的标签和标记，设置了其中之一时再询问备注
+func askForSessionNote(localReader *bufio.Reader) types.SessionNote {
+	var note types.SessionNote
+	fmt.Print("请输入本次备份的标签，如 \"迁移到 v3 之前\" (回车跳过): ")
+	input, _ := localReader.ReadString('\n')
+	note.Label = strings.TrimSpace(input)
+	fmt.Print("请输入标记，多个用逗号分隔，如 archive, keep (回车跳过): ")
+	input, _ = localReader.ReadString('\n')
+	note.Tags = types.ParseTags(input)
+	if note.IsEmpty() {
+		return note
+	}
+	fmt.Print("请输入备注 (回车跳过): ")
+	input, _ = localReader.ReadString('\n')
+	note.Notes = strings.TrimSpace(input)
+	return note
+}
 
-	fmt.Print("请输入交付包保存路径 (回车使用默认: ./delivery): ")
+// askForDestinations 询问交付目录，多个目录用 ; 分隔: 第一个为主交付目录，其余为镜像目录
+func askForDestinations(localReader *bufio.Reader, params *session.DeliveryParams) {
+	fmt.Print("请输入交付包保存路径，多个目录用 ; 分隔 (回车使用默认: ./delivery): ")
 	input, _ := localReader.ReadString('\n')
-	params.DeliveryPath = strings.TrimSpace(input)
+	for _, path := range strings.Split(input, ";") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if params.DeliveryPath == "" {
+			params.DeliveryPath = path
+		} else {
+			params.Mirrors = append(params.Mirrors, path)
+		}
+	}
 	if params.DeliveryPath == "" {
 		params.DeliveryPath = "./delivery"
 	}
+}
+
+// askForSizeLimit 询问是否按介质剩余空间交付 (换盘模式)，否则询问本次交付的总大小限制
+func askForSizeLimit(localReader *bufio.Reader, params *session.DeliveryParams) {
+	fmt.Print("是否按介质剩余空间分批交付，写满后提示更换光盘或 U 盘? (y/n, 回车表示否): ")
+	input, _ := localReader.ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(input)) == "y" {
+		params.SpanMedia = true
+		return
+	}
 
 	fmt.Print("请输入本次交付的总大小限制 (MB, 回车表示无限制): ")
 	input, _ = localReader.ReadString('\n')
@@ -625,17 +938,63 @@ func askForResumeDeliveryParams() *session.DeliveryParams {
 	} else {
 		params.TotalSizeLimitMB = 0
 	}
+}
+
+// askForPackingMode 询问新文件分配到各包的方式，默认值来自配置文件
+func askForPackingMode(localReader *bufio.Reader, defaultMode types.PackingMode) types.PackingMode {
+	if defaultMode == "" {
+		defaultMode = types.PackingSequential
+	}
+	fmt.Printf("请选择分包方式 (sequential=按路径顺序/ffd=最少包数/locality=按目录聚集, 回车使用默认 %s): ", defaultMode)
+	input, _ := localReader.ReadString('\n')
+	switch mode := types.PackingMode(strings.ToLower(strings.TrimSpace(input))); mode {
+	case types.PackingSequential, types.PackingFFD, types.PackingLocality:
+		return mode
+	}
+	return defaultMode
+}
+
+func packingModeName(mode types.PackingMode) string {
+	switch mode {
+	case types.PackingFFD:
+		return "最少包数 (ffd)"
+	case types.PackingLocality:
+		return "按目录聚集 (locality)"
+	}
+	return "按路径顺序 (sequential)"
+}
+
+// askForCompressionMethod 在启用压缩时询问可压缩文件使用的方法，已压缩过的文件总是仅存储。
+func askForCompressionMethod(localReader *bufio.Reader, compressionLevel int) types.CompressionMethod {
+	if compressionLevel == 0 {
+		return types.CompressionStore
+	}
+	fmt.Print("请选择压缩方法 (lzma2/ppmd/gzip/store, 回车使用默认 lzma2): ")
+	input, _ := localReader.ReadString('\n')
+	if method, ok := compression.ParseMethod(input); ok {
+		return method
+	}
+	return types.CompressionLZMA2
+}
+
+func askForResumeDeliveryParams() *session.DeliveryParams {
+	params := &session.DeliveryParams{}
+	localReader := bufio.NewReader(os.Stdin)
+
+	askForDestinations(localReader, params)
+	askForSizeLimit(localReader, params)
 
 	// 移除了对 PackageSizeLimitMB 的提问，因为它已保存在 Plan 中
 	// 压缩级别和密码也应在恢复时重新确认
 
 	fmt.Print("请输入压缩级别 (0-9, 回车使用默认 0): ")
-	input, _ = localReader.ReadString('\n')
+	input, _ := localReader.ReadString('\n')
 	if level, err := strconv.Atoi(strings.TrimSpace(input)); err == nil && level >= 0 && level <= 9 {
 		params.CompressionLevel = level
 	} else {
 		params.CompressionLevel = 0
 	}
+	params.CompressionMethod = askForCompressionMethod(localReader, params.CompressionLevel)
 
 	fmt.Print("请输入加密密码 (回车表示不加密): ")
 	input, _ = localReader.ReadString('\n')
@@ -671,6 +1030,10 @@ func handleRestore() {
 		return
 	}
 
+	if metadataDir := askForCatalogWorkspace(); metadataDir != "" {
+		res.UseCatalog(metadataDir)
+	}
+
 	password := askForPassword()
 	err = res.LoadSessionManifests(selectedSession, password)
 	if err != nil {
@@ -678,49 +1041,97 @@ func handleRestore() {
 		return
 	}
 
+	rootName := askForRestoreRoot(selectedSession.SessionRoots())
+
 	restorePath := askForRestorePath()
 	if !confirmRestore(selectedSession, restorePath, password) {
 		fmt.Println("恢复操作已取消。")
 		return
 	}
 
-	if err = res.RestoreFromSession(selectedSession, restorePath, password); err != nil {
+	finalRestorePath, err := res.RestoreFromSession(selectedSession, rootName, restorePath, password)
+	if err != nil {
 		log.Printf("错误: 恢复失败: %v\n", err)
 	} else {
-		workspaceName := "workspace"
-		if len(selectedSession.Manifests) > 0 {
-			workspaceName = util.GetWorkspaceName(selectedSession.Manifests[0].WorkspaceName)
-		}
-		ts := selectedSession.Timestamp.Format("060102_150405")
-		recoveryDir := fmt.Sprintf("%s_S%d_%s_Recovery", workspaceName, selectedSession.SessionID, ts)
-		finalRestorePath := filepath.Join(restorePath, recoveryDir)
 		fmt.Println("\n✓ 恢复成功！文件已存至:", finalRestorePath)
 	}
 }
 
+// askForRestoreRoot 对多源目录备份集询问要恢复的源目录，返回空字符串表示恢复全部
+func askForRestoreRoot(roots []string) string {
+	if len(roots) == 0 {
+		return ""
+	}
+	fmt.Println("\n该备份集包含以下源目录:")
+	for i, name := range roots {
+		fmt.Printf("  [%d] %s\n", i+1, name)
+	}
+	fmt.Print("请选择要单独恢复的源目录 (回车恢复全部): ")
+	choice, _ := reader.ReadString('\n')
+	index, err := strconv.Atoi(strings.TrimSpace(choice))
+	if err != nil || index < 1 || index > len(roots) {
+		return ""
+	}
+	return roots[index-1]
+}
+
 func selectSessionToRestoreUI(sessions []*restorer.DeliverySession) (*restorer.DeliverySession, error) {
-	fmt.Printf("\n发现 %d 个备份记录:\n", len(sessions))
-	for i, session := range sessions {
-		// 预加载以获取时间戳等信息
-		if len(session.Manifests) > 0 {
-			fmt.Printf("  [%d] %s (S%d) - %s\n",
-				i+1,
-				session.Manifests[0].WorkspaceName,
-				session.SessionID,
-				session.Timestamp.Format("2006-01-02 15:04:05"))
-		} else {
-			// 如果没有清单，可能是旧格式或损坏的
-			fmt.Printf("  [%d] S%d - (时间戳未知)\n", i+1, session.SessionID)
+	for {
+		fmt.Printf("\n发现 %d 个备份记录:\n", len(sessions))
+		for i, session := range sessions {
+			// 预加载以获取时间戳等信息
+			if len(session.Manifests) > 0 {
+				fmt.Printf("  [%d] %s (S%d) - %s",
+					i+1,
+					session.Manifests[0].WorkspaceName,
+					session.SessionID,
+					session.Timestamp.Format("2006-01-02 15:04:05"))
+			} else {
+				// 如果没有清单，可能是旧格式或损坏的
+				fmt.Printf("  [%d] S%d - (时间戳未知)", i+1, session.SessionID)
+			}
+			if !session.Note.IsEmpty() {
+				fmt.Printf("  %s", session.Note)
+			}
+			fmt.Println()
+			if session.Note.Notes != "" {
+				fmt.Printf("      备注: %s\n", session.Note.Notes)
+			}
+			for _, problem := range session.Problems {
+				fmt.Printf("      ⚠ %s\n", problem)
+			}
+		}
+		fmt.Print("\n请选择要恢复的备份记录 (1-", len(sessions), "，或输入文字按标签筛选，如 tag:archive): ")
+		choice, _ := reader.ReadString('\n')
+		choice = strings.TrimSpace(choice)
+		choiceIndex, err := strconv.Atoi(choice)
+		if err == nil {
+			if choiceIndex < 1 || choiceIndex > len(sessions) {
+				return nil, fmt.Errorf("无效选择，返回主菜单")
+			}
+			return sessions[choiceIndex-1], nil
 		}
+		if choice == "" {
+			return nil, fmt.Errorf("无效选择，返回主菜单")
+		}
+		matched := filterDeliverySessions(sessions, choice)
+		if len(matched) == 0 {
+			fmt.Printf("没有与 '%s' 匹配的备份记录。\n", choice)
+			continue
+		}
+		sessions = matched
 	}
-	fmt.Print("\n请选择要恢复的备份记录 (1-", len(sessions), "): ")
-	choice, _ := reader.ReadString('\n')
-	choice = strings.TrimSpace(choice)
-	choiceIndex, err := strconv.Atoi(choice)
-	if err != nil || choiceIndex < 1 || choiceIndex > len(sessions) {
-		return nil, fmt.Errorf("无效选择，返回主菜单")
+}
+
+// filterDeliverySessions 返回标签、备注或标记满足筛选条件的会话
+func filterDeliverySessions(sessions []*restorer.DeliverySession, filter string) []*restorer.DeliverySession {
+	var matched []*restorer.DeliverySession
+	for _, session := range sessions {
+		if session.Note.Matches(filter) {
+			matched = append(matched, session)
+		}
 	}
-	return sessions[choiceIndex-1], nil
+	return matched
 }
 
 func askForPassword() string {
@@ -752,6 +1163,26 @@ func askForDeliveryPath() string {
 	return deliveryPath
 }
 
+// askForCatalogWorkspace 询问原工作区 (可选)。若其元数据目录仍在，可直接使用目录索引而无需从每个包中解压清单。
+func askForCatalogWorkspace() string {
+	fmt.Print("若原工作区的元数据仍在，可输入工作区路径或备份集定义以加快读取 (回车跳过): ")
+	path, _ := reader.ReadString('\n')
+	path = strings.Trim(strings.TrimSpace(path), "\"")
+	if path == "" {
+		return ""
+	}
+	set, err := backupset.Open(path)
+	if err != nil {
+		fmt.Printf("警告: 无法打开工作区 '%s': %v，将从交付包中读取清单。\n", path, err)
+		return ""
+	}
+	if _, err := os.Stat(set.MetadataDir); err != nil {
+		fmt.Printf("警告: 元数据目录 '%s' 不存在，将从交付包中读取清单。\n", set.MetadataDir)
+		return ""
+	}
+	return set.MetadataDir
+}
+
 func askForRestorePath() string {
 	fmt.Print("请输入恢复目标路径 (回车使用默认): ")
 	restorePath, _ := reader.ReadString('\n')